@@ -0,0 +1,456 @@
+package faas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+var (
+	// ErrRelayGone is returned when the relay no longer has the request.
+	// This typically means the caller has already been given a response.
+	ErrRelayGone = errors.New("relay no longer has the request")
+
+	// ErrResponseRejected is returned when the relay does not accept the
+	// response.
+	ErrResponseRejected = errors.New("relay rejected the response")
+
+	// ErrTokenRejected is returned when the relay does not accept the
+	// token. It has either expired or already been used.
+	ErrTokenRejected = errors.New("relay rejected the token")
+)
+
+// Client talks to the relay (and worker for resident processes) on behalf
+// of a Handler. Unlike Start and Serve, it returns errors instead of
+// exiting the process.
+type Client struct {
+	relay       relay
+	workAddr    string
+	appInstance string
+	httpClient  *http.Client
+	policy      RetryPolicy
+	errorBodies bool
+	debug       bool
+	log         *log.Logger
+}
+
+// RetryPolicy configures how a Client retries failed requests. Only network
+// errors and 5xx status codes are retried. The delay between attempts starts
+// at Backoff and doubles each time up to MaxBackoff. A relay token can only
+// be used once, so a request with one is only retried if it was never sent
+// (e.g., the connection was refused).
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithRelayAddr sets the relay address. It defaults to CF_FAAS_RELAY_ADDR.
+func WithRelayAddr(addr string) ClientOption {
+	return func(c *Client) {
+		c.relay.addr = addr
+	}
+}
+
+// WithRelayToken sets the token that authenticates requests to the relay.
+// It defaults to CF_FAAS_RELAY_TOKEN.
+func WithRelayToken(token string) ClientOption {
+	return func(c *Client) {
+		c.relay.token = token
+	}
+}
+
+// WithWorkAddr sets the address resident processes fetch work from. It
+// defaults to CF_FAAS_WORK_ADDR.
+func WithWorkAddr(addr string) ClientOption {
+	return func(c *Client) {
+		c.workAddr = addr
+	}
+}
+
+// WithAppInstance sets the X-CF-APP-INSTANCE header. It defaults to
+// X_CF_APP_INSTANCE.
+func WithAppInstance(appInstance string) ClientOption {
+	return func(c *Client) {
+		c.appInstance = appInstance
+	}
+}
+
+// WithHTTPClient sets the HTTP client. It defaults to http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) ClientOption {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetryPolicy sets the RetryPolicy. It defaults to 3 attempts starting
+// with a 100ms backoff.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.policy = p
+	}
+}
+
+// WithLogger sets the logger. It defaults to writing to stderr.
+func WithLogger(log *log.Logger) ClientOption {
+	return func(c *Client) {
+		c.log = log
+	}
+}
+
+// WithErrorBodies makes error responses include a JSON ErrorBody. It
+// defaults to CF_FAAS_ERROR_BODIES.
+func WithErrorBodies() ClientOption {
+	return func(c *Client) {
+		c.errorBodies = true
+	}
+}
+
+// WithDebug includes the stack trace of a panic in the ErrorBody. It
+// defaults to CF_FAAS_DEBUG.
+func WithDebug() ClientOption {
+	return func(c *Client) {
+		c.debug = true
+	}
+}
+
+// NewClient returns a new Client. It is configured from the environment
+// and then the given options.
+func NewClient(opts ...ClientOption) (*Client, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		relay:       relay{addr: cfg.RelayAddr, token: cfg.RelayToken},
+		workAddr:    cfg.WorkAddr,
+		appInstance: cfg.AppInstance,
+		httpClient:  http.DefaultClient,
+		policy: RetryPolicy{
+			Attempts:   3,
+			Backoff:    100 * time.Millisecond,
+			MaxBackoff: 2 * time.Second,
+		},
+		errorBodies: cfg.ErrorBodies,
+		debug:       cfg.Debug,
+		log:         log.New(os.Stderr, "[FAAS HANDLER] ", log.LstdFlags),
+	}
+
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c, nil
+}
+
+// Run fetches a single request, hands it to the Handler and POSTs the
+// results. An error from the Handler results in a 500 and is not returned.
+func (c *Client) Run(h Handler) error {
+	if c.relay.addr == "" {
+		return errors.New("CF_FAAS_RELAY_ADDR is required")
+	}
+
+	return c.handle(h, c.relay)
+}
+
+// Serve handles requests until the worker says to stop. Failures for a
+// single request are logged and do not stop the loop.
+func (c *Client) Serve(h Handler) error {
+	if c.workAddr == "" {
+		return errors.New("CF_FAAS_WORK_ADDR is required")
+	}
+
+	for {
+		r, ok, err := c.getWork()
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return nil
+		}
+
+		if r.addr == "" {
+			continue
+		}
+
+		if err := c.handle(h, r); err != nil {
+			c.log.Printf("failed to handle request: %s", err)
+		}
+	}
+}
+
+// relay is where a single request is fetched from and its response is sent
+// to. The token is only good for that request.
+type relay struct {
+	addr  string
+	token string
+}
+
+func (c *Client) handle(h Handler, r relay) error {
+	if sh, ok := h.(StreamHandler); ok {
+		return c.handleStream(sh, r)
+	}
+
+	request, multipart, err := c.getRequest(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if request.Timeout > 0 {
+		var timeoutCancel func()
+		ctx, timeoutCancel = context.WithTimeout(ctx, request.Timeout)
+		defer timeoutCancel()
+	}
+
+	resp, err := invoke(func() (Response, error) {
+		if ch, ok := h.(ContextHandler); ok {
+			return ch.HandleContext(ctx, request)
+		}
+		return h.Handle(request)
+	})
+
+	// The caller has already been given a response, there is nobody to
+	// send the results to.
+	if ctx.Err() != nil {
+		c.log.Printf("deadline exceeded, dropping response")
+		return nil
+	}
+
+	if err != nil {
+		c.logHandlerError(err)
+		return c.postResponse(r, c.errorResponse(request, err), multipart)
+	}
+
+	return c.postResponse(r, resp, multipart)
+}
+
+func (c *Client) logHandlerError(err error) {
+	if pe, ok := err.(panicError); ok {
+		c.log.Printf("%s\n%s", pe, pe.stack)
+		return
+	}
+
+	c.log.Printf("handler error: %s", err)
+}
+
+// getWork long-polls the worker for the next relay. It returns false if the
+// process should exit and an empty address if there wasn't any work.
+func (c *Client) getWork() (relay, bool, error) {
+	resp, err := c.do(http.MethodGet, c.workAddr, nil, nil)
+	if err != nil {
+		return relay{}, false, fmt.Errorf("failed to GET work: %s", err)
+	}
+	defer c.drain(resp)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return relay{}, true, nil
+	case http.StatusGone:
+		return relay{}, false, nil
+	default:
+		data, _ := ioutil.ReadAll(resp.Body)
+		return relay{}, false, fmt.Errorf("unexpected status code while GETting work %d: %s", resp.StatusCode, data)
+	}
+
+	var w struct {
+		Href  string `json:"href"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&w); err != nil {
+		return relay{}, false, fmt.Errorf("failed to unmarshal work: %s", err)
+	}
+	return relay{addr: w.Href, token: w.Token}, true, nil
+}
+
+// getRequest fetches the request from the relay. It reports whether the
+// relay used the multipart encoding.
+func (c *Client) getRequest(rl relay) (Request, bool, error) {
+	r, body, resp, err := c.fetchRequest(rl)
+	if err != nil {
+		return Request{}, false, err
+	}
+	defer c.drain(resp)
+
+	if body == nil {
+		return r, false, nil
+	}
+
+	r.Body, err = ioutil.ReadAll(body)
+	if err != nil {
+		return Request{}, false, fmt.Errorf("failed to read request body: %s", err)
+	}
+
+	return r, true, nil
+}
+
+// fetchRequest GETs the request from the relay. It offers the multipart
+// encoding, older relays only speak JSON. If the relay used it, the body is
+// returned as a reader instead of being set on the Request. The response
+// must be drained.
+func (c *Client) fetchRequest(r relay) (Request, io.Reader, *http.Response, error) {
+	resp, err := c.do(http.MethodGet, r.addr, nil, http.Header{
+		"Accept":                []string{internalapi.MultipartType + ", application/json;q=0.9"},
+		internalapi.TokenHeader: []string{r.token},
+	})
+	if err != nil {
+		return Request{}, nil, nil, fmt.Errorf("failed to GET request: %s", err)
+	}
+
+	if err := c.checkStatus(resp, "GETting request"); err != nil {
+		c.drain(resp)
+		return Request{}, nil, nil, err
+	}
+
+	var req Request
+	body, err := internalapi.DecodeStream(resp.Body, resp.Header.Get("Content-Type"), &req)
+	if err != nil {
+		c.drain(resp)
+		return Request{}, nil, nil, fmt.Errorf("failed to unmarshal request: %s", err)
+	}
+
+	if req.Query == nil && req.RawQuery != "" {
+		req.Query, _ = url.ParseQuery(req.RawQuery)
+	}
+
+	return req, body, resp, nil
+}
+
+// postResponse POSTs the response to the relay. It uses the multipart
+// encoding only if the relay used it for the request.
+func (c *Client) postResponse(r relay, response Response, multipart bool) error {
+	contentType := "application/json"
+	data, err := json.Marshal(response)
+	if multipart {
+		body := response.Body
+		response.Body = nil
+		contentType, data, err = internalapi.EncodeMultipart(response, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal response: %s", err)
+	}
+
+	resp, err := c.do(http.MethodPost, r.addr, data, http.Header{
+		"Content-Type":          []string{contentType},
+		internalapi.TokenHeader: []string{r.token},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to POST response: %s", err)
+	}
+	defer c.drain(resp)
+
+	return c.checkStatus(resp, "POSTing results")
+}
+
+// postStream POSTs a response that is still being written. It is not
+// retried as the body can only be read once.
+func (c *Client) postStream(r relay, contentType string, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, r.addr, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(internalapi.TokenHeader, r.token)
+	req.Header.Set("X-CF-APP-INSTANCE", c.appInstance)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to POST response: %s", err)
+	}
+	defer c.drain(resp)
+
+	return c.checkStatus(resp, "POSTing results")
+}
+
+func (c *Client) checkStatus(resp *http.Response, action string) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrRelayGone
+	case http.StatusUnauthorized:
+		return ErrTokenRejected
+	case http.StatusExpectationFailed:
+		return ErrResponseRejected
+	default:
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code while %s %d: %s", action, resp.StatusCode, data)
+	}
+}
+
+// do makes the request and retries according to the RetryPolicy. A 5xx from
+// the final attempt is returned as a response and not an error.
+func (c *Client) do(method, addr string, body []byte, header http.Header) (*http.Response, error) {
+	attempts := c.policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff := c.policy.Backoff
+	for i := 0; ; i++ {
+		req, err := http.NewRequest(method, addr, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("X-CF-APP-INSTANCE", c.appInstance)
+
+		var sent int32
+		if token := header[internalapi.TokenHeader]; len(token) > 0 && token[0] != "" {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+				WroteHeaders: func() {
+					atomic.StoreInt32(&sent, 1)
+				},
+			}))
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if i == attempts-1 || atomic.LoadInt32(&sent) == 1 {
+			return resp, err
+		}
+
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+
+		if err != nil {
+			c.log.Printf("request to %s failed (attempt %d/%d): %s", addr, i+1, attempts, err)
+		} else {
+			c.log.Printf("request to %s failed (attempt %d/%d): status code %d", addr, i+1, attempts, resp.StatusCode)
+			c.drain(resp)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if c.policy.MaxBackoff > 0 && backoff > c.policy.MaxBackoff {
+			backoff = c.policy.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
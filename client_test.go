@@ -0,0 +1,394 @@
+package faas_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	faas "github.com/poy/cf-faas"
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	statuses map[string][]int
+	bodies   [][]byte
+	request  faas.Request
+
+	multipart bool
+}
+
+func (t *TC) Requests() []*http.Request {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	results := make([]*http.Request, len(t.requests))
+	copy(results, t.requests)
+	return results
+}
+
+func (t *TC) client(opts ...faas.ClientOption) *faas.Client {
+	opts = append([]faas.ClientOption{
+		faas.WithRelayAddr(t.server.URL),
+		faas.WithAppInstance("some-app-instance"),
+		faas.WithRetryPolicy(faas.RetryPolicy{
+			Attempts: 3,
+			Backoff:  time.Millisecond,
+		}),
+		faas.WithLogger(log.New(ioutil.Discard, "", 0)),
+	}, opts...)
+
+	c, err := faas.NewClient(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) *TC {
+		tc := &TC{
+			T:        t,
+			statuses: make(map[string][]int),
+			request: faas.Request{
+				Path: "some-path",
+			},
+		}
+
+		tc.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tc.mu.Lock()
+			defer tc.mu.Unlock()
+			tc.requests = append(tc.requests, r)
+
+			body, _ := ioutil.ReadAll(r.Body)
+			tc.bodies = append(tc.bodies, body)
+
+			if s := tc.statuses[r.Method]; len(s) > 0 {
+				tc.statuses[r.Method] = s[1:]
+				if s[0] != http.StatusOK {
+					w.WriteHeader(s[0])
+					return
+				}
+			}
+
+			if r.Method == http.MethodGet && tc.multipart {
+				req := tc.request
+				req.Body = nil
+				contentType, data, _ := internalapi.EncodeMultipart(req, tc.request.Body)
+				w.Header().Set("Content-Type", contentType)
+				w.Write(data)
+				return
+			}
+
+			if r.Method == http.MethodGet {
+				json.NewEncoder(w).Encode(tc.request)
+			}
+		}))
+
+		return tc
+	})
+
+	o.AfterEach(func(t *TC) {
+		t.server.Close()
+	})
+
+	o.Spec("it GETs the request and POSTs the response", func(t *TC) {
+		err := t.client(faas.WithRelayToken("some-token")).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{
+				StatusCode: 234,
+				Body:       []byte(r.Path),
+			}, nil
+		}))
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.Requests()).To(HaveLen(2))
+		Expect(t, t.Requests()[0].Method).To(Equal(http.MethodGet))
+		Expect(t, t.Requests()[0].Header.Get("X-CF-APP-INSTANCE")).To(Equal("some-app-instance"))
+		Expect(t, t.Requests()[0].Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
+		Expect(t, t.Requests()[1].Method).To(Equal(http.MethodPost))
+		Expect(t, t.Requests()[1].Header.Get("X-CF-APP-INSTANCE")).To(Equal("some-app-instance"))
+		Expect(t, t.Requests()[1].Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(234))
+		Expect(t, string(resp.Body)).To(Equal("some-path"))
+	})
+
+	o.Spec("it parses the query when the relay only sends the raw query", func(t *TC) {
+		t.request.RawQuery = "a=1&a=2"
+
+		var query url.Values
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			query = r.Query
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(BeNil())
+		Expect(t, query["a"]).To(Equal([]string{"1", "2"}))
+	})
+
+	o.Spec("it offers the multipart encoding and falls back to JSON", func(t *TC) {
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.Requests()[0].Header.Get("Accept")).To(ContainSubstring("multipart/mixed"))
+		Expect(t, t.Requests()[1].Header.Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	o.Spec("it uses the multipart encoding when the relay does", func(t *TC) {
+		t.multipart = true
+		t.request.Body = []byte{0, 1, 255}
+
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{
+				StatusCode: 234,
+				Body:       append(r.Body, 2),
+			}, nil
+		}))
+		Expect(t, err).To(BeNil())
+
+		contentType := t.Requests()[1].Header.Get("Content-Type")
+		Expect(t, internalapi.IsMultipart(contentType)).To(BeTrue())
+
+		var resp faas.Response
+		body, err := internalapi.Decode(bytes.NewReader(t.bodies[1]), contentType, &resp)
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(234))
+		Expect(t, body).To(Equal([]byte{0, 1, 255, 2}))
+	})
+
+	o.Spec("it POSTs a 500 for a handler error", func(t *TC) {
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{}, errors.New("some-error")
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+	})
+
+	o.Spec("it POSTs a 500 for a handler panic", func(t *TC) {
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("some-panic")
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(t, resp.Body).To(HaveLen(0))
+	})
+
+	o.Spec("it uses the status from a faas.Error", func(t *TC) {
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{}, faas.Error{Status: http.StatusNotFound}
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	o.Spec("it POSTs a 500 for a faas.Error without a status", func(t *TC) {
+		err := t.client(faas.WithErrorBodies()).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{}, faas.Error{}
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(t, resp.Body).To(MatchJSON(`{"error":"Internal Server Error"}`))
+	})
+
+	o.Spec("it uses the status from a wrapped faas.Error", func(t *TC) {
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{}, fmt.Errorf("some-context: %w", &faas.Error{Status: http.StatusConflict})
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusConflict))
+	})
+
+	o.Spec("it writes a structured error body", func(t *TC) {
+		err := t.client(faas.WithErrorBodies()).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{}, &faas.Error{Status: http.StatusConflict, Message: "some-message"}
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusConflict))
+		Expect(t, resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(t, resp.Body).To(MatchJSON(`{"error":"some-message"}`))
+	})
+
+	o.Spec("it only includes the stack trace in debug mode", func(t *TC) {
+		err := t.client(faas.WithErrorBodies()).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("some-panic")
+		}))
+		Expect(t, err).To(BeNil())
+
+		var resp faas.Response
+		var body faas.ErrorBody
+		Expect(t, json.Unmarshal(t.bodies[1], &resp)).To(BeNil())
+		Expect(t, json.Unmarshal(resp.Body, &body)).To(BeNil())
+		Expect(t, body.Error).To(ContainSubstring("some-panic"))
+		Expect(t, body.Stack).To(Equal(""))
+
+		err = t.client(faas.WithErrorBodies(), faas.WithDebug()).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("some-panic")
+		}))
+		Expect(t, err).To(BeNil())
+
+		Expect(t, json.Unmarshal(t.bodies[3], &resp)).To(BeNil())
+		Expect(t, json.Unmarshal(resp.Body, &body)).To(BeNil())
+		Expect(t, body.Stack).To(ContainSubstring("client_test.go"))
+	})
+
+	o.Spec("it retries 5xx status codes", func(t *TC) {
+		t.statuses[http.MethodGet] = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+		t.statuses[http.MethodPost] = []int{http.StatusBadGateway}
+
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.Requests()).To(HaveLen(5))
+	})
+
+	o.Spec("it retries network errors", func(t *TC) {
+		var attempts int
+		httpClient := &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+				if attempts == 1 {
+					return nil, errors.New("some-error")
+				}
+				return http.DefaultTransport.RoundTrip(r)
+			}),
+		}
+
+		err := t.client(faas.WithHTTPClient(httpClient)).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(BeNil())
+		Expect(t, attempts).To(Equal(3))
+	})
+
+	o.Spec("it does not retry a request once its token was sent", func(t *TC) {
+		t.statuses[http.MethodGet] = []int{http.StatusBadGateway}
+
+		err := t.client(faas.WithRelayToken("some-token")).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("should not be called")
+		}))
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.Requests()).To(HaveLen(1))
+	})
+
+	o.Spec("it retries a request whose token was never sent", func(t *TC) {
+		var attempts int
+		httpClient := &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+				if attempts == 1 {
+					return nil, errors.New("some-error")
+				}
+				return http.DefaultTransport.RoundTrip(r)
+			}),
+		}
+
+		err := t.client(faas.WithHTTPClient(httpClient), faas.WithRelayToken("some-token")).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(BeNil())
+		Expect(t, attempts).To(Equal(3))
+	})
+
+	o.Spec("it gives up after the configured attempts", func(t *TC) {
+		t.statuses[http.MethodGet] = []int{500, 500, 500, 500}
+
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("should not be called")
+		}))
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.Requests()).To(HaveLen(3))
+	})
+
+	o.Spec("it returns ErrRelayGone for a 404", func(t *TC) {
+		t.statuses[http.MethodPost] = []int{http.StatusNotFound}
+
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(Equal(faas.ErrRelayGone))
+		Expect(t, t.Requests()).To(HaveLen(2))
+	})
+
+	o.Spec("it returns ErrResponseRejected for a 417", func(t *TC) {
+		t.statuses[http.MethodPost] = []int{http.StatusExpectationFailed}
+
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: 200}, nil
+		}))
+		Expect(t, err).To(Equal(faas.ErrResponseRejected))
+	})
+
+	o.Spec("it returns ErrTokenRejected for a 401", func(t *TC) {
+		t.statuses[http.MethodGet] = []int{http.StatusUnauthorized}
+
+		err := t.client(faas.WithRelayToken("some-token")).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("should not be called")
+		}))
+		Expect(t, err).To(Equal(faas.ErrTokenRejected))
+		Expect(t, t.Requests()).To(HaveLen(1))
+	})
+
+	o.Spec("it does not retry other 4xx status codes", func(t *TC) {
+		t.statuses[http.MethodGet] = []int{http.StatusBadRequest}
+
+		err := t.client().Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("should not be called")
+		}))
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, t.Requests()).To(HaveLen(1))
+	})
+
+	o.Spec("it returns an error without a relay address", func(t *TC) {
+		err := t.client(faas.WithRelayAddr("")).Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			panic("should not be called")
+		}))
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/go-envstruct"
 	"github.com/poy/cf-faas/internal/manifest"
@@ -24,6 +25,19 @@ type Config struct {
 	VcapApplication VcapApplication `env:"VCAP_APPLICATION, required"`
 
 	SkipSSLValidation bool `env:"SKIP_SSL_VALIDATION, report"`
+
+	Scaler              string        `env:"SCALER, report"`
+	ScalerMaxLaunches   int           `env:"SCALER_MAX_LAUNCHES, report"`
+	ScalerTargetLatency time.Duration `env:"SCALER_TARGET_LATENCY, report"`
+	ScalerWorkPerTask   int           `env:"SCALER_WORK_PER_TASK, report"`
+
+	MinWarmWorkers int           `env:"MIN_WARM_WORKERS, report"`
+	WorkerIdleTTL  time.Duration `env:"WORKER_IDLE_TTL, report"`
+
+	// LocalWorkerPath runs workers as local processes instead of Cloud
+	// Foundry tasks. LocalPackageDirs are given to them (as PACKAGE_DIRS).
+	LocalWorkerPath  string            `env:"LOCAL_WORKER_PATH, report"`
+	LocalPackageDirs map[string]string `env:"LOCAL_PACKAGE_DIRS, report"`
 }
 
 type VcapApplication struct {
@@ -39,7 +53,13 @@ func (a *VcapApplication) UnmarshalEnv(data string) error {
 }
 
 func LoadConfig(log *log.Logger) Config {
-	cfg := Config{}
+	cfg := Config{
+		Scaler:              "fixed",
+		ScalerMaxLaunches:   5,
+		ScalerTargetLatency: 2 * time.Second,
+		ScalerWorkPerTask:   1,
+		WorkerIdleTTL:       5 * time.Minute,
+	}
 	if err := envstruct.Load(&cfg); err != nil {
 		log.Fatal(err)
 	}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/poy/cf-faas/internal/capi"
 	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/cf-faas/internal/local"
 	"github.com/poy/cf-faas/internal/manifest"
+	"github.com/poy/cf-faas/internal/metrics"
 	cfgroupcache "github.com/poy/cf-groupcache"
 	gocapi "github.com/poy/go-capi"
 	"github.com/golang/groupcache"
@@ -48,7 +55,20 @@ func main() {
 		capiClient,
 		log,
 	)
-	updateCachePeers(peerManager)
+
+	var taskCreator handlers.TaskCreator = capi.NewTaskCreator(capiClient)
+	if cfg.LocalWorkerPath != "" {
+		localTaskCreator := buildLocalTaskCreator(cfg, log)
+		stopOnSignal(localTaskCreator, log)
+		taskCreator = localTaskCreator
+	} else {
+		updateCachePeers(peerManager)
+	}
+
+	scaler := buildScaler(cfg, log)
+
+	// Published via /debug/vars on the health port.
+	m := metrics.New(expvar.NewMap("cf-faas"))
 
 	// Bootstrap
 	bootstrapCtx, bootstrapCancel := context.WithCancel(context.Background())
@@ -58,7 +78,11 @@ func main() {
 		cfg.VcapApplication.ApplicationID,
 		cfg.InstanceIndex,
 		gcPool,
-		capiClient,
+		taskCreator,
+		scaler,
+		cfg.MinWarmWorkers,
+		cfg.WorkerIdleTTL,
+		m,
 		handlers.NewRequestRelayer,
 		handlers.NewWorkerPool,
 		handlers.NewHTTPEvent,
@@ -68,6 +92,11 @@ func main() {
 
 	hotSwap := handlers.NewHotSwap(bootstrapRouter)
 
+	var h http.Handler = hotSwap
+	if cfg.LocalWorkerPath != "" {
+		h = localTLS(h)
+	}
+
 	var wg, ready sync.WaitGroup
 	wg.Add(1)
 	ready.Add(1)
@@ -78,7 +107,7 @@ func main() {
 		log.Fatal(
 			http.ListenAndServe(
 				fmt.Sprintf(":%d", cfg.Port),
-				hotSwap,
+				h,
 			),
 		)
 	}()
@@ -91,7 +120,11 @@ func main() {
 		cfg.VcapApplication.ApplicationID,
 		cfg.InstanceIndex,
 		gcPool,
-		capiClient,
+		taskCreator,
+		scaler,
+		cfg.MinWarmWorkers,
+		cfg.WorkerIdleTTL,
+		m,
 		handlers.NewRequestRelayer,
 		handlers.NewWorkerPool,
 		handlers.NewHTTPEvent,
@@ -132,7 +165,8 @@ func startHealthEndpoint(cfg Config) {
 
 func updateCachePeers(peerManager *cfgroupcache.PeerManager) {
 	updatePeers := func() {
-		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
 		peerManager.Tick(ctx)
 	}
 	updatePeers()
@@ -143,3 +177,58 @@ func updateCachePeers(peerManager *cfgroupcache.PeerManager) {
 		}
 	}()
 }
+
+// buildLocalTaskCreator runs workers without Cloud Foundry. There aren't any
+// other instances to share the cache with.
+func buildLocalTaskCreator(cfg Config, log *log.Logger) *local.TaskCreator {
+	var dirs []string
+	for appName, dir := range cfg.LocalPackageDirs {
+		dirs = append(dirs, appName+":"+dir)
+	}
+
+	return local.NewTaskCreator(
+		cfg.LocalWorkerPath,
+		map[string]string{
+			"PACKAGE_DIRS": strings.Join(dirs, ","),
+		},
+		log,
+	)
+}
+
+// stopOnSignal kills the local workers when cf-faas is stopped. They are
+// its child processes and would otherwise be orphaned.
+func stopOnSignal(c *local.TaskCreator, log *log.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, stopping local workers...", sig)
+		c.Stop()
+		os.Exit(1)
+	}()
+}
+
+// localTLS stands in for the gorouter. Locally, there isn't anything
+// terminating TLS and the RequestRelayer only accepts requests that were
+// HTTPS.
+func localTLS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-Forwarded-Proto", "https")
+		h.ServeHTTP(w, r)
+	})
+}
+
+func buildScaler(cfg Config, log *log.Logger) handlers.Scaler {
+	switch cfg.Scaler {
+	case "fixed":
+		return handlers.NewFixedScaler(cfg.ScalerMaxLaunches)
+	case "target-latency":
+		return handlers.NewTargetLatencyScaler(cfg.ScalerTargetLatency, cfg.ScalerMaxLaunches)
+	case "proportional":
+		return handlers.NewProportionalScaler(cfg.ScalerWorkPerTask, cfg.ScalerMaxLaunches)
+	default:
+		log.Fatalf("unknown scaler: %s", cfg.Scaler)
+		return nil
+	}
+}
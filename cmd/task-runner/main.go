@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"time"
 
 	faas "github.com/poy/cf-faas"
 	"github.com/poy/cf-faas/internal/capi"
@@ -35,8 +34,8 @@ func main() {
 	)
 
 	if !cfg.CreateTask {
-		taskRunner = handlers.TaskRunnerFunc(func(command, name string) (string, error) {
-			ctx, _ := context.WithTimeout(context.Background(), time.Minute)
+		// The context is cancelled once the function's timeout passes.
+		taskRunner = handlers.TaskRunnerFunc(func(ctx context.Context, command, name string) (string, error) {
 			cmd := exec.CommandContext(ctx, "/bin/bash", append([]string{"-c"}, command)...)
 
 			for k, v := range map[string]string{
@@ -4,18 +4,51 @@ import (
 	"encoding/json"
 	"log"
 	"strings"
+	"time"
 
 	"code.cloudfoundry.org/go-envstruct"
 )
 
 type Config struct {
 	PoolAddr    string   `env:"POOL_ADDR, required, report"`
+	PoolToken   string   `env:"POOL_TOKEN, required"`
 	AppInstance string   `env:"X_CF_APP_INSTANCE, required, report"`
 	AppNames    []string `env:"APP_NAMES, required, report"`
-	HTTPProxy   string   `env:"HTTP_PROXY, required, report"`
+	HTTPProxy   string   `env:"HTTP_PROXY, report"`
 	DataDir     string   `env:"DATA_DIR, report"`
 
-	VcapApplication VcapApplication `env:"VCAP_APPLICATION, required"`
+	// ScratchDir is where isolated functions get their scratch directories.
+	// It defaults to the directory for temporary files.
+	ScratchDir string `env:"SCRATCH_DIR, report"`
+
+	// PackageDirs are app names to local directories with their packages.
+	// When set, packages aren't downloaded from Cloud Foundry.
+	PackageDirs map[string]string `env:"PACKAGE_DIRS, report"`
+
+	// InstanceGUID identifies the worker when it registers with the
+	// WorkerPool. A random one is used if it isn't set.
+	InstanceGUID string `env:"CF_INSTANCE_GUID, report"`
+
+	IdleTTL time.Duration `env:"IDLE_TTL, report"`
+
+	// ExecutionSlots is how many functions the worker runs at once. It
+	// stops asking for work while every slot is taken.
+	ExecutionSlots int `env:"EXECUTION_SLOTS, report"`
+
+	// DrainTimeout is how long the worker waits for running functions after
+	// it is told to stop. Cloud Foundry kills it 10 seconds after SIGTERM.
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT, report"`
+
+	// StreamTimeout is how long a function that streams its response may
+	// run. The function's own timeout only applies until it starts the
+	// response.
+	StreamTimeout time.Duration `env:"STREAM_TIMEOUT, report"`
+
+	// PollMaxFailures is how many times in a row the worker fails to ask
+	// for work before it gives up. 0 means it never gives up.
+	PollMaxFailures int `env:"POLL_MAX_FAILURES, report"`
+
+	VcapApplication VcapApplication `env:"VCAP_APPLICATION"`
 }
 
 type VcapApplication struct {
@@ -31,12 +64,24 @@ func (a *VcapApplication) UnmarshalEnv(data string) error {
 
 func LoadConfig(log *log.Logger) Config {
 	cfg := Config{
-		DataDir: "/dev/shm",
+		DataDir:         "/dev/shm",
+		ExecutionSlots:  10,
+		DrainTimeout:    8 * time.Second,
+		StreamTimeout:   time.Hour,
+		PollMaxFailures: 10,
 	}
 	if err := envstruct.Load(&cfg); err != nil {
 		log.Fatal(err)
 	}
 
+	if len(cfg.PackageDirs) == 0 && cfg.VcapApplication.CAPIAddr == "" {
+		log.Fatal("VCAP_APPLICATION is required without PACKAGE_DIRS")
+	}
+
+	if cfg.ExecutionSlots <= 0 {
+		log.Fatal("EXECUTION_SLOTS must be positive")
+	}
+
 	// Use HTTP so we can use HTTP_PROXY
 	cfg.VcapApplication.CAPIAddr = strings.Replace(cfg.VcapApplication.CAPIAddr, "https", "http", 1)
 
@@ -2,18 +2,31 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/poy/cf-faas/internal/capi"
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/cf-faas/internal/local"
+	"github.com/poy/cf-faas/internal/metrics"
 	"github.com/poy/cf-faas/internal/scheduler"
 	gocapi "github.com/poy/go-capi"
 )
 
+// version is reported with each heartbeat. It is set at build time (e.g.,
+// -ldflags "-X main.version=...").
+var version = "dev"
+
 func main() {
 	log := log.New(os.Stderr, "[WORKER] ", log.LstdFlags)
 	log.Printf("Starting CF FaaS worker...")
@@ -31,53 +44,164 @@ func main() {
 		return nil
 	}
 
-	capiClient := gocapi.NewClient(
-		cfg.VcapApplication.CAPIAddr,
-		cfg.VcapApplication.ApplicationID,
-		cfg.VcapApplication.SpaceID,
-		http.DefaultClient,
-	)
+	packManager := buildPackageManager(cfg, log)
 
-	packManager := capi.NewPackageManager(
-		cfg.AppNames,
-		15*time.Second,
-		cfg.DataDir,
-		capiClient,
-		http.DefaultClient,
-		log,
-	)
+	// The metrics are reported with each heartbeat.
+	metricsMap := expvar.NewMap("worker")
+	m := metrics.New(metricsMap)
 
-	exec := scheduler.ExecutorFunc(func(cwd string, envs map[string]string, command string) error {
-		ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-		cmd := exec.CommandContext(ctx, "/bin/bash", append([]string{"-c"}, command)...)
-		cmd.Dir = cwd
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		for k, v := range envs {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
-		}
+	// The Runner stops the command once the function's timeout passes.
+	exec := scheduler.NewCommandExecutor(os.Stdout, os.Stderr, log)
 
-		return cmd.Run()
+	// Resident processes live until they exit on their own or the worker
+	// does. They don't have limits.
+	residentExec := scheduler.ExecutorFunc(func(ctx context.Context, cwd string, envs map[string]string, command string) error {
+		return exec.Execute(context.Background(), cwd, envs, command)
 	})
 
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("failed to listen for resident processes: %s", err)
+	}
+
+	resident := scheduler.NewResidentExecutor(
+		"http://"+lis.Addr().String(),
+		residentExec,
+		30*time.Second,
+		log,
+	)
+	defer resident.Stop()
+	go func() {
+		log.Fatal(http.Serve(lis, resident))
+	}()
+
 	runner := scheduler.NewRunner(
 		packManager,
 		exec,
+		resident,
 		http.DefaultClient,
 		map[string]string{
 			"HTTP_PROXY":        cfg.HTTPProxy,
 			"X_CF_APP_INSTANCE": cfg.AppInstance,
 			"VCAP_APPLICATION":  os.Getenv("VCAP_APPLICATION"),
 		},
+		cfg.ScratchDir,
+		cfg.StreamTimeout,
 		log,
 	)
 
+	inFlight := scheduler.NewInFlight(runner)
+
+	id := cfg.InstanceGUID
+	if id == "" {
+		id = randomID()
+	}
+
+	// Heartbeats keep Run supplied with fresh tokens while it is too busy to
+	// ask for work.
+	tokens := scheduler.NewTokenSource(cfg.PoolToken)
+
+	// Register with the WorkerPool until Run returns.
+	heartbeatCtx, stopHeartbeats := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scheduler.Heartbeat(
+			heartbeatCtx,
+			cfg.PoolAddr,
+			cfg.AppInstance,
+			tokens,
+			internalapi.HeartbeatInterval,
+			func() internalapi.Heartbeat {
+				return internalapi.Heartbeat{
+					ID:          id,
+					AppInstance: cfg.AppInstance,
+					Apps:        packManager.ReadyApps(),
+					InFlight:    inFlight.Count(),
+					Version:     version,
+					Metrics:     json.RawMessage(metricsMap.String()),
+				}
+			},
+			http.DefaultClient,
+			log,
+		)
+	}()
+	defer wg.Wait()
+	defer stopHeartbeats()
+
+	// Stop asking for work once we are told to stop. Running functions get
+	// until the DrainTimeout to finish, then they are aborted and their
+	// clients are told.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %s, draining for up to %s", sig, cfg.DrainTimeout)
+			time.AfterFunc(cfg.DrainTimeout, runner.Abort)
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+
 	scheduler.Run(
+		ctx,
 		cfg.PoolAddr,
 		cfg.AppInstance,
-		30*time.Second,
-		runner,
+		tokens,
+		// Longer than the WorkerPool holds onto a request.
+		40*time.Second,
+		cfg.IdleTTL,
+		cfg.ExecutionSlots,
+		scheduler.Backoff{
+			Base:        500 * time.Millisecond,
+			Max:         15 * time.Second,
+			MaxFailures: cfg.PollMaxFailures,
+		},
+		packManager,
+		inFlight,
 		http.DefaultClient,
+		m,
 		log,
 	)
 }
+
+type packageManager interface {
+	scheduler.PackageManager
+	scheduler.AppLister
+}
+
+// buildPackageManager downloads packages from Cloud Foundry unless they are
+// in local directories.
+func buildPackageManager(cfg Config, log *log.Logger) packageManager {
+	if len(cfg.PackageDirs) > 0 {
+		return local.NewPackageManager(cfg.PackageDirs)
+	}
+
+	capiClient := gocapi.NewClient(
+		cfg.VcapApplication.CAPIAddr,
+		cfg.VcapApplication.ApplicationID,
+		cfg.VcapApplication.SpaceID,
+		http.DefaultClient,
+	)
+
+	return capi.NewPackageManager(
+		cfg.AppNames,
+		15*time.Second,
+		cfg.DataDir,
+		capiClient,
+		http.DefaultClient,
+		log,
+	)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("failed to generate an ID: %s", err)
+	}
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,116 @@
+package faas
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Error can be returned (or wrapped) by a Handler to choose the status code
+// of the response. A Status of 0 and any other error result in a 500.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+
+	if text := http.StatusText(e.statusCode()); text != "" {
+		return text
+	}
+	return fmt.Sprintf("status code %d", e.Status)
+}
+
+func (e Error) statusCode() int {
+	if e.Status == 0 {
+		return http.StatusInternalServerError
+	}
+	return e.Status
+}
+
+// ErrorBody is the JSON body of an error response. It is only written when
+// error bodies are enabled (see WithErrorBodies). The Stack is only included
+// in debug mode (see WithDebug).
+//
+// The worker writes one when a function's command exceeds one of its
+// limits or fails while its handler has debug enabled. Debug includes the
+// exit code and the end of the command's output.
+type ErrorBody struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+	Stack     string `json:"stack,omitempty"`
+
+	// Limit is the resource limit the command exceeded (e.g., memory).
+	Limit string `json:"limit,omitempty"`
+
+	ExitCode int    `json:"exit_code,omitempty"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+}
+
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.value)
+}
+
+// invoke runs the handler and turns a panic into an error.
+func invoke(f func() (Response, error)) (resp Response, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError{value: r, stack: debug.Stack()}
+		}
+	}()
+
+	return f()
+}
+
+func (c *Client) errorResponse(req Request, err error) Response {
+	status := http.StatusInternalServerError
+	var e Error
+	var pe *Error
+	switch {
+	case errors.As(err, &e):
+		status = e.statusCode()
+	case errors.As(err, &pe) && pe != nil:
+		status = pe.statusCode()
+	}
+
+	resp := Response{
+		StatusCode: status,
+	}
+
+	if !c.errorBodies {
+		return resp
+	}
+
+	body := ErrorBody{
+		Error:     err.Error(),
+		RequestID: req.RequestID,
+	}
+
+	if pe, ok := err.(panicError); ok && c.debug {
+		body.Stack = string(pe.stack)
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.log.Printf("failed to marshal error body: %s", err)
+		return resp
+	}
+
+	resp.Header = http.Header{
+		"Content-Type": []string{"application/json"},
+	}
+	resp.Body = data
+
+	return resp
+}
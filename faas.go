@@ -1,13 +1,12 @@
 package faas
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
-	"io/ioutil"
+	"context"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	envstruct "code.cloudfoundry.org/go-envstruct"
 )
@@ -18,6 +17,22 @@ type Request struct {
 	Method       string            `json:"method"`
 	Header       http.Header       `json:"headers"`
 	Body         []byte            `json:"body"`
+
+	Query    url.Values `json:"query,omitempty"`
+	RawQuery string     `json:"raw_query,omitempty"`
+	Host     string     `json:"host,omitempty"`
+	Scheme   string     `json:"scheme,omitempty"`
+
+	// RemoteAddr is the address of the client. It honors X-Forwarded-For.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// RequestID uniquely identifies the request. It is the X-Vcap-Request-Id
+	// header when set by the CF router.
+	RequestID string `json:"request_id,omitempty"`
+
+	// Timeout is how much time was left to respond when the request was
+	// fetched. It is zero if there isn't a deadline.
+	Timeout time.Duration `json:"timeout,omitempty"`
 }
 
 type Response struct {
@@ -36,96 +51,77 @@ func (f HandlerFunc) Handle(r Request) (Response, error) {
 	return f(r)
 }
 
-func Start(h Handler) {
-	log := log.New(os.Stderr, "[FAAS HANDLER] ", log.LstdFlags)
-	cfg := loadConfig(log)
-
-	request := getRequest(cfg, http.DefaultClient, log)
-	resp, err := h.Handle(request)
-	if err != nil {
-		log.Printf("handler error: %s", err)
-		postResponse(Response{
-			StatusCode: http.StatusInternalServerError,
-		}, cfg, http.DefaultClient, log)
-		return
-	}
-
-	postResponse(resp, cfg, http.DefaultClient, log)
+// ContextHandler is a Handler that is given a context. The context is
+// cancelled once the request's deadline passes. Start and Serve use
+// HandleContext for any Handler that implements it.
+type ContextHandler interface {
+	Handler
+	HandleContext(context.Context, Request) (Response, error)
 }
 
-func getRequest(cfg config, httpClient *http.Client, log *log.Logger) Request {
-	req, err := http.NewRequest(http.MethodGet, cfg.RelayAddr, nil)
-	if err != nil {
-		log.Fatalf("failed to build request with CF_FAAS_RELAY_ADDR: %s", err)
-	}
-	req.Header.Set("X-CF-APP-INSTANCE", cfg.AppInstance)
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		log.Fatalf("failed to GET request: %s", err)
-	}
+type ContextHandlerFunc func(context.Context, Request) (Response, error)
 
-	defer func(resp *http.Response) {
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-	}(resp)
-
-	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalf("failed to read body: %s", err)
-		}
-		log.Fatalf("unexpected status code while GETting request%d: %s", resp.StatusCode, data)
-	}
+func (f ContextHandlerFunc) Handle(r Request) (Response, error) {
+	return f(context.Background(), r)
+}
 
-	var r Request
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		log.Fatalf("failed to unmarshal request: %s", err)
-	}
-	return r
+func (f ContextHandlerFunc) HandleContext(ctx context.Context, r Request) (Response, error) {
+	return f(ctx, r)
 }
 
-func postResponse(response Response, cfg config, httpClient *http.Client, log *log.Logger) {
-	data, err := json.Marshal(response)
+// Start fetches a single request, hands it to the Handler and POSTs the
+// results. It is meant to be invoked once per process. Any failure to talk
+// to the relay exits the process. Use a Client to handle errors instead.
+func Start(h Handler) {
+	log := log.New(os.Stderr, "[FAAS HANDLER] ", log.LstdFlags)
+	c, err := NewClient(WithLogger(log))
 	if err != nil {
-		log.Fatalf("failed to marshal response: %s", err)
+		log.Fatal(err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, cfg.RelayAddr, bytes.NewReader(data))
-	if err != nil {
-		log.Fatalf("failed to build request with CF_FAAS_RELAY_ADDR: %s", err)
+	if err := c.Run(h); err != nil {
+		log.Fatal(err)
 	}
-	req.Header.Set("X-CF-APP-INSTANCE", cfg.AppInstance)
-	resp, err := httpClient.Do(req)
+}
+
+// Serve keeps the process resident and handles requests until the worker
+// tells it to stop. The handler must be configured as resident in the
+// manifest so the worker sets CF_FAAS_WORK_ADDR. Any failure to talk to the
+// worker exits the process. Use a Client to handle errors instead.
+func Serve(h Handler) {
+	log := log.New(os.Stderr, "[FAAS HANDLER] ", log.LstdFlags)
+	c, err := NewClient(WithLogger(log))
 	if err != nil {
-		log.Fatalf("failed to POST response: %s", err)
+		log.Fatal(err)
 	}
 
-	defer func(resp *http.Response) {
-		io.Copy(ioutil.Discard, resp.Body)
-		resp.Body.Close()
-	}(resp)
-
-	if resp.StatusCode != http.StatusOK {
-		data, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalf("failed to read body: %s", err)
-		}
-		log.Fatalf("unexpected status code while POSTing results %d: %s", resp.StatusCode, data)
+	if err := c.Serve(h); err != nil {
+		log.Fatal(err)
 	}
 }
 
 type config struct {
-	RelayAddr string `env:"CF_FAAS_RELAY_ADDR, required"`
+	// RelayAddr is required by Start.
+	RelayAddr string `env:"CF_FAAS_RELAY_ADDR"`
+
+	// RelayToken authenticates the requests to RelayAddr.
+	RelayToken string `env:"CF_FAAS_RELAY_TOKEN"`
+
+	// WorkAddr is required by Serve.
+	WorkAddr string `env:"CF_FAAS_WORK_ADDR"`
 
 	AppInstance string `env:"X_CF_APP_INSTANCE, requried"`
+
+	ErrorBodies bool `env:"CF_FAAS_ERROR_BODIES"`
+	Debug       bool `env:"CF_FAAS_DEBUG"`
 }
 
-func loadConfig(log *log.Logger) config {
+func loadConfig() (config, error) {
 	cfg := config{}
 
 	if err := envstruct.Load(&cfg); err != nil {
-		log.Fatal(err)
+		return config{}, err
 	}
 
-	return cfg
+	return cfg, nil
 }
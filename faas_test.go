@@ -11,6 +11,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path"
 	"sync"
 	"testing"
 	"time"
@@ -37,6 +38,20 @@ func TestMain(m *testing.M) {
 				Body:       data,
 			}, nil
 		}))
+	case "SERVE_ECHO":
+		faas.Serve(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{
+				StatusCode: 200,
+				Body:       []byte(r.Path),
+			}, nil
+		}))
+	case "CONTEXT_DEADLINE":
+		faas.Start(faas.ContextHandlerFunc(func(ctx context.Context, r faas.Request) (faas.Response, error) {
+			<-ctx.Done()
+			return faas.Response{
+				StatusCode: 200,
+			}, nil
+		}))
 	case "UNHAPPY_PATH_ERR":
 		faas.Start(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
 			return faas.Response{}, errors.New("some-error")
@@ -56,6 +71,7 @@ type TF struct {
 	responses []faas.Response
 
 	writer func(io.Writer) int
+	work   func(http.ResponseWriter)
 }
 
 func (t *TF) Requests() []*http.Request {
@@ -66,6 +82,18 @@ func (t *TF) Requests() []*http.Request {
 	return results
 }
 
+func (t *TF) SetWriter(writer func(io.Writer) int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writer = writer
+}
+
+func (t *TF) SetWork(work func(http.ResponseWriter)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.work = work
+}
+
 func (t *TF) Responses() []faas.Response {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -93,6 +121,15 @@ func TestFaas(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer r.Body.Close()
 
+			if r.URL.Path == "/work" {
+				tf.mu.Lock()
+				work := tf.work
+				tf.mu.Unlock()
+
+				work(w)
+				return
+			}
+
 			tf.mu.Lock()
 			defer tf.mu.Unlock()
 			tf.requests = append(tf.requests, r)
@@ -118,12 +155,12 @@ func TestFaas(t *testing.T) {
 	})
 
 	o.Spec("GETs data from the configured endpoint and POSTs the results", func(t *TF) {
-		t.writer = func(w io.Writer) int {
+		t.SetWriter(func(w io.Writer) int {
 			json.NewEncoder(w).Encode(faas.Request{
 				Path: "some-path",
 			})
 			return 200
-		}
+		})
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		cmd := exec.CommandContext(ctx, t.execPath)
@@ -154,14 +191,90 @@ func TestFaas(t *testing.T) {
 		Expect(t, rr.Path).To(Equal("some-path"))
 	})
 
-	o.Spec("returns a 500 for an error from the handler", func(t *TF) {
-		t.writer = func(w io.Writer) int {
+	o.Spec("Serve handles requests until the worker says to stop", func(t *TF) {
+		t.SetWriter(func(w io.Writer) int {
 			json.NewEncoder(w).Encode(faas.Request{
 				Path: "some-path",
 			})
 			return 200
+		})
+
+		var mu sync.Mutex
+		hrefs := []string{t.server.URL + "/relay-1", t.server.URL + "/relay-2"}
+		t.SetWork(func(w http.ResponseWriter) {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(hrefs) == 0 {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+
+			json.NewEncoder(w).Encode(map[string]string{
+				"href":  hrefs[0],
+				"token": "token-" + path.Base(hrefs[0]),
+			})
+			hrefs = hrefs[1:]
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, t.execPath)
+		cmd.Env = []string{
+			"FAAS_TEST_MODE=SERVE_ECHO",
+
+			fmt.Sprintf("CF_FAAS_WORK_ADDR=%s/work", t.server.URL),
+			"X_CF_APP_INSTANCE=some-app-instance",
+		}
+
+		Expect(t, cmd.Run()).To(BeNil())
+		Expect(t, t.Requests()).To(HaveLen(4))
+
+		Expect(t, t.Requests()[0].Method).To(Equal(http.MethodGet))
+		Expect(t, t.Requests()[0].URL.Path).To(Equal("/relay-1"))
+		Expect(t, t.Requests()[1].Method).To(Equal(http.MethodPost))
+		Expect(t, t.Requests()[1].URL.Path).To(Equal("/relay-1"))
+		Expect(t, t.Requests()[1].Header.Get("X-CF-FAAS-TOKEN")).To(Equal("token-relay-1"))
+		Expect(t, t.Requests()[3].Method).To(Equal(http.MethodPost))
+		Expect(t, t.Requests()[3].URL.Path).To(Equal("/relay-2"))
+		Expect(t, t.Requests()[3].Header.Get("X-CF-FAAS-TOKEN")).To(Equal("token-relay-2"))
+
+		Expect(t, string(t.Responses()[3].Body)).To(Equal("some-path"))
+	})
+
+	o.Spec("cancels the context once the deadline passes", func(t *TF) {
+		t.SetWriter(func(w io.Writer) int {
+			json.NewEncoder(w).Encode(faas.Request{
+				Path:    "some-path",
+				Timeout: 100 * time.Millisecond,
+			})
+			return 200
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, t.execPath)
+		cmd.Env = []string{
+			"FAAS_TEST_MODE=CONTEXT_DEADLINE",
+
+			fmt.Sprintf("CF_FAAS_RELAY_ADDR=%s", t.server.URL),
+			"X_CF_APP_INSTANCE=some-app-instance",
 		}
 
+		Expect(t, cmd.Run()).To(BeNil())
+
+		// The response is dropped as the caller has already been answered.
+		Expect(t, t.Requests()).To(HaveLen(1))
+		Expect(t, t.Requests()[0].Method).To(Equal(http.MethodGet))
+	})
+
+	o.Spec("returns a 500 for an error from the handler", func(t *TF) {
+		t.SetWriter(func(w io.Writer) int {
+			json.NewEncoder(w).Encode(faas.Request{
+				Path: "some-path",
+			})
+			return 200
+		})
+
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		cmd := exec.CommandContext(ctx, t.execPath)
 		cmd.Env = []string{
@@ -182,12 +295,12 @@ func TestFaas(t *testing.T) {
 	})
 
 	o.Spec("it does not continue with non-200", func(t *TF) {
-		t.writer = func(w io.Writer) int {
+		t.SetWriter(func(w io.Writer) int {
 			json.NewEncoder(w).Encode(faas.Request{
 				Path: "some-path",
 			})
 			return 400
-		}
+		})
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		cmd := exec.CommandContext(ctx, t.execPath)
@@ -208,10 +321,10 @@ func TestFaas(t *testing.T) {
 	})
 
 	o.Spec("it does not continue with bad JSON request", func(t *TF) {
-		t.writer = func(w io.Writer) int {
+		t.SetWriter(func(w io.Writer) int {
 			w.Write([]byte("invalid"))
 			return 200
-		}
+		})
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		cmd := exec.CommandContext(ctx, t.execPath)
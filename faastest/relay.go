@@ -0,0 +1,232 @@
+// Package faastest provides a fake relay for testing functions built with
+// the faas package.
+package faastest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	faas "github.com/poy/cf-faas"
+)
+
+// AppInstance is the X-CF-APP-INSTANCE value the Relay expects unless
+// configured otherwise.
+const AppInstance = "faastest-app-instance"
+
+// Relay is a fake relay. It serves a single faas.Request via GET and
+// captures each faas.Response that is POSTed to it.
+type Relay struct {
+	// AppInstance is the expected X-CF-APP-INSTANCE header. It defaults to
+	// the AppInstance constant.
+	AppInstance string
+
+	server *httptest.Server
+
+	mu        sync.Mutex
+	req       faas.Request
+	requests  []*http.Request
+	responses []faas.Response
+	errs      []error
+	failures  map[string][]int
+	delay     time.Duration
+	served    bool
+}
+
+// NewRelay starts a Relay that serves the given request. It must be closed.
+func NewRelay(req faas.Request) *Relay {
+	r := &Relay{
+		AppInstance: AppInstance,
+		req:         req,
+		failures:    make(map[string][]int),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+
+	return r
+}
+
+// Invoke runs the Handler against a Relay serving the given request and
+// returns the POSTed response.
+func Invoke(h faas.Handler, req faas.Request) (faas.Response, error) {
+	r := NewRelay(req)
+	defer r.Close()
+
+	c, err := r.Client()
+	if err != nil {
+		return faas.Response{}, err
+	}
+
+	if err := c.Run(h); err != nil {
+		return faas.Response{}, err
+	}
+
+	if errs := r.Errors(); len(errs) > 0 {
+		return faas.Response{}, errs[0]
+	}
+
+	resp, ok := r.Response()
+	if !ok {
+		return faas.Response{}, fmt.Errorf("handler did not POST a response")
+	}
+
+	return resp, nil
+}
+
+// Addr is the address to give a function via CF_FAAS_RELAY_ADDR.
+func (r *Relay) Addr() string {
+	return r.server.URL
+}
+
+// Env returns the environment variables required by faas.Start. It is
+// intended for functions that are run via os/exec.
+func (r *Relay) Env() []string {
+	return []string{
+		fmt.Sprintf("CF_FAAS_RELAY_ADDR=%s", r.Addr()),
+		fmt.Sprintf("X_CF_APP_INSTANCE=%s", r.AppInstance),
+	}
+}
+
+// Client returns a faas.Client that talks to the Relay. It does not retry
+// so failures are reported immediately.
+func (r *Relay) Client(opts ...faas.ClientOption) (*faas.Client, error) {
+	return faas.NewClient(append([]faas.ClientOption{
+		faas.WithRelayAddr(r.Addr()),
+		faas.WithAppInstance(r.AppInstance),
+		faas.WithRetryPolicy(faas.RetryPolicy{Attempts: 1}),
+	}, opts...)...)
+}
+
+// Fail makes the next count requests for the given method respond with the
+// status code (e.g., http.StatusNotFound for a relay that is gone or
+// http.StatusExpectationFailed for a rejected response).
+func (r *Relay) Fail(method string, statusCode, count int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		r.failures[method] = append(r.failures[method], statusCode)
+	}
+}
+
+// Delay makes the Relay wait before responding to each request.
+func (r *Relay) Delay(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = d
+}
+
+// Requests returns every request made to the Relay.
+func (r *Relay) Requests() []*http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]*http.Request, len(r.requests))
+	copy(results, r.requests)
+	return results
+}
+
+// Response returns the last POSTed response. It returns false if there
+// wasn't one.
+func (r *Relay) Response() (faas.Response, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.responses) == 0 {
+		return faas.Response{}, false
+	}
+
+	return r.responses[len(r.responses)-1], true
+}
+
+// Responses returns every POSTed response.
+func (r *Relay) Responses() []faas.Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]faas.Response, len(r.responses))
+	copy(results, r.responses)
+	return results
+}
+
+// Errors returns any protocol violations. This includes a missing or
+// incorrect X-CF-APP-INSTANCE header, a POST body that is not a valid
+// faas.Response and POSTing before the request was fetched.
+func (r *Relay) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := make([]error, len(r.errs))
+	copy(results, r.errs)
+	return results
+}
+
+// Close shuts down the Relay.
+func (r *Relay) Close() {
+	r.server.Close()
+}
+
+func (r *Relay) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	r.requests = append(r.requests, req)
+	delay := r.delay
+
+	var failure int
+	if f := r.failures[req.Method]; len(f) > 0 {
+		failure = f[0]
+		r.failures[req.Method] = f[1:]
+	}
+
+	if h := req.Header.Get("X-CF-APP-INSTANCE"); h != r.AppInstance {
+		r.errs = append(r.errs, fmt.Errorf("%s: expected X-CF-APP-INSTANCE to be %q, got %q", req.Method, r.AppInstance, h))
+	}
+	r.mu.Unlock()
+
+	time.Sleep(delay)
+
+	if failure != 0 {
+		w.WriteHeader(failure)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if err := json.NewEncoder(w).Encode(r.req); err != nil {
+			r.errs = append(r.errs, fmt.Errorf("failed to encode request: %s", err))
+			return
+		}
+		r.served = true
+	case http.MethodPost:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		if !r.served {
+			r.errs = append(r.errs, fmt.Errorf("POSTed a response before GETting the request"))
+		}
+
+		var resp faas.Response
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.DisallowUnknownFields()
+		if err := d.Decode(&resp); err != nil {
+			r.errs = append(r.errs, fmt.Errorf("invalid response JSON: %s", err))
+			w.WriteHeader(http.StatusExpectationFailed)
+			return
+		}
+
+		r.responses = append(r.responses, resp)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
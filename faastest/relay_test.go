@@ -0,0 +1,144 @@
+package faastest_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	faas "github.com/poy/cf-faas"
+	"github.com/poy/cf-faas/faastest"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TR struct {
+	*testing.T
+	r *faastest.Relay
+}
+
+func TestRelay(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TR {
+		return TR{
+			T: t,
+			r: faastest.NewRelay(faas.Request{
+				Path:   "/v1/some-path",
+				Method: http.MethodPost,
+				Body:   []byte("some-body"),
+			}),
+		}
+	})
+
+	o.AfterEach(func(t TR) {
+		t.r.Close()
+	})
+
+	o.Spec("it serves the request and captures the response", func(t TR) {
+		c, err := t.r.Client()
+		Expect(t, err).To(BeNil())
+
+		err = c.Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{
+				StatusCode: http.StatusCreated,
+				Body:       r.Body,
+			}, nil
+		}))
+		Expect(t, err).To(BeNil())
+
+		resp, ok := t.r.Response()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(t, string(resp.Body)).To(Equal("some-body"))
+		Expect(t, t.r.Errors()).To(HaveLen(0))
+		Expect(t, t.r.Requests()).To(HaveLen(2))
+	})
+
+	o.Spec("it reports a missing X-CF-APP-INSTANCE header", func(t TR) {
+		c, err := t.r.Client(faas.WithAppInstance(""))
+		Expect(t, err).To(BeNil())
+
+		err = c.Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: http.StatusOK}, nil
+		}))
+		Expect(t, err).To(BeNil())
+		Expect(t, t.r.Errors()).To(HaveLen(2))
+	})
+
+	o.Spec("it simulates a relay that is gone", func(t TR) {
+		t.r.Fail(http.MethodPost, http.StatusNotFound, 1)
+		c, err := t.r.Client()
+		Expect(t, err).To(BeNil())
+
+		err = c.Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: http.StatusOK}, nil
+		}))
+		Expect(t, err).To(Equal(faas.ErrRelayGone))
+
+		_, ok := t.r.Response()
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it simulates a rejected response", func(t TR) {
+		t.r.Fail(http.MethodPost, http.StatusExpectationFailed, 1)
+		c, err := t.r.Client()
+		Expect(t, err).To(BeNil())
+
+		err = c.Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: http.StatusOK}, nil
+		}))
+		Expect(t, err).To(Equal(faas.ErrResponseRejected))
+	})
+
+	o.Spec("it simulates a slow relay", func(t TR) {
+		t.r.Delay(50 * time.Millisecond)
+		c, err := t.r.Client(faas.WithHTTPClient(&http.Client{
+			Timeout: 10 * time.Millisecond,
+		}))
+		Expect(t, err).To(BeNil())
+
+		err = c.Run(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{StatusCode: http.StatusOK}, nil
+		}))
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it provides the environment for faas.Start", func(t TR) {
+		Expect(t, t.r.Env()).To(Contain(
+			"CF_FAAS_RELAY_ADDR="+t.r.Addr(),
+			"X_CF_APP_INSTANCE="+faastest.AppInstance,
+		))
+	})
+}
+
+func TestInvoke(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it returns the response from the handler", func(t *testing.T) {
+		resp, err := faastest.Invoke(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{
+				StatusCode: http.StatusOK,
+				Body:       []byte(r.Path),
+			}, nil
+		}), faas.Request{Path: "/v1/some-path"})
+
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(t, string(resp.Body)).To(Equal("/v1/some-path"))
+	})
+
+	o.Spec("it returns a 500 for a handler error", func(t *testing.T) {
+		resp, err := faastest.Invoke(faas.HandlerFunc(func(r faas.Request) (faas.Response, error) {
+			return faas.Response{}, errors.New("some-error")
+		}), faas.Request{})
+
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+	})
+}
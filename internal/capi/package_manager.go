@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"sync"
 	"time"
 
@@ -91,6 +92,21 @@ func (m *PackageManager) PackageForApp(appName string) (string, error) {
 	return dir, nil
 }
 
+// ReadyApps returns the apps that have a package. It does not wait for the
+// first download.
+func (m *PackageManager) ReadyApps() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var apps []string
+	for appName := range m.m {
+		apps = append(apps, appName)
+	}
+	sort.Strings(apps)
+
+	return apps
+}
+
 func (m *PackageManager) start(interval time.Duration) {
 	f := func() {
 		var wg sync.WaitGroup
@@ -105,6 +105,19 @@ func TestPackageManager(t *testing.T) {
 		Expect(t, pDir).To(Equal(path.Join(t.tempDir, "package-guid-a")))
 	})
 
+	o.Spec("it reports the apps it has packages for", func(t TM) {
+		Expect(t, t.m.ReadyApps()).To(HaveLen(0))
+
+		t.spyDoer.m["GET:http://download.x"] = &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewReader(createZip())),
+		}
+		t.spyPackageClient.SetAppResult("a", "guid-a", nil)
+		t.spyPackageClient.SetPackageResults("guid-a", "package-guid-a", "http://download.x")
+
+		Expect(t, t.m.ReadyApps).To(ViaPolling(Equal([]string{"a"})))
+	})
+
 	o.Spec("it returns an error for an unknown app", func(t TM) {
 		_, err := t.m.PackageForApp("unknown")
 		Expect(t, err).To(Not(BeNil()))
@@ -0,0 +1,96 @@
+package capi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	capi "github.com/poy/go-capi"
+)
+
+// TaskCreator starts each worker as a Cloud Foundry task. The task also
+// runs the proxy the worker reaches the relays through.
+type TaskCreator struct {
+	c TaskClient
+}
+
+type TaskClient interface {
+	RunTask(ctx context.Context, command, name, dropletGuid, appGuid string) (capi.Task, error)
+}
+
+func NewTaskCreator(c TaskClient) *TaskCreator {
+	return &TaskCreator{
+		c: c,
+	}
+}
+
+// StartWorker creates a task that runs a worker with the given environment
+// variables. The worker's HTTP_PROXY is set to the task's proxy.
+func (c *TaskCreator) StartWorker(ctx context.Context, env map[string]string) error {
+	// Leave out name, droplet and app name. Their defaults are good enough.
+	_, err := c.c.RunTask(ctx, buildWorkerCommand(env), "", "", "")
+	return err
+}
+
+// buildWorkerCommand returns the command for a task that runs a worker with
+// the given environment variables.
+func buildWorkerCommand(env map[string]string) string {
+	workerEnv := make(map[string]string)
+	for k, v := range env {
+		workerEnv[k] = v
+	}
+	workerEnv["HTTP_PROXY"] = "http://localhost:9999"
+
+	var keys []string
+	for k := range workerEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var vars []string
+	for _, k := range keys {
+		vars = append(vars, k+"="+shellQuote(workerEnv[k]))
+	}
+
+	return fmt.Sprintf(`#!/bin/bash
+
+PORT=9999 PROXY_HEALTH_PORT=10000 ./proxy &
+echo $! > /tmp/pids
+sleep 2
+
+%s ./worker &
+WORKER_PID=$!
+echo $WORKER_PID >> /tmp/pids
+
+# Close everything, otherwise the container won't be reset
+function kill_everything {
+    for pid in $(cat /tmp/pids)
+    do
+        kill -9 $pid &>/dev/null || true
+    done
+	exit 0
+}
+
+# Let the worker drain. The proxy stays up so it can still reach the relays.
+trap 'kill -TERM $WORKER_PID &>/dev/null || true' TERM
+
+# Watch pids
+while true
+do
+    for pid in $(cat /tmp/pids)
+    do
+        ps -p $pid &> /dev/null || kill_everything
+    done
+    # Wait in the background so the trap runs right away.
+    sleep 10 &
+    wait $!
+done
+`, strings.Join(vars, " "))
+}
+
+// shellQuote quotes s for bash. Nothing is expanded within single quotes,
+// so only the single quotes themselves have to be escaped.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
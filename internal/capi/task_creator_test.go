@@ -0,0 +1,79 @@
+package capi_test
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-faas/internal/capi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+	c         *capi.TaskCreator
+	spyClient *spyClient
+}
+
+func TestTaskCreator(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		spyClient := newSpyClient()
+		return TC{
+			T:         t,
+			spyClient: spyClient,
+			c:         capi.NewTaskCreator(spyClient),
+		}
+	})
+
+	o.Spec("it starts a task that runs a worker", func(t TC) {
+		err := t.c.StartWorker(context.Background(), map[string]string{
+			"POOL_ADDR":  "https://some.url/some-pool",
+			"POOL_TOKEN": "some-token",
+		})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, t.spyClient.runCtx).To(Not(BeNil()))
+		Expect(t, t.spyClient.runCommand).To(ContainSubstring("./proxy &"))
+		Expect(t, t.spyClient.runCommand).To(ContainSubstring(
+			`HTTP_PROXY='http://localhost:9999' POOL_ADDR='https://some.url/some-pool' POOL_TOKEN='some-token' ./worker &`,
+		))
+		Expect(t, t.spyClient.runName).To(Equal(""))
+		Expect(t, t.spyClient.runDropletGuid).To(Equal(""))
+		Expect(t, t.spyClient.runAppGuid).To(Equal(""))
+	})
+
+	o.Spec("it quotes the environment for bash", func(t TC) {
+		value := `it's "$HOME" and \n`
+		err := t.c.StartWorker(context.Background(), map[string]string{
+			"SOME_VAR": value,
+		})
+		Expect(t, err).To(BeNil())
+
+		var line string
+		for _, l := range strings.Split(t.spyClient.runCommand, "\n") {
+			if strings.HasSuffix(l, "./worker &") {
+				line = l
+			}
+		}
+		Expect(t, line).To(Not(Equal("")))
+
+		script := strings.TrimSuffix(line, "./worker &") + "printenv SOME_VAR"
+		out, err := exec.Command("/bin/bash", "-c", script).Output()
+		Expect(t, err).To(BeNil())
+		Expect(t, string(out)).To(Equal(value + "\n"))
+	})
+
+	o.Spec("it returns an error if the task can't be started", func(t TC) {
+		t.spyClient.runErr = errors.New("some-error")
+		err := t.c.StartWorker(context.Background(), nil)
+		Expect(t, err).To(Not(BeNil()))
+	})
+}
@@ -26,8 +26,8 @@ func NewTaskRunner(appName string, c Client) *TaskRunner {
 	}
 }
 
-func (r *TaskRunner) RunTask(command, name string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+func (r *TaskRunner) RunTask(ctx context.Context, command, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	appGuid, err := r.c.GetAppGuid(ctx, r.appName)
@@ -0,0 +1,22 @@
+package handlers
+
+import "time"
+
+// ReplayWindow is exported for tests.
+const ReplayWindow = replayWindow
+
+// SetNow replaces the clock the Tokens use. It has to be called before they
+// are used.
+func (t *Tokens) SetNow(now func() time.Time) {
+	t.now = now
+}
+
+// LaunchWindow is exported for tests.
+const LaunchWindow = launchWindow
+
+// SetNow replaces the clock the WorkerPool uses for launches.
+func (p *WorkerPool) SetNow(now func() time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.now = now
+}
@@ -3,55 +3,134 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/poy/cf-faas"
 	"github.com/poy/cf-faas/internal/internalapi"
 )
 
+// defaultTimeout is how long to wait for a function that does not have a
+// timeout in the manifest.
+const defaultTimeout = 10 * time.Second
+
 type HTTPEvent struct {
-	log *log.Logger
-	r   Relayer
-	s   WorkSubmitter
+	log    *log.Logger
+	r      Relayer
+	s      WorkSubmitter
+	stream bool
+	limits QueueLimits
+
+	// queued is how many requests are waiting for a worker.
+	queued     *int64
+	queueDepth func(value float64)
+	shed       func(delta uint64)
 
-	command string
-	appName string
+	// work is used as a template for each submitted Work. Only the Href is
+	// set per request.
+	work internalapi.Work
 }
 
 type Relayer interface {
 	Relay(r *http.Request) (*url.URL, func() (faas.Response, error), error)
+	RelayStream(r *http.Request) (*url.URL, func() (faas.Response, io.ReadCloser, error), error)
 }
 
+// WorkSubmitter blocks until a worker takes the work. It returns an error
+// if the context is done first.
 type WorkSubmitter interface {
-	SubmitWork(ctx context.Context, w internalapi.Work)
+	SubmitWork(ctx context.Context, w internalapi.Work) error
+}
+
+// QueueLimits sheds requests instead of having them wait for a worker. A
+// zero value is no limit.
+type QueueLimits struct {
+	// MaxLength is how many requests can wait for a worker.
+	MaxLength int
+
+	// MaxWait is how long a request waits for a worker.
+	MaxWait time.Duration
+}
+
+type Metrics interface {
+	NewCounter(name string) func(delta uint64)
+	NewGauge(name string) func(value float64)
 }
 
+// NewHTTPEvent returns a new HTTPEvent. If stream is set, the request and
+// response bodies are relayed as they are read and written instead of all at
+// once. The caller waits for the work's Timeout (or 10s if it is not set).
+//
+// Requests past the QueueLimits, or rejected because the handler is at its
+// MaxConcurrency, are answered with a 503 and a Retry-After header. They are
+// counted by the shed_requests metric. With QueueLimits, the waiting
+// requests are published as the queue_depth metric. An HTTPEvent that can
+// shed requests only serves one route, so its Metrics should be for that
+// route (see Router).
 func NewHTTPEvent(
-	command string,
-	appName string,
+	work internalapi.Work,
+	stream bool,
+	limits QueueLimits,
 	r Relayer,
 	s WorkSubmitter,
+	m Metrics,
 	log *log.Logger,
 ) *HTTPEvent {
-	return &HTTPEvent{
-		log:     log,
-		r:       r,
-		s:       s,
-		command: command,
-		appName: appName,
+	e := &HTTPEvent{
+		log:        log,
+		r:          r,
+		s:          s,
+		stream:     stream,
+		limits:     limits,
+		work:       work,
+		queued:     new(int64),
+		queueDepth: func(float64) {},
+		shed:       func(uint64) {},
+	}
+
+	if limits != (QueueLimits{}) {
+		e.queueDepth = m.NewGauge("queue_depth")
 	}
+
+	if limits != (QueueLimits{}) || work.RejectExcess {
+		e.shed = m.NewCounter("shed_requests")
+	}
+
+	return e
 }
 
 func (e HTTPEvent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	leave, ok := e.join()
+	if !ok {
+		e.log.Printf("shedding request for %s: %d requests are already waiting", r.URL.Path, e.limits.MaxLength)
+		e.shedRequest(w)
+		return
+	}
+	defer leave()
+
+	// The worker logs the request ID when the function fails. Make sure the
+	// function and the worker agree on it.
+	if r.Header.Get("X-Vcap-Request-Id") == "" {
+		r.Header.Set("X-Vcap-Request-Id", requestID(r))
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), e.timeout())
 	defer cancel()
 	r = r.WithContext(ctx)
 
+	if e.stream {
+		e.serveStream(w, r, cancel, leave)
+		return
+	}
+
 	u, f, err := e.r.Relay(r)
 	if err != nil {
 		e.log.Printf("relayer failed: %s", err)
@@ -59,11 +138,12 @@ func (e HTTPEvent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	e.s.SubmitWork(ctx, internalapi.Work{
-		Href:    u.String(),
-		Command: e.command,
-		AppName: e.appName,
-	})
+	if err := e.submit(r, u, leave); err != nil {
+		cancel()
+		f()
+		e.submitFailed(w, r, err)
+		return
+	}
 
 	// blocks until the request has been fulfilled.
 	resp, err := f()
@@ -73,18 +153,200 @@ func (e HTTPEvent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	e.writeHeader(w, resp)
+	io.Copy(w, bytes.NewReader(resp.Body))
+}
+
+// serveStream relays the response body as the function writes it. The
+// timeout only applies until the function starts its response. If the body
+// fails (e.g., the function aborts it), the response is aborted too.
+func (e HTTPEvent) serveStream(w http.ResponseWriter, r *http.Request, cancel, leave func()) {
+	u, f, err := e.r.RelayStream(r)
+	if err != nil {
+		e.log.Printf("relayer failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, bytes.NewReader(resp.Body))
+	if err := e.submit(r, u, leave); err != nil {
+		cancel()
+		f()
+		e.submitFailed(w, r, err)
+		return
+	}
+
+	// blocks until the function starts its response.
+	resp, body, err := f()
+	if err != nil {
+		e.log.Printf("running task failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	e.writeHeader(w, resp)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				e.log.Printf("failed to write streamed response: %s", err)
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err == io.EOF {
+			return
+		}
+
+		if err != nil {
+			// Returning would end the response like any other. Aborting
+			// it lets the caller tell it was cut short.
+			e.log.Printf("failed to read streamed response: %s", err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+func (e HTTPEvent) timeout() time.Duration {
+	if e.work.Timeout > 0 {
+		return e.work.Timeout
+	}
+
+	return defaultTimeout
+}
+
+// errMaxWait is returned by submit when no worker took the work within the
+// MaxWait.
+var errMaxWait = errors.New("no worker took the request in time")
+
+// join counts the request as waiting for a worker. It returns false if
+// MaxLength requests are already waiting. The returned func stops counting
+// it and can be called more than once.
+func (e HTTPEvent) join() (func(), bool) {
+	var n int64
+	for {
+		n = atomic.LoadInt64(e.queued)
+		if e.limits.MaxLength > 0 && n >= int64(e.limits.MaxLength) {
+			return nil, false
+		}
+
+		if atomic.CompareAndSwapInt64(e.queued, n, n+1) {
+			break
+		}
+	}
+	e.queueDepth(float64(n + 1))
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.queueDepth(float64(atomic.AddInt64(e.queued, -1)))
+		})
+	}, true
 }
 
-func (e HTTPEvent) buildCommand(relayURL *url.URL) string {
-	return fmt.Sprintf(`
-export CF_FAAS_RELAY_ADDR=%q
+// submit blocks until a worker takes the work. After the MaxWait, it
+// gives up unless a worker took the work in the meantime. Either way, the
+// request is no longer waiting once it returns.
+func (e HTTPEvent) submit(r *http.Request, u *url.URL, leave func()) error {
+	defer leave()
+
+	work := e.work
+	work.Href = u.String()
+	work.Timeout = e.timeout()
+	work.Stream = e.stream
+	work.RequestID = r.Header.Get("X-Vcap-Request-Id")
 
-%s
-	`, relayURL, e.command)
+	if e.limits.MaxWait <= 0 {
+		return e.s.SubmitWork(r.Context(), work)
+	}
+
+	ctx, stopWaiting := withMaxWait(r.Context())
+	defer stopWaiting()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- e.s.SubmitWork(ctx, work)
+	}()
+
+	timer := time.NewTimer(e.limits.MaxWait)
+	defer timer.Stop()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-timer.C:
+		stopWaiting()
+		if err := <-errs; err != nil {
+			return fmt.Errorf("%w within %s", errMaxWait, e.limits.MaxWait)
+		}
+
+		// A worker took it as the MaxWait passed.
+		return nil
+	}
+}
+
+// requestKey is the context key for the request of work that stops waiting
+// for a worker after a MaxWait.
+type requestKey struct{}
+
+// withMaxWait returns a context to submit work with that stops waiting for
+// a worker before the request is done. Work a worker took still lives as
+// long as the request (see requestContext).
+func withMaxWait(ctx context.Context) (context.Context, func()) {
+	return context.WithCancel(context.WithValue(ctx, requestKey{}, ctx))
+}
+
+// requestContext returns the context of the request the work is for.
+func requestContext(ctx context.Context) context.Context {
+	if r, ok := ctx.Value(requestKey{}).(context.Context); ok {
+		return r
+	}
+
+	return ctx
+}
+
+// submitFailed sheds the request if it was turned away. Otherwise (e.g.,
+// it timed out), it is answered with a 500 like any other failed request.
+func (e HTTPEvent) submitFailed(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errMaxWait) || errors.Is(err, ErrMaxConcurrency) {
+		e.log.Printf("shedding request for %s: %s", r.URL.Path, err)
+		e.shedRequest(w)
+		return
+	}
+
+	e.log.Printf("running task failed: %s", err)
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// shedRequest tells the client to come back later.
+func (e HTTPEvent) shedRequest(w http.ResponseWriter) {
+	e.shed(1)
+
+	retryAfter := time.Second
+	if e.limits.MaxWait > retryAfter {
+		retryAfter = e.limits.MaxWait
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func (e HTTPEvent) writeHeader(w http.ResponseWriter, resp faas.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+
+	// Like net/http, a response without a status code is a 200.
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	w.WriteHeader(resp.StatusCode)
 }
@@ -3,13 +3,17 @@ package handlers_test
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/poy/cf-faas"
 	"github.com/poy/cf-faas/internal/handlers"
@@ -26,6 +30,7 @@ type TE struct {
 
 	spyWorkSubmitter *spyWorkSubmitter
 	spyRelayer       *spyRelayer
+	spyMetrics       *spyMetrics
 }
 
 func TestHTTPEvent(t *testing.T) {
@@ -36,16 +41,23 @@ func TestHTTPEvent(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TE {
 		spyRelayer := newSpyRelayer()
 		spyWorkSubmitter := newSpyWorkSubmitter()
+		spyMetrics := newSpyMetrics()
 		return TE{
 			T:                t,
 			recorder:         httptest.NewRecorder(),
 			spyRelayer:       spyRelayer,
 			spyWorkSubmitter: spyWorkSubmitter,
+			spyMetrics:       spyMetrics,
 			h: handlers.NewHTTPEvent(
-				"some-command",
-				"some-app",
+				internalapi.Work{
+					Command: "some-command",
+					AppName: "some-app",
+				},
+				false,
+				handlers.QueueLimits{},
 				spyRelayer,
 				spyWorkSubmitter,
+				spyMetrics,
 				log.New(ioutil.Discard, "", 0),
 			),
 		}
@@ -58,15 +70,78 @@ func TestHTTPEvent(t *testing.T) {
 		t.spyRelayer.u = u
 		req, err := http.NewRequest("GET", "http://some.url", nil)
 		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Vcap-Request-Id", "some-request-id")
 
 		t.h.ServeHTTP(t.recorder, req)
 		Expect(t, t.spyWorkSubmitter.w).To(Equal(internalapi.Work{
-			Href:    u.String(),
-			Command: "some-command",
-			AppName: "some-app",
+			Href:      u.String(),
+			Command:   "some-command",
+			AppName:   "some-app",
+			Timeout:   10 * time.Second,
+			RequestID: "some-request-id",
 		}))
 	})
 
+	o.Spec("it gives the function and the worker the same request ID", func(t TE) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.spyWorkSubmitter.w.RequestID).To(Not(Equal("")))
+		Expect(t, t.spyRelayer.r.Header.Get("X-Vcap-Request-Id")).To(Equal(t.spyWorkSubmitter.w.RequestID))
+	})
+
+	o.Spec("it waits for the work's timeout", func(t TE) {
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+				Timeout: 2 * time.Minute,
+			},
+			false,
+			handlers.QueueLimits{},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+		t.spyRelayer.resp = faas.Response{StatusCode: http.StatusOK}
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.spyWorkSubmitter.w.Timeout).To(Equal(2 * time.Minute))
+
+		deadline, ok := t.spyRelayer.ctx.Deadline()
+		Expect(t, ok).To(BeTrue())
+		Expect(t, time.Until(deadline).Seconds()).To(BeAbove(110))
+	})
+
+	o.Spec("submits the handler settings with the work", func(t TE) {
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command:  "some-command",
+				AppName:  "some-app",
+				Resident: true,
+			},
+			false,
+			handlers.QueueLimits{},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+		t.spyRelayer.resp = faas.Response{StatusCode: http.StatusOK}
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.spyWorkSubmitter.w.Resident).To(BeTrue())
+		Expect(t, t.spyWorkSubmitter.w.Href).To(Equal(t.spyRelayer.u.String()))
+	})
+
 	o.Spec("relayer should be given the request", func(t TE) {
 		req, err := http.NewRequest("GET", "http://some.url", nil)
 		Expect(t, err).To(BeNil())
@@ -95,6 +170,50 @@ func TestHTTPEvent(t *testing.T) {
 		Expect(t, t.recorder.Body.String()).To(Equal("some-data"))
 	})
 
+	o.Spec("it defaults to a 200", func(t TE) {
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	o.Spec("it streams the response when configured to", func(t TE) {
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			true,
+			handlers.QueueLimits{},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+		t.spyRelayer.resp = faas.Response{
+			StatusCode: 234,
+			Header: http.Header{
+				"A": []string{"x"},
+			},
+		}
+		body := &spyReadCloser{Reader: strings.NewReader("some-data")}
+		t.spyRelayer.body = body
+
+		req, err := http.NewRequest("POST", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.spyRelayer.streamed).To(BeTrue())
+		Expect(t, t.spyWorkSubmitter.w.Href).To(Equal(t.spyRelayer.u.String()))
+		Expect(t, t.spyWorkSubmitter.w.Stream).To(BeTrue())
+		Expect(t, t.recorder.Code).To(Equal(234))
+		Expect(t, t.recorder.Header().Get("A")).To(Equal("x"))
+		Expect(t, t.recorder.Body.String()).To(Equal("some-data"))
+		Expect(t, t.recorder.Flushed).To(BeTrue())
+		Expect(t, body.closed).To(BeTrue())
+	})
+
 	o.Spec("it should return a 500 if the task fails", func(t TE) {
 		t.spyRelayer.respErr = errors.New("some-error")
 
@@ -115,6 +234,219 @@ func TestHTTPEvent(t *testing.T) {
 		Expect(t, t.recorder.Code).To(Equal(http.StatusInternalServerError))
 	})
 
+	o.Spec("it sheds requests past the max queue length", func(t TE) {
+		t.spyWorkSubmitter.block = true
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			false,
+			handlers.QueueLimits{MaxLength: 1},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+		go t.h.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+		Expect(t, t.spyWorkSubmitter.Called).To(ViaPolling(Equal(1)))
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("1"))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(1)))
+
+		// It was shed before it was relayed.
+		Expect(t, t.spyWorkSubmitter.Called()).To(Equal(1))
+	})
+
+	o.Spec("it sheds requests that wait past the max queue wait", func(t TE) {
+		t.spyWorkSubmitter.block = true
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			false,
+			handlers.QueueLimits{MaxWait: 50 * time.Millisecond},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		start := time.Now()
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, time.Since(start).Seconds()).To(BeBelow(5))
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("1"))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(1)))
+
+		// The relayer gives up on the request.
+		Expect(t, t.spyRelayer.ctx.Err()).To(Not(BeNil()))
+	})
+
+	o.Spec("it does not shed requests a worker took as the max queue wait passed", func(t TE) {
+		t.spyWorkSubmitter.takeLate = true
+		t.spyRelayer.resp = faas.Response{StatusCode: http.StatusAccepted}
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			false,
+			handlers.QueueLimits{MaxWait: 50 * time.Millisecond},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(0)))
+	})
+
+	o.Spec("it cuts the response short if the streamed body fails", func(t TE) {
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			true,
+			handlers.QueueLimits{},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+		t.spyRelayer.resp = faas.Response{StatusCode: http.StatusOK}
+		t.spyRelayer.body = &spyReadCloser{Reader: io.MultiReader(
+			strings.NewReader("some-data"),
+			&errReader{err: errors.New("some-error")},
+		)}
+
+		server := httptest.NewServer(t.h)
+		server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, string(data)).To(Equal("some-data"))
+	})
+
+	o.Spec("it sheds streamed requests too", func(t TE) {
+		t.spyWorkSubmitter.block = true
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			true,
+			handlers.QueueLimits{MaxWait: 50 * time.Millisecond},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+
+		req, err := http.NewRequest("POST", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(1)))
+	})
+
+	o.Spec("it never lets more than the max queue length wait", func(t TE) {
+		t.spyWorkSubmitter.block = true
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command: "some-command",
+				AppName: "some-app",
+			},
+			false,
+			handlers.QueueLimits{MaxLength: 2},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", "http://some.url", nil)
+				t.h.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+			}()
+		}
+
+		Expect(t, func() uint64 { return t.spyMetrics.Counter("shed_requests") }).To(ViaPolling(Equal(uint64(18))))
+		Expect(t, t.spyWorkSubmitter.Called()).To(Equal(2))
+		Expect(t, t.spyMetrics.Gauge("queue_depth")).To(Equal(2.0))
+
+		cancel()
+		wg.Wait()
+		Expect(t, t.spyMetrics.Gauge("queue_depth")).To(Equal(0.0))
+	})
+
+	o.Spec("it sheds requests rejected for the max concurrency", func(t TE) {
+		t.spyWorkSubmitter.err = fmt.Errorf("%w: some-command allows 1", handlers.ErrMaxConcurrency)
+		t.h = handlers.NewHTTPEvent(
+			internalapi.Work{
+				Command:        "some-command",
+				AppName:        "some-app",
+				MaxConcurrency: 1,
+				RejectExcess:   true,
+			},
+			false,
+			handlers.QueueLimits{},
+			t.spyRelayer,
+			t.spyWorkSubmitter,
+			t.spyMetrics,
+			log.New(ioutil.Discard, "", 0),
+		)
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal("1"))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(1)))
+	})
+
+	o.Spec("it returns a 500 if no worker takes the work", func(t TE) {
+		t.spyWorkSubmitter.err = context.DeadlineExceeded
+
+		req, err := http.NewRequest("GET", "http://some.url", nil)
+		Expect(t, err).To(BeNil())
+
+		t.h.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusInternalServerError))
+		Expect(t, t.recorder.Header().Get("Retry-After")).To(Equal(""))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(0)))
+	})
+
 	o.Spec("it should use context from request for submitting work", func(t TE) {
 		ctx, cancel := context.WithCancel(context.Background())
 		req, err := http.NewRequest("GET", "http://some.url", nil)
@@ -164,6 +496,9 @@ type spyRelayer struct {
 
 	resp    faas.Response
 	respErr error
+
+	streamed bool
+	body     io.ReadCloser
 }
 
 func newSpyRelayer() *spyRelayer {
@@ -194,16 +529,125 @@ func (s *spyRelayer) Relay(r *http.Request) (*url.URL, func() (faas.Response, er
 	}, s.err
 }
 
+func (s *spyRelayer) RelayStream(r *http.Request) (*url.URL, func() (faas.Response, io.ReadCloser, error), error) {
+	u, f, err := s.Relay(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streamed = true
+
+	return u, func() (faas.Response, io.ReadCloser, error) {
+		resp, err := f()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return resp, s.body, err
+	}, err
+}
+
+type spyReadCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (s *spyReadCloser) Close() error {
+	s.closed = true
+	return nil
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
 type spyWorkSubmitter struct {
-	ctx context.Context
-	w   internalapi.Work
+	mu     sync.Mutex
+	ctx    context.Context
+	w      internalapi.Work
+	called int
+	err    error
+
+	// block makes SubmitWork wait for the context, like there aren't
+	// any workers.
+	block bool
+
+	// takeLate makes SubmitWork wait for the context like block, but a
+	// worker takes the work as it is done.
+	takeLate bool
 }
 
 func newSpyWorkSubmitter() *spyWorkSubmitter {
 	return &spyWorkSubmitter{}
 }
 
-func (s *spyWorkSubmitter) SubmitWork(ctx context.Context, w internalapi.Work) {
+func (s *spyWorkSubmitter) SubmitWork(ctx context.Context, w internalapi.Work) error {
+	s.mu.Lock()
 	s.ctx = ctx
 	s.w = w
+	s.called++
+	block := s.block
+	takeLate := s.takeLate
+	s.mu.Unlock()
+
+	if takeLate {
+		<-ctx.Done()
+		return nil
+	}
+
+	if block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	return s.err
+}
+
+func (s *spyWorkSubmitter) Called() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.called
+}
+
+type spyMetrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	gauges   map[string]float64
+}
+
+func newSpyMetrics() *spyMetrics {
+	return &spyMetrics{
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+func (s *spyMetrics) NewCounter(name string) func(delta uint64) {
+	return func(delta uint64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.counters[name] += delta
+	}
+}
+
+func (s *spyMetrics) NewGauge(name string) func(value float64) {
+	return func(value float64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.gauges[name] = value
+	}
+}
+
+func (s *spyMetrics) Counter(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
+
+func (s *spyMetrics) Gauge(name string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gauges[name]
 }
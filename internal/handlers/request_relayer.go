@@ -1,18 +1,23 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/poy/cf-faas"
+	"github.com/poy/cf-faas/internal/internalapi"
 	"github.com/gorilla/mux"
 )
 
@@ -20,54 +25,149 @@ type RequestRelayer struct {
 	log        *log.Logger
 	addr       string
 	pathPrefix string
+	appID      string
+	index      string
+	tokens     *Tokens
+	proxy      *httputil.ReverseProxy
 
 	mu sync.Mutex
-	m  map[string]struct {
-		writer chan<- faas.Response
-		errs   chan<- error
-		req    *faas.Request
-	}
+	m  map[string]*relayRequest
+}
+
+type relayRequest struct {
+	req      *faas.Request
+	deadline time.Time
+
+	// body is the request body of a streamed request. It is nil when the
+	// body was read up front. As each token can only be used once, it is
+	// only fetched once.
+	body io.Reader
+
+	writer chan<- relayResponse
+	errs   chan<- error
+
+	// abandoned is closed when nobody is waiting for the response anymore.
+	abandoned <-chan struct{}
+
+	// claim is the token of the GET that fetched the request. A request
+	// can be handed to more than one worker (see WorkerPool), only the
+	// first to fetch it gets it.
+	claim string
+}
+
+type relayResponse struct {
+	resp faas.Response
+
+	// body is set for streamed responses. done must be closed once it has
+	// been read.
+	body io.Reader
+	done chan<- struct{}
 }
 
-func NewRequestRelayer(addr, pathPrefix string, log *log.Logger) *RequestRelayer {
+// NewRequestRelayer returns a new RequestRelayer. Each GET and POST must
+// include a token (via the X-CF-FAAS-TOKEN header) signed by the given
+// Tokens for the relay path. The WorkerPool signs them when it hands out
+// work.
+//
+// The appInstance (<app-guid>:<instance-index>) is included in each relay
+// path. The addr is load balanced across every cf-faas instance, so a
+// request for another instance's relay path is forwarded to it via the CF
+// router (using the X-CF-APP-INSTANCE header). The pathPrefix must therefore
+// be the same on every instance.
+func NewRequestRelayer(addr, pathPrefix, appInstance string, tokens *Tokens, log *log.Logger) *RequestRelayer {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Panicf("invalid relay address %s: %s", addr, err)
+	}
+
+	appID, index := appInstance, ""
+	if i := strings.LastIndex(appInstance, ":"); i >= 0 {
+		appID, index = appInstance[:i], appInstance[i+1:]
+	}
+
 	return &RequestRelayer{
 		log:        log,
 		addr:       addr,
 		pathPrefix: pathPrefix,
-		m: make(map[string]struct {
-			writer chan<- faas.Response
-			errs   chan<- error
-			req    *faas.Request
-		}),
+		appID:      appID,
+		index:      index,
+		tokens:     tokens,
+		m:          make(map[string]*relayRequest),
+		proxy: &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = u.Scheme
+				req.URL.Host = u.Host
+				req.Host = u.Host
+			},
+
+			// Streamed responses have to be relayed as they are written.
+			FlushInterval: -1,
+			ErrorLog:      log,
+		},
 	}
 }
 
+// Relay reads the request body and waits for a function to respond.
 func (r *RequestRelayer) Relay(req *http.Request) (*url.URL, func() (faas.Response, error), error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	path := fmt.Sprintf("/%s/%d%d", r.pathPrefix, rand.Int63(), time.Now().UnixNano())
+	u, f, err := r.relay(req, false)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	body, err := ioutil.ReadAll(req.Body)
+	return u, func() (faas.Response, error) {
+		rr, err := f()
+		return rr.resp, err
+	}, nil
+}
+
+// RelayStream is like Relay, however the request body is handed to the
+// function as it is read and the response body is returned as it is
+// written. The returned body must be closed.
+func (r *RequestRelayer) RelayStream(req *http.Request) (*url.URL, func() (faas.Response, io.ReadCloser, error), error) {
+	u, f, err := r.relay(req, true)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	wc, we := make(chan faas.Response, 1), make(chan error, 1)
+	return u, func() (faas.Response, io.ReadCloser, error) {
+		rr, err := f()
+		if err != nil {
+			return faas.Response{}, nil, err
+		}
 
-	r.m[path] = struct {
-		writer chan<- faas.Response
-		errs   chan<- error
-		req    *faas.Request
-	}{
-		req: &faas.Request{
-			Path:         req.URL.Path,
-			Method:       req.Method,
-			Body:         body,
-			Header:       req.Header,
-			URLVariables: mux.Vars(req),
-		},
-		writer: wc,
-		errs:   we,
+		if rr.body == nil {
+			return rr.resp, ioutil.NopCloser(bytes.NewReader(rr.resp.Body)), nil
+		}
+
+		return rr.resp, &streamBody{Reader: rr.body, done: rr.done}, nil
+	}, nil
+}
+
+func (r *RequestRelayer) relay(req *http.Request, stream bool) (*url.URL, func() (relayResponse, error), error) {
+	path := fmt.Sprintf("/%s/%s/%d%d", r.pathPrefix, r.index, rand.Int63(), time.Now().UnixNano())
+
+	fr := &faas.Request{
+		Path:         req.URL.Path,
+		Method:       req.Method,
+		Header:       req.Header,
+		URLVariables: mux.Vars(req),
+		Query:        req.URL.Query(),
+		RawQuery:     req.URL.RawQuery,
+		Host:         req.Host,
+		Scheme:       scheme(req),
+		RemoteAddr:   remoteAddr(req),
+		RequestID:    requestID(req),
+	}
+
+	var body io.Reader
+	if stream {
+		body = req.Body
+	} else {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		fr.Body = data
 	}
 
 	u, err := url.Parse(fmt.Sprintf("%s%s", r.addr, path))
@@ -75,7 +175,22 @@ func (r *RequestRelayer) Relay(req *http.Request) (*url.URL, func() (faas.Respon
 		return nil, nil, err
 	}
 
-	return u, func() (faas.Response, error) {
+	wc, we := make(chan relayResponse, 1), make(chan error, 1)
+	abandoned := make(chan struct{})
+	deadline, _ := req.Context().Deadline()
+
+	r.mu.Lock()
+	r.m[path] = &relayRequest{
+		req:       fr,
+		deadline:  deadline,
+		body:      body,
+		writer:    wc,
+		errs:      we,
+		abandoned: abandoned,
+	}
+	r.mu.Unlock()
+
+	return u, func() (relayResponse, error) {
 		defer func() {
 			r.mu.Lock()
 			defer r.mu.Unlock()
@@ -84,11 +199,12 @@ func (r *RequestRelayer) Relay(req *http.Request) (*url.URL, func() (faas.Respon
 
 		select {
 		case <-req.Context().Done():
-			return faas.Response{}, req.Context().Err()
+			close(abandoned)
+			return relayResponse{}, req.Context().Err()
 		case resp := <-wc:
 			return resp, nil
 		case err := <-we:
-			return faas.Response{}, err
+			return relayResponse{}, err
 		}
 	}, nil
 }
@@ -105,22 +221,51 @@ func (r *RequestRelayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if instance, ok := r.instance(req.URL.Path); ok && instance != r.index {
+		r.forward(w, req, instance)
+		return
+	}
+
+	if req.Method == http.MethodGet || req.Method == http.MethodPost {
+		if err := r.tokens.Redeem(req.Method, req.URL.Path, req.Header.Get(internalapi.TokenHeader)); err != nil {
+			r.log.Printf("rejecting %s request for %s: %s", req.Method, req.URL.Path, err)
+			rejectToken(w, err)
+			return
+		}
+	}
+
+	token := req.Header.Get(internalapi.TokenHeader)
+
 	switch req.Method {
 	case http.MethodGet:
 		r.mu.Lock()
 		request, ok := r.m[req.URL.Path]
+		claimed := ok && request.claim != ""
+		if ok && !claimed {
+			request.claim = token
+		}
 		r.mu.Unlock()
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		if err := json.NewEncoder(w).Encode(request.req); err != nil {
-			r.log.Printf("failed to send request to GET request: %s", err)
+
+		if claimed {
+			r.log.Printf("request for %s was already fetched by another worker", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
+
+		r.serveRequest(w, req, request)
 	case http.MethodPost:
 		r.mu.Lock()
 		request, ok := r.m[req.URL.Path]
-		delete(r.m, req.URL.Path)
+		if ok && request.claim != "" && request.claim != token {
+			ok = false
+			r.log.Printf("rejecting response for %s from a worker that did not fetch the request", req.URL.Path)
+		} else {
+			delete(r.m, req.URL.Path)
+		}
 		r.mu.Unlock()
 		if !ok {
 			w.WriteHeader(http.StatusNotFound)
@@ -128,7 +273,13 @@ func (r *RequestRelayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 
 		var resp faas.Response
-		if err := json.NewDecoder(req.Body).Decode(&resp); err != nil {
+		body, err := internalapi.DecodeStream(req.Body, req.Header.Get("Content-Type"), &resp)
+		if err == nil && body != nil && request.body == nil {
+			resp.Body, err = ioutil.ReadAll(body)
+			body = nil
+		}
+
+		if err != nil {
 			r.log.Printf("failed to unmarshal response from POST request: %s", err)
 			w.WriteHeader(http.StatusExpectationFailed)
 
@@ -136,8 +287,192 @@ func (r *RequestRelayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		request.writer <- resp
+		if body == nil {
+			request.writer <- relayResponse{resp: resp}
+			return
+		}
+
+		// The body has to be read before the handler returns.
+		done := make(chan struct{})
+		request.writer <- relayResponse{resp: resp, body: body, done: done}
+
+		select {
+		case <-done:
+		case <-request.abandoned:
+			w.WriteHeader(http.StatusNotFound)
+		case <-req.Context().Done():
+		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+// Fetched reports whether a worker has fetched the request for the relay
+// address. A request that is no longer pending counts as fetched.
+func (r *RequestRelayer) Fetched(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	request, ok := r.m[u.Path]
+
+	return !ok || request.claim != ""
+}
+
+// instance returns the index of the cf-faas instance that owns the relay
+// path.
+func (r *RequestRelayer) instance(path string) (string, bool) {
+	prefix := "/" + r.pathPrefix + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// forward proxies the request to the instance that owns it. The token is
+// verified by that instance.
+func (r *RequestRelayer) forward(w http.ResponseWriter, req *http.Request, instance string) {
+	if from := req.Header.Get(internalapi.ForwardedHeader); from != "" {
+		// The CF router could not route the request to the instance. It
+		// most likely no longer exists (along with the request).
+		r.log.Printf("dropping %s request for %s (instance %s) forwarded by instance %s", req.Method, req.URL.Path, instance, from)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	req.Header.Set("X-CF-APP-INSTANCE", fmt.Sprintf("%s:%s", r.appID, instance))
+	req.Header.Set(internalapi.ForwardedHeader, r.index)
+	r.proxy.ServeHTTP(w, req)
+}
+
+func (r *RequestRelayer) serveRequest(w http.ResponseWriter, req *http.Request, request *relayRequest) {
+	fr := *request.req
+	if !request.deadline.IsZero() {
+		fr.Timeout = time.Until(request.deadline)
+	}
+
+	if request.body != nil && !internalapi.AcceptsMultipart(req.Header) {
+		// The function doesn't support the multipart encoding. Fallback to
+		// reading the body up front.
+		data, err := ioutil.ReadAll(request.body)
+		if err != nil {
+			r.log.Printf("failed to read streamed request body: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fr.Body = data
+	}
+
+	if !internalapi.AcceptsMultipart(req.Header) {
+		if err := json.NewEncoder(w).Encode(fr); err != nil {
+			r.log.Printf("failed to send request to GET request: %s", err)
+		}
+		return
+	}
+
+	body := request.body
+	if body == nil {
+		body = bytes.NewReader(fr.Body)
+	}
+	fr.Body = nil
+
+	mw := internalapi.NewMultipartWriter(w)
+	w.Header().Set("Content-Type", mw.ContentType())
+
+	pw, err := mw.WriteEnvelope(fr)
+	if err != nil {
+		r.log.Printf("failed to send request to GET request: %s", err)
+		return
+	}
+
+	// The envelope and each chunk are flushed so the function can start on
+	// them right away.
+	fw := &flushWriter{Writer: pw}
+	fw.f, _ = w.(http.Flusher)
+	fw.flush()
+
+	if _, err := io.Copy(fw, body); err != nil {
+		r.log.Printf("failed to send request body to GET request: %s", err)
+		return
+	}
+
+	if err := mw.Close(); err != nil {
+		r.log.Printf("failed to send request to GET request: %s", err)
+	}
+}
+
+type flushWriter struct {
+	io.Writer
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.flush()
+	return n, err
+}
+
+func (w *flushWriter) flush() {
+	if w.f != nil {
+		w.f.Flush()
+	}
+}
+
+// streamBody releases the POST request that is writing the body once it is
+// closed.
+type streamBody struct {
+	io.Reader
+	once sync.Once
+	done chan<- struct{}
+}
+
+func (b *streamBody) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+	})
+	return nil
+}
+
+func scheme(req *http.Request) string {
+	if s := req.Header.Get("X-Forwarded-Proto"); s != "" {
+		return s
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// remoteAddr returns the original client address. The CF router appends to
+// X-Forwarded-For, so the first entry is the client.
+func remoteAddr(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Vcap-Request-Id"); id != "" {
+		return id
+	}
+
+	return fmt.Sprintf("%x%x", rand.Int63(), time.Now().UnixNano())
+}
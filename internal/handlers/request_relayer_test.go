@@ -7,14 +7,20 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	faas "github.com/poy/cf-faas"
 	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/cf-faas/internal/internalapi"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
 	. "github.com/poy/onpar/matchers"
@@ -24,19 +30,35 @@ import (
 type TR struct {
 	*testing.T
 	r        *handlers.RequestRelayer
+	tokens   *handlers.Tokens
+	signed   map[string]string
 	recorder *httptest.ResponseRecorder
 }
 
+// sign adds a token like the WorkerPool would have handed out. Like a
+// worker, the same token is used for the GET and POST.
+func (t TR) sign(req *http.Request) {
+	token, ok := t.signed[req.URL.Path]
+	if !ok {
+		token = t.tokens.Sign(req.URL.Path, time.Minute)
+		t.signed[req.URL.Path] = token
+	}
+	req.Header.Set("X-CF-FAAS-TOKEN", token)
+}
+
 func TestRequestRelayer(t *testing.T) {
 	t.Parallel()
 	o := onpar.New()
 	defer o.Run(t)
 
 	o.BeforeEach(func(t *testing.T) TR {
+		tokens := handlers.NewRandomTokens()
 		return TR{
 			T:        t,
+			tokens:   tokens,
+			signed:   make(map[string]string),
 			recorder: httptest.NewRecorder(),
-			r:        handlers.NewRequestRelayer("http://some.url", "some-prefix", log.New(ioutil.Discard, "", 0)),
+			r:        handlers.NewRequestRelayer("http://some.url", "some-prefix", "some-guid:0", tokens, log.New(ioutil.Discard, "", 0)),
 		}
 	})
 
@@ -65,6 +87,7 @@ func TestRequestRelayer(t *testing.T) {
 			req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
 			Expect(t, err).To(BeNil())
 			req.Header.Set("X-Forwarded-Proto", "https")
+			t.sign(req)
 
 			t.r.ServeHTTP(t.recorder, req)
 			Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
@@ -86,6 +109,92 @@ func TestRequestRelayer(t *testing.T) {
 		r.ServeHTTP(httptest.NewRecorder(), req)
 	})
 
+	o.Spec("it includes the remaining time before the deadline", func(t TR) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req = req.WithContext(ctx)
+
+		addr, _, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var r faas.Request
+		Expect(t, json.Unmarshal(t.recorder.Body.Bytes(), &r)).To(BeNil())
+		Expect(t, float64(r.Timeout)).To(And(BeAbove(float64(55*time.Second)), BeBelow(float64(time.Minute+1))))
+	})
+
+	o.Spec("it includes the query, host, client and request id", func(t TR) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path?a=1&a=2&b=3", bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.2")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Vcap-Request-Id", "some-request-id")
+
+		addr, _, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var r faas.Request
+		Expect(t, json.Unmarshal(t.recorder.Body.Bytes(), &r)).To(BeNil())
+		Expect(t, r.Query["a"]).To(Equal([]string{"1", "2"}))
+		Expect(t, r.Query.Get("b")).To(Equal("3"))
+		Expect(t, r.RawQuery).To(Equal("a=1&a=2&b=3"))
+		Expect(t, r.Host).To(Equal("some.url"))
+		Expect(t, r.Scheme).To(Equal("https"))
+		Expect(t, r.RemoteAddr).To(Equal("1.2.3.4"))
+		Expect(t, r.RequestID).To(Equal("some-request-id"))
+	})
+
+	o.Spec("it falls back to the connection and generates a request id", func(t TR) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.RemoteAddr = "10.0.0.1:12345"
+
+		addr1, _, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+		addr2, _, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+
+		var requests []faas.Request
+		for _, addr := range []string{addr1.String(), addr2.String()} {
+			req, err = http.NewRequest("GET", addr, bytes.NewReader(nil))
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-Forwarded-Proto", "https")
+			t.sign(req)
+
+			recorder := httptest.NewRecorder()
+			t.r.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+			var r faas.Request
+			Expect(t, json.Unmarshal(recorder.Body.Bytes(), &r)).To(BeNil())
+			requests = append(requests, r)
+		}
+
+		Expect(t, requests[0].RemoteAddr).To(Equal("10.0.0.1"))
+		Expect(t, requests[0].Scheme).To(Equal("http"))
+		Expect(t, requests[0].RequestID).To(Not(Equal("")))
+		Expect(t, requests[0].RequestID).To(Not(Equal(requests[1].RequestID)))
+	})
+
 	o.Spec("it writes response back to ResponseWriter on POST", func(t TR) {
 		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
 		Expect(t, err).To(BeNil())
@@ -102,6 +211,7 @@ func TestRequestRelayer(t *testing.T) {
 
 		Expect(t, err).To(BeNil())
 		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
 
 		t.r.ServeHTTP(t.recorder, req)
 		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
@@ -112,6 +222,252 @@ func TestRequestRelayer(t *testing.T) {
 		Expect(t, string(resp.Body)).To(Equal("hello"))
 	})
 
+	o.Spec("it uses the multipart encoding when the function accepts it", func(t TR) {
+		expectedData := []byte{0, 1, 255}
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(expectedData))
+		Expect(t, err).To(BeNil())
+
+		addr, f, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+		req.Header.Set("Accept", "multipart/mixed, application/json;q=0.9")
+
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		contentType := t.recorder.Header().Get("Content-Type")
+		Expect(t, internalapi.IsMultipart(contentType)).To(BeTrue())
+
+		var r faas.Request
+		body, err := internalapi.Decode(t.recorder.Body, contentType, &r)
+		Expect(t, err).To(BeNil())
+		Expect(t, body).To(Equal(expectedData))
+		Expect(t, r.Path).To(Equal("/v1/some-path"))
+		Expect(t, r.Body).To(BeNil())
+
+		contentType, data, err := internalapi.EncodeMultipart(faas.Response{StatusCode: 234}, []byte{255, 0})
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("POST", addr.String(), bytes.NewReader(data))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+		req.Header.Set("Content-Type", contentType)
+
+		t.r.ServeHTTP(httptest.NewRecorder(), req)
+
+		resp, err := f()
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(234))
+		Expect(t, resp.Body).To(Equal([]byte{255, 0}))
+	})
+
+	o.Spec("it streams the request and response bodies", func(t TR) {
+		ur, uw := io.Pipe()
+		go func() {
+			uw.Write([]byte("some-upload"))
+			uw.Close()
+		}()
+
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", ur)
+		Expect(t, err).To(BeNil())
+
+		addr, f, err := t.r.RelayStream(req)
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+		req.Header.Set("Accept", "multipart/mixed")
+
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var r faas.Request
+		body, err := internalapi.Decode(t.recorder.Body, t.recorder.Header().Get("Content-Type"), &r)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(body)).To(Equal("some-upload"))
+
+		pr, pw := io.Pipe()
+		mw := internalapi.NewMultipartWriter(pw)
+		next := make(chan struct{})
+		go func() {
+			bw, _ := mw.WriteEnvelope(faas.Response{StatusCode: 234})
+			bw.Write([]byte("chunk-1"))
+			<-next
+			bw.Write([]byte("chunk-2"))
+			mw.Close()
+			pw.Close()
+		}()
+
+		req, err = http.NewRequest("POST", addr.String(), pr)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+		req.Header.Set("Content-Type", mw.ContentType())
+
+		posted := make(chan struct{})
+		go func() {
+			defer close(posted)
+			t.r.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+
+		resp, rc, err := f()
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(234))
+
+		chunk := make([]byte, len("chunk-1"))
+		_, err = io.ReadFull(rc, chunk)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(chunk)).To(Equal("chunk-1"))
+
+		close(next)
+		rest, err := ioutil.ReadAll(rc)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(rest)).To(Equal("chunk-2"))
+
+		// The POST is held open until the body has been read.
+		Expect(t, posted).To(Always(Not(BeClosed())))
+		rc.Close()
+		Expect(t, posted).To(ViaPolling(BeClosed()))
+	})
+
+	o.Spec("it rejects a replayed token", func(t TR) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", strings.NewReader("some-upload"))
+		Expect(t, err).To(BeNil())
+
+		addr, _, err := t.r.RelayStream(req)
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var r faas.Request
+		Expect(t, json.Unmarshal(t.recorder.Body.Bytes(), &r)).To(BeNil())
+		Expect(t, string(r.Body)).To(Equal("some-upload"))
+
+		recorder := httptest.NewRecorder()
+		t.r.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("it only gives the request to the first worker that fetches it", func(t TR) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+
+		addr, f, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+		Expect(t, t.r.Fetched(addr.String())).To(BeFalse())
+
+		first := t.tokens.Sign(addr.Path, time.Minute)
+		second := t.tokens.Sign(addr.Path, time.Minute)
+
+		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-CF-FAAS-TOKEN", first)
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, t.r.Fetched(addr.String())).To(BeTrue())
+
+		recorder := httptest.NewRecorder()
+		req.Header.Set("X-CF-FAAS-TOKEN", second)
+		t.r.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusNotFound))
+
+		// Only the worker that fetched the request can respond.
+		post := func(token string) int {
+			req, err := http.NewRequest("POST", addr.String(), strings.NewReader(`{"status_code":234}`))
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-CF-FAAS-TOKEN", token)
+
+			recorder := httptest.NewRecorder()
+			t.r.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		Expect(t, post(second)).To(Equal(http.StatusNotFound))
+		Expect(t, post(first)).To(Equal(http.StatusOK))
+
+		resp, err := f()
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(234))
+	})
+
+	o.Spec("it reports requests that are no longer pending as fetched", func(t TR) {
+		Expect(t, t.r.Fetched("http://some.url/some-prefix/0/unknown")).To(BeTrue())
+	})
+
+	o.Spec("it rejects a missing or invalid token", func(t TR) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+
+		addr, _, err := t.r.Relay(req)
+		Expect(t, err).To(BeNil())
+
+		for _, method := range []string{"GET", "POST"} {
+			req, err = http.NewRequest(method, addr.String(), strings.NewReader(`{"status_code":200}`))
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-Forwarded-Proto", "https")
+
+			recorder := httptest.NewRecorder()
+			t.r.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+
+			// Signed for another path
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-other-path", time.Minute))
+			recorder = httptest.NewRecorder()
+			t.r.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+
+			// Signed with another key
+			req.Header.Set("X-CF-FAAS-TOKEN", handlers.NewRandomTokens().Sign(addr.Path, time.Minute))
+			recorder = httptest.NewRecorder()
+			t.r.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+
+			// Expired
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign(addr.Path, -time.Second))
+			recorder = httptest.NewRecorder()
+			t.r.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+		}
+	})
+
+	o.Spec("it buffers a JSON response for a streamed request", func(t TR) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
+		Expect(t, err).To(BeNil())
+
+		addr, f, err := t.r.RelayStream(req)
+		Expect(t, err).To(BeNil())
+
+		req, err = http.NewRequest("POST", addr.String(), strings.NewReader(`{"status_code":234,"body":"aGVsbG8="}`))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
+
+		t.r.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		resp, rc, err := f()
+		Expect(t, err).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(234))
+
+		body, err := ioutil.ReadAll(rc)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(body)).To(Equal("hello"))
+	})
+
 	o.Spec("it rejects requests that dont have X-Forwarded-Proto for HTTPS", func(t TR) {
 		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", bytes.NewReader(nil))
 		Expect(t, err).To(BeNil())
@@ -148,6 +504,7 @@ func TestRequestRelayer(t *testing.T) {
 		req, err = http.NewRequest("POST", addr.String(), strings.NewReader("invalid"))
 		Expect(t, err).To(BeNil())
 		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
 		t.r.ServeHTTP(t.recorder, req)
 
 		_, err = f()
@@ -185,6 +542,7 @@ func TestRequestRelayer(t *testing.T) {
 		req, err = http.NewRequest("GET", addr.String(), bytes.NewReader(nil))
 		Expect(t, err).To(BeNil())
 		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
 
 		t.r.ServeHTTP(t.recorder, req)
 		Expect(t, t.recorder.Code).To(Equal(http.StatusNotFound))
@@ -192,6 +550,7 @@ func TestRequestRelayer(t *testing.T) {
 		req, err = http.NewRequest("POST", addr.String(), bytes.NewReader(nil))
 		Expect(t, err).To(BeNil())
 		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
 
 		t.recorder = httptest.NewRecorder()
 		t.r.ServeHTTP(t.recorder, req)
@@ -202,6 +561,7 @@ func TestRequestRelayer(t *testing.T) {
 		req, err := http.NewRequest("GET", "http://some.url/invalid", bytes.NewReader(nil))
 		Expect(t, err).To(BeNil())
 		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
 
 		t.r.ServeHTTP(t.recorder, req)
 		Expect(t, t.recorder.Code).To(Equal(http.StatusNotFound))
@@ -211,8 +571,199 @@ func TestRequestRelayer(t *testing.T) {
 		req, err := http.NewRequest("PUT", "http://some.url", bytes.NewReader(nil))
 		Expect(t, err).To(BeNil())
 		req.Header.Set("X-Forwarded-Proto", "https")
+		t.sign(req)
 
 		t.r.ServeHTTP(t.recorder, req)
 		Expect(t, t.recorder.Code).To(Equal(http.StatusMethodNotAllowed))
 	})
 }
+
+type TRI struct {
+	*testing.T
+	server   *httptest.Server
+	relayers []*handlers.RequestRelayer
+	tokens   []*handlers.Tokens
+}
+
+// TestRequestRelayerInstances simulates several cf-faas instances behind a
+// CF router. The router honors X-CF-APP-INSTANCE and otherwise picks the
+// next instance.
+func TestRequestRelayerInstances(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TRI {
+		tri := TRI{T: t}
+
+		var mu sync.Mutex
+		var next int
+		tri.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			i := next % len(tri.relayers)
+			next++
+			mu.Unlock()
+
+			if instance := req.Header.Get("X-CF-APP-INSTANCE"); instance != "" {
+				var err error
+				i, err = strconv.Atoi(strings.TrimPrefix(instance, "some-guid:"))
+				if err != nil || i >= len(tri.relayers) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+			}
+
+			req.Header.Set("X-Forwarded-Proto", "https")
+			tri.relayers[i].ServeHTTP(w, req)
+		}))
+
+		for i := 0; i < 3; i++ {
+			tokens := handlers.NewRandomTokens()
+			tri.tokens = append(tri.tokens, tokens)
+			tri.relayers = append(tri.relayers, handlers.NewRequestRelayer(
+				tri.server.URL,
+				"some-prefix",
+				fmt.Sprintf("some-guid:%d", i),
+				tokens,
+				log.New(ioutil.Discard, "", 0),
+			))
+		}
+
+		return tri
+	})
+
+	o.AfterEach(func(t TRI) {
+		t.server.Close()
+	})
+
+	o.Spec("it forwards requests to the instance that owns them", func(t TRI) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", strings.NewReader("some-body"))
+		Expect(t, err).To(BeNil())
+
+		addr, f, err := t.relayers[1].Relay(req)
+		Expect(t, err).To(BeNil())
+		token := t.tokens[1].Sign(addr.Path, time.Minute)
+
+		// Lands on instance 0
+		req, err = http.NewRequest("GET", addr.String(), nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", token)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+
+		var fr faas.Request
+		Expect(t, json.NewDecoder(resp.Body).Decode(&fr)).To(BeNil())
+		Expect(t, string(fr.Body)).To(Equal("some-body"))
+
+		// Lands on instance 2
+		req, err = http.NewRequest("POST", addr.String(), strings.NewReader(`{"status_code":234}`))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-APP-INSTANCE", "some-guid:2")
+		req.Header.Set("X-CF-FAAS-TOKEN", token)
+		resp, err = http.DefaultClient.Do(req)
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+
+		r, err := f()
+		Expect(t, err).To(BeNil())
+		Expect(t, r.StatusCode).To(Equal(234))
+	})
+
+	o.Spec("it streams through the forwarding instance", func(t TRI) {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", pr)
+		Expect(t, err).To(BeNil())
+
+		addr, f, err := t.relayers[0].RelayStream(req)
+		Expect(t, err).To(BeNil())
+		token := t.tokens[0].Sign(addr.Path, time.Minute)
+
+		req, err = http.NewRequest("GET", addr.String(), nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-APP-INSTANCE", "some-guid:1")
+		req.Header.Set("X-CF-FAAS-TOKEN", token)
+		req.Header.Set("Accept", internalapi.MultipartType)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+
+		var fr faas.Request
+		body, err := internalapi.DecodeStream(resp.Body, resp.Header.Get("Content-Type"), &fr)
+		Expect(t, err).To(BeNil())
+
+		// The first chunk arrives before the upload is done.
+		pw.Write([]byte("chunk-1"))
+		chunk := make([]byte, len("chunk-1"))
+		_, err = io.ReadFull(body, chunk)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(chunk)).To(Equal("chunk-1"))
+		pw.Close()
+
+		ct, data, err := internalapi.EncodeMultipart(faas.Response{StatusCode: 200}, []byte("some-response"))
+		Expect(t, err).To(BeNil())
+		req, err = http.NewRequest("POST", addr.String(), bytes.NewReader(data))
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-APP-INSTANCE", "some-guid:2")
+		req.Header.Set("X-CF-FAAS-TOKEN", token)
+		req.Header.Set("Content-Type", ct)
+
+		errs := make(chan error, 1)
+		go func() {
+			resp, err := http.DefaultClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			errs <- err
+		}()
+
+		_, rb, err := f()
+		Expect(t, err).To(BeNil())
+		respBody, err := ioutil.ReadAll(rb)
+		Expect(t, err).To(BeNil())
+		rb.Close()
+		Expect(t, string(respBody)).To(Equal("some-response"))
+		Expect(t, <-errs).To(BeNil())
+	})
+
+	o.Spec("the owner still verifies the token", func(t TRI) {
+		req, err := http.NewRequest("PUT", "http://some.url/v1/some-path", strings.NewReader(""))
+		Expect(t, err).To(BeNil())
+
+		addr, _, err := t.relayers[1].Relay(req)
+		Expect(t, err).To(BeNil())
+
+		// Signed by the wrong instance
+		req, err = http.NewRequest("GET", addr.String(), nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-APP-INSTANCE", "some-guid:0")
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens[0].Sign(addr.Path, time.Minute))
+		resp, err := http.DefaultClient.Do(req)
+		Expect(t, err).To(BeNil())
+		resp.Body.Close()
+		Expect(t, resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("it returns a 404 if the owner is gone", func(t TRI) {
+		req, err := http.NewRequest("GET", t.server.URL+"/some-prefix/7/some-id", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", "some-token")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(t, err).To(BeNil())
+		resp.Body.Close()
+		Expect(t, resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	o.Spec("it does not forward a request more than once", func(t TRI) {
+		req := httptest.NewRequest("GET", t.server.URL+"/some-prefix/1/some-id", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-CF-FAAS-FORWARDED", "2")
+
+		recorder := httptest.NewRecorder()
+		t.relayers[0].ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusNotFound))
+	})
+}
@@ -9,21 +9,34 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/poy/cf-faas/internal/internalapi"
 	"github.com/poy/cf-faas/internal/manifest"
-	gocapi "github.com/poy/go-capi"
 	"github.com/gorilla/mux"
 )
 
+// relayerPathPrefix is where every instance serves its RequestRelayer from.
+// Some random thing that won't be a viable path.
+const relayerPathPrefix = "_relayer_59274013642857031"
+
+// WorkersPath is where each instance lists the workers that have registered
+// with it. Like every endpoint that isn't no_auth, it requires a token for
+// the space.
+const WorkersPath = "/_cf_faas/workers"
+
 type Router struct {
 	applicationURI    string
 	applicationName   string
 	applicationID     string
 	instanceIndex     int
 	groupcachePool    http.Handler
-	capiClient        *gocapi.Client
-	newRequestRelayer func(addr, pathPrefix string, log *log.Logger) *RequestRelayer
-	newWorkerPool     func(ctx context.Context, addr string, appNames []string, appInstance string, addTaskThreshold time.Duration, c TaskCreator, log *log.Logger) *WorkerPool
-	newHTTPEvent      func(command string, appName string, r Relayer, s WorkSubmitter, log *log.Logger) *HTTPEvent
+	taskCreator       TaskCreator
+	scaler            Scaler
+	minWarmWorkers    int
+	workerIdleTTL     time.Duration
+	metrics           Metrics
+	newRequestRelayer func(addr, pathPrefix, appInstance string, tokens *Tokens, log *log.Logger) *RequestRelayer
+	newWorkerPool     func(ctx context.Context, addr string, appNames []string, appInstance string, addTaskThreshold, leaseTTL time.Duration, tokens *Tokens, s Scaler, minWarm int, idleTTL time.Duration, l LeaseChecker, c TaskCreator, m Metrics, log *log.Logger) *WorkerPool
+	newHTTPEvent      func(work internalapi.Work, stream bool, limits QueueLimits, r Relayer, s WorkSubmitter, m Metrics, log *log.Logger) *HTTPEvent
 	newCache          func(name string, headers []string, h http.Handler, d time.Duration, log *log.Logger) *Cache
 	log               *log.Logger
 }
@@ -34,10 +47,14 @@ func NewRouter(
 	applicationID string,
 	instanceIndex int,
 	groupcachePool http.Handler,
-	capiClient *gocapi.Client,
-	newRequestRelayer func(addr, pathPrefix string, log *log.Logger) *RequestRelayer,
-	newWorkerPool func(ctx context.Context, addr string, appNames []string, appInstance string, addTaskThreshold time.Duration, c TaskCreator, log *log.Logger) *WorkerPool,
-	newHTTPEvent func(command string, appName string, r Relayer, s WorkSubmitter, log *log.Logger) *HTTPEvent,
+	taskCreator TaskCreator,
+	scaler Scaler,
+	minWarmWorkers int,
+	workerIdleTTL time.Duration,
+	metrics Metrics,
+	newRequestRelayer func(addr, pathPrefix, appInstance string, tokens *Tokens, log *log.Logger) *RequestRelayer,
+	newWorkerPool func(ctx context.Context, addr string, appNames []string, appInstance string, addTaskThreshold, leaseTTL time.Duration, tokens *Tokens, s Scaler, minWarm int, idleTTL time.Duration, l LeaseChecker, c TaskCreator, m Metrics, log *log.Logger) *WorkerPool,
+	newHTTPEvent func(work internalapi.Work, stream bool, limits QueueLimits, r Relayer, s WorkSubmitter, m Metrics, log *log.Logger) *HTTPEvent,
 	newCache func(name string, headers []string, h http.Handler, d time.Duration, log *log.Logger) *Cache,
 	log *log.Logger,
 ) *Router {
@@ -47,7 +64,11 @@ func NewRouter(
 		applicationID:     applicationID,
 		instanceIndex:     instanceIndex,
 		groupcachePool:    groupcachePool,
-		capiClient:        capiClient,
+		taskCreator:       taskCreator,
+		scaler:            scaler,
+		minWarmWorkers:    minWarmWorkers,
+		workerIdleTTL:     workerIdleTTL,
+		metrics:           metrics,
 		newRequestRelayer: newRequestRelayer,
 		newWorkerPool:     newWorkerPool,
 		newHTTPEvent:      newHTTPEvent,
@@ -59,10 +80,15 @@ func NewRouter(
 func (r *Router) BuildHandler(ctx context.Context, appNames []string, functions []manifest.HTTPFunction) http.Handler {
 	mux := mux.NewRouter()
 	internalID := fmt.Sprintf("%d%d", rand.Int63(), time.Now().UnixNano())
+	appInstance := fmt.Sprintf("%s:%d", r.applicationID, r.instanceIndex)
+
+	// Relay and worker pool credentials. Both are only valid for this
+	// handler.
+	tokens := NewRandomTokens()
 
 	// Request Relayer
-	relayer := r.newRequestRelayer(r.applicationURI, fmt.Sprintf("%s/relayer", internalID), r.log)
-	mux.Handle(fmt.Sprintf("/%s/relayer/{id}", internalID), relayer).Methods(http.MethodGet, http.MethodPost)
+	relayer := r.newRequestRelayer(r.applicationURI, relayerPathPrefix, appInstance, tokens, r.log)
+	mux.Handle(fmt.Sprintf("/%s/{instance}/{id}", relayerPathPrefix), relayer).Methods(http.MethodGet, http.MethodPost)
 
 	// Groupcache Pool
 	mux.Handle("/_group_cache_32723262323249873240/{name}/{key}", r.groupcachePool)
@@ -73,12 +99,20 @@ func (r *Router) BuildHandler(ctx context.Context, appNames []string, functions
 		ctx,
 		r.applicationURI+poolPath,
 		appNames,
-		fmt.Sprintf("%s:%d", r.applicationID, r.instanceIndex),
+		appInstance,
 		time.Second,
-		r.capiClient,
+		5*time.Second,
+		tokens,
+		r.scaler,
+		r.minWarmWorkers,
+		r.workerIdleTTL,
+		relayer,
+		r.taskCreator,
+		r.metrics,
 		r.log,
 	)
-	mux.Handle(poolPath, pool).Methods(http.MethodGet)
+	mux.Handle(poolPath, pool).Methods(http.MethodGet, http.MethodPost)
+	mux.Handle(WorkersPath, pool.Registry()).Methods(http.MethodGet)
 
 	// Functions
 	r.buildFunctionHandlers(functions, mux, relayer, pool)
@@ -93,15 +127,55 @@ func (r *Router) buildFunctionHandlers(functions []manifest.HTTPFunction, mux *m
 			appName = r.applicationName
 		}
 
-		eh := r.newHTTPEvent(
-			f.Handler.Command,
-			appName,
-			relayer,
-			pool,
-			r.log,
-		)
+		// Events share an HTTPEvent unless they stream or have a different
+		// timeout. Those that can shed requests (queue limits or the reject
+		// policy) have their own so their metrics are per route.
+		type key struct {
+			stream  bool
+			timeout time.Duration
+			route   string
+		}
+		ehs := make(map[key]*HTTPEvent)
+		httpEvent := func(e manifest.HTTPEvent) *HTTPEvent {
+			limits := QueueLimits{
+				MaxLength: e.Queue.MaxLength,
+				MaxWait:   e.Queue.MaxWait,
+			}
+
+			k := key{stream: e.Stream, timeout: e.Timeout}
+			if limits != (QueueLimits{}) || f.Handler.ConcurrencyPolicy == manifest.RejectPolicy {
+				k.route = e.Method + " " + e.Path
+			}
+
+			if eh, ok := ehs[k]; ok {
+				return eh
+			}
+
+			work := internalapi.Work{
+				Command:        f.Handler.Command,
+				AppName:        appName,
+				Resident:       f.Handler.Resident,
+				Timeout:        e.Timeout,
+				MaxConcurrency: f.Handler.MaxConcurrency,
+				RejectExcess:   f.Handler.ConcurrencyPolicy == manifest.RejectPolicy,
+				Priority:       f.Handler.Priority,
+				Weight:         f.Handler.Weight,
+				Debug:          f.Handler.Debug,
+				Limits:         internalapi.Limits(f.Handler.Limits),
+				Isolate:        f.Handler.Isolate,
+			}
+			ehs[k] = r.newHTTPEvent(work, e.Stream, limits, relayer, pool, routeMetrics{r.metrics, k.route}, r.log)
+			return ehs[k]
+		}
 
 		for _, e := range f.Events {
+			eh := httpEvent(e)
+
+			if e.Stream {
+				mux.Handle(e.Path, eh).Methods(e.Method)
+				continue
+			}
+
 			if e.Cache.Duration > 0 {
 				ceh := r.newCache(
 					base64.URLEncoding.EncodeToString([]byte(e.Path)),
@@ -118,3 +192,26 @@ func (r *Router) buildFunctionHandlers(functions []manifest.HTTPFunction, mux *m
 		}
 	}
 }
+
+// routeMetrics names the metrics for a route (e.g.,
+// shed_requests{route="GET /v1/path"}). Without a route, they are left as
+// they are.
+type routeMetrics struct {
+	m     Metrics
+	route string
+}
+
+func (m routeMetrics) NewCounter(name string) func(delta uint64) {
+	return m.m.NewCounter(m.name(name))
+}
+
+func (m routeMetrics) NewGauge(name string) func(value float64) {
+	return m.m.NewGauge(m.name(name))
+}
+
+func (m routeMetrics) name(name string) string {
+	if m.route == "" {
+		return name
+	}
+	return fmt.Sprintf("%s{route=%q}", name, m.route)
+}
@@ -10,9 +10,8 @@ import (
 	"testing"
 	"time"
 
-	gocapi "github.com/poy/go-capi"
-
 	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/cf-faas/internal/internalapi"
 	"github.com/poy/cf-faas/internal/manifest"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
@@ -26,6 +25,7 @@ type TRR struct {
 	stubConstructorHTTPEvent      *stubConstructorHTTPEvent
 	stubConstructorCache          *stubConstructorCache
 	groupcachePool                *spyHandler
+	spyMetrics                    *spyMetrics
 	r                             *handlers.Router
 	m                             []manifest.HTTPFunction
 }
@@ -41,6 +41,7 @@ func TestRouter(t *testing.T) {
 		stubConstructorHTTPEvent := newStubConstructorHTTPEvent()
 		stubConstructorCache := newStubConstructorCache()
 		groupcachePool := newSpyHandler()
+		spyMetrics := newSpyMetrics()
 		m := []manifest.HTTPFunction{
 			{
 				Handler: manifest.Handler{
@@ -62,16 +63,43 @@ func TestRouter(t *testing.T) {
 			},
 			{
 				Handler: manifest.Handler{
-					Command: "some-command",
+					Command:           "some-command",
+					Resident:          true,
+					MaxConcurrency:    3,
+					ConcurrencyPolicy: manifest.RejectPolicy,
+					Priority:          1,
+					Weight:            2,
+					Debug:             true,
+					Limits:            manifest.Limits{MemoryMB: 128},
+					Isolate:           true,
 				},
 				Events: []manifest.HTTPEvent{
 					{
 						Path:   "/v1/some-path",
 						Method: "GET",
 					},
+					{
+						Path:   "/v1/some-stream",
+						Method: "POST",
+						Stream: true,
+					},
+					{
+						Path:    "/v1/some-report",
+						Method:  "GET",
+						Timeout: 2 * time.Minute,
+					},
 				},
 			},
 		}
+
+		// Queue limits are per route.
+		for _, path := range []string{"/v1/some-limited", "/v1/other-limited"} {
+			e := manifest.HTTPEvent{Path: path, Method: "GET"}
+			e.Queue.MaxLength = 10
+			e.Queue.MaxWait = time.Second
+			m[1].Events = append(m[1].Events, e)
+		}
+
 		return TRR{
 			T: t,
 			m: m,
@@ -80,13 +108,18 @@ func TestRouter(t *testing.T) {
 			stubConstructorHTTPEvent:      stubConstructorHTTPEvent,
 			stubConstructorCache:          stubConstructorCache,
 			groupcachePool:                groupcachePool,
+			spyMetrics:                    spyMetrics,
 			r: handlers.NewRouter(
 				"http://some.url",
 				"some-application",
 				"some-id",
 				99,
 				groupcachePool,
-				&gocapi.Client{},
+				newSpyTaskCreator(),
+				handlers.NewFixedScaler(5),
+				2,
+				5*time.Minute,
+				spyMetrics,
 				stubConstructorRequestRelayer.New,
 				stubConstructorWorkerPool.New,
 				stubConstructorHTTPEvent.New,
@@ -100,12 +133,18 @@ func TestRouter(t *testing.T) {
 		h := t.r.BuildHandler(context.Background(), nil, t.m)
 		Expect(t, t.stubConstructorRequestRelayer.addr).To(Equal("http://some.url"))
 		Expect(t, t.stubConstructorRequestRelayer.pathPrefix).To(ContainSubstring("relayer"))
+		Expect(t, t.stubConstructorRequestRelayer.appInstance).To(Equal("some-id:99"))
 		Expect(t, t.stubConstructorRequestRelayer.log).To(Not(BeNil()))
 
+		// Every instance has to use the same prefix.
+		prefix := t.stubConstructorRequestRelayer.pathPrefix
+		t.r.BuildHandler(context.Background(), nil, t.m)
+		Expect(t, t.stubConstructorRequestRelayer.pathPrefix).To(Equal(prefix))
+
 		recorder := httptest.NewRecorder()
 		req := httptest.NewRequest(
 			"DELETE", // DELETE is not accepted by RequestRelayer
-			t.stubConstructorRequestRelayer.addr+"/"+t.stubConstructorRequestRelayer.pathPrefix+"/some-id",
+			t.stubConstructorRequestRelayer.addr+"/"+t.stubConstructorRequestRelayer.pathPrefix+"/99/some-id",
 			nil,
 		)
 		h.ServeHTTP(recorder, req)
@@ -135,10 +174,21 @@ func TestRouter(t *testing.T) {
 		Expect(t, t.stubConstructorWorkerPool.appNames).To(Contain("some-application"))
 		Expect(t, t.stubConstructorWorkerPool.appInstance).To(Equal("some-id:99"))
 		Expect(t, t.stubConstructorWorkerPool.addTaskThreshold).To(Equal(time.Second))
-		Expect(t, t.stubConstructorWorkerPool.addTaskThreshold).To(Equal(time.Second))
+		Expect(t, t.stubConstructorWorkerPool.scaler).To(Equal(handlers.NewFixedScaler(5)))
+		Expect(t, t.stubConstructorWorkerPool.minWarm).To(Equal(2))
+		Expect(t, t.stubConstructorWorkerPool.idleTTL).To(Equal(5 * time.Minute))
+		Expect(t, t.stubConstructorWorkerPool.leaseTTL).To(Equal(5 * time.Second))
 		Expect(t, t.stubConstructorWorkerPool.taskCreator).To(Not(BeNil()))
+		Expect(t, t.stubConstructorWorkerPool.metrics).To(Not(BeNil()))
 		Expect(t, t.stubConstructorWorkerPool.log).To(Not(BeNil()))
 
+		// The WorkerPool signs the tokens the RequestRelayer verifies.
+		Expect(t, t.stubConstructorWorkerPool.tokens).To(Not(BeNil()))
+		Expect(t, t.stubConstructorWorkerPool.tokens == t.stubConstructorRequestRelayer.tokens).To(BeTrue())
+
+		// The RequestRelayer knows when leased work is fetched.
+		Expect(t, t.stubConstructorWorkerPool.leases == t.stubConstructorRequestRelayer.relayer).To(BeTrue())
+
 		recorder := httptest.NewRecorder()
 		req := httptest.NewRequest(
 			"DELETE", // DELETE is not accepted by WorkerPool
@@ -151,8 +201,16 @@ func TestRouter(t *testing.T) {
 
 	o.Spec("it creates and registers an HTTPEvent for each function", func(t TRR) {
 		h := t.r.BuildHandler(context.Background(), nil, t.m)
-		Expect(t, t.stubConstructorHTTPEvent.command).To(Equal("some-command"))
-		Expect(t, t.stubConstructorHTTPEvent.appName).To(Equal("some-application"))
+		Expect(t, t.stubConstructorHTTPEvent.work.Command).To(Equal("some-command"))
+		Expect(t, t.stubConstructorHTTPEvent.work.AppName).To(Equal("some-application"))
+		Expect(t, t.stubConstructorHTTPEvent.work.Resident).To(BeTrue())
+		Expect(t, t.stubConstructorHTTPEvent.work.MaxConcurrency).To(Equal(3))
+		Expect(t, t.stubConstructorHTTPEvent.work.RejectExcess).To(BeTrue())
+		Expect(t, t.stubConstructorHTTPEvent.work.Priority).To(Equal(1))
+		Expect(t, t.stubConstructorHTTPEvent.work.Weight).To(Equal(2))
+		Expect(t, t.stubConstructorHTTPEvent.work.Debug).To(BeTrue())
+		Expect(t, t.stubConstructorHTTPEvent.work.Limits.MemoryMB).To(Equal(128))
+		Expect(t, t.stubConstructorHTTPEvent.work.Isolate).To(BeTrue())
 		Expect(t, t.stubConstructorHTTPEvent.relayer).To(Not(BeNil()))
 		Expect(t, t.stubConstructorHTTPEvent.submitter).To(Not(BeNil()))
 		Expect(t, t.stubConstructorHTTPEvent.log).To(Not(BeNil()))
@@ -171,6 +229,47 @@ func TestRouter(t *testing.T) {
 		}).To(Panic())
 	})
 
+	o.Spec("it creates a streaming HTTPEvent for streamed events", func(t TRR) {
+		h := t.r.BuildHandler(context.Background(), nil, t.m)
+		Expect(t, t.stubConstructorHTTPEvent.streams).To(Equal([]bool{false, false, true, false, false, false}))
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(
+			"POST",
+			"http://some.url/v1/some-stream",
+			nil,
+		)
+
+		// We didn't return a properly setup HTTPEvent from our stub. It
+		// should just blow up.
+		Expect(t, func() {
+			h.ServeHTTP(recorder, req)
+		}).To(Panic())
+	})
+
+	o.Spec("it creates an HTTPEvent for each timeout", func(t TRR) {
+		t.r.BuildHandler(context.Background(), nil, t.m)
+		Expect(t, t.stubConstructorHTTPEvent.timeouts).To(Equal([]time.Duration{0, 0, 0, 2 * time.Minute, 0, 0}))
+	})
+
+	o.Spec("it creates an HTTPEvent for each route with queue limits", func(t TRR) {
+		t.r.BuildHandler(context.Background(), nil, t.m)
+		limits := handlers.QueueLimits{MaxLength: 10, MaxWait: time.Second}
+		Expect(t, t.stubConstructorHTTPEvent.limits).To(Equal([]handlers.QueueLimits{
+			{}, {}, {}, {}, limits, limits,
+		}))
+		Expect(t, t.stubConstructorHTTPEvent.metrics).To(HaveLen(6))
+
+		// Routes that can shed requests have their own metrics.
+		t.stubConstructorHTTPEvent.metrics[4].NewCounter("shed_requests")(1)
+		t.stubConstructorHTTPEvent.metrics[5].NewGauge("queue_depth")(3)
+		t.stubConstructorHTTPEvent.metrics[1].NewCounter("shed_requests")(2)
+		Expect(t, t.spyMetrics.Counter(`shed_requests{route="GET /v1/some-limited"}`)).To(Equal(uint64(1)))
+		Expect(t, t.spyMetrics.Gauge(`queue_depth{route="GET /v1/other-limited"}`)).To(Equal(3.0))
+		Expect(t, t.spyMetrics.Counter(`shed_requests{route="GET /v1/some-path"}`)).To(Equal(uint64(2)))
+		Expect(t, t.spyMetrics.Counter("shed_requests")).To(Equal(uint64(0)))
+	})
+
 	o.Spec("it creates and registers a cache for each function", func(t TRR) {
 		h := t.r.BuildHandler(context.Background(), nil, t.m)
 		_ = h
@@ -196,8 +295,11 @@ func TestRouter(t *testing.T) {
 }
 
 type stubConstructorRequestRelayer struct {
-	addr       string
-	pathPrefix string
+	addr        string
+	pathPrefix  string
+	appInstance string
+	tokens      *handlers.Tokens
+	relayer     *handlers.RequestRelayer
 	log        *log.Logger
 }
 
@@ -205,11 +307,14 @@ func newStubConstructorRequestRelayer() *stubConstructorRequestRelayer {
 	return &stubConstructorRequestRelayer{}
 }
 
-func (s *stubConstructorRequestRelayer) New(addr, pathPrefix string, log *log.Logger) *handlers.RequestRelayer {
+func (s *stubConstructorRequestRelayer) New(addr, pathPrefix, appInstance string, tokens *handlers.Tokens, log *log.Logger) *handlers.RequestRelayer {
 	s.addr = addr
 	s.pathPrefix = pathPrefix
+	s.appInstance = appInstance
+	s.tokens = tokens
 	s.log = log
-	return &handlers.RequestRelayer{}
+	s.relayer = &handlers.RequestRelayer{}
+	return s.relayer
 }
 
 type spyHandler struct {
@@ -235,7 +340,14 @@ type stubConstructorWorkerPool struct {
 	appNames         []string
 	appInstance      string
 	addTaskThreshold time.Duration
+	leaseTTL         time.Duration
+	tokens           *handlers.Tokens
+	scaler           handlers.Scaler
+	minWarm          int
+	idleTTL          time.Duration
+	leases           handlers.LeaseChecker
 	taskCreator      handlers.TaskCreator
+	metrics          handlers.Metrics
 	log              *log.Logger
 }
 
@@ -243,23 +355,33 @@ func newStubConstructorWorkerPool() *stubConstructorWorkerPool {
 	return &stubConstructorWorkerPool{}
 }
 
-func (s *stubConstructorWorkerPool) New(ctx context.Context, addr string, appNames []string, appInstance string, addTaskThreshold time.Duration, c handlers.TaskCreator, log *log.Logger) *handlers.WorkerPool {
+func (s *stubConstructorWorkerPool) New(ctx context.Context, addr string, appNames []string, appInstance string, addTaskThreshold, leaseTTL time.Duration, tokens *handlers.Tokens, sc handlers.Scaler, minWarm int, idleTTL time.Duration, l handlers.LeaseChecker, c handlers.TaskCreator, m handlers.Metrics, log *log.Logger) *handlers.WorkerPool {
 	s.ctx = ctx
 	s.addr = addr
 	s.appNames = appNames
 	s.appInstance = appInstance
 	s.addTaskThreshold = addTaskThreshold
+	s.leaseTTL = leaseTTL
+	s.tokens = tokens
+	s.scaler = sc
+	s.minWarm = minWarm
+	s.idleTTL = idleTTL
+	s.leases = l
 	s.taskCreator = c
+	s.metrics = m
 	s.log = log
 
 	return &handlers.WorkerPool{}
 }
 
 type stubConstructorHTTPEvent struct {
-	command   string
-	appName   string
+	work      internalapi.Work
+	streams   []bool
+	timeouts  []time.Duration
+	limits    []handlers.QueueLimits
 	relayer   handlers.Relayer
 	submitter handlers.WorkSubmitter
+	metrics   []handlers.Metrics
 	log       *log.Logger
 }
 
@@ -267,11 +389,14 @@ func newStubConstructorHTTPEvent() *stubConstructorHTTPEvent {
 	return &stubConstructorHTTPEvent{}
 }
 
-func (s *stubConstructorHTTPEvent) New(command string, appName string, r handlers.Relayer, submitter handlers.WorkSubmitter, log *log.Logger) *handlers.HTTPEvent {
-	s.command = command
-	s.appName = appName
+func (s *stubConstructorHTTPEvent) New(work internalapi.Work, stream bool, limits handlers.QueueLimits, r handlers.Relayer, submitter handlers.WorkSubmitter, m handlers.Metrics, log *log.Logger) *handlers.HTTPEvent {
+	s.work = work
+	s.streams = append(s.streams, stream)
+	s.timeouts = append(s.timeouts, work.Timeout)
+	s.limits = append(s.limits, limits)
 	s.relayer = r
 	s.submitter = submitter
+	s.metrics = append(s.metrics, m)
 	s.log = log
 
 	return &handlers.HTTPEvent{}
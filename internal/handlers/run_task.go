@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -20,13 +21,13 @@ type RunTask struct {
 }
 
 type TaskRunner interface {
-	RunTask(command, name string) (string, error)
+	RunTask(ctx context.Context, command, name string) (string, error)
 }
 
-type TaskRunnerFunc func(command, name string) (string, error)
+type TaskRunnerFunc func(ctx context.Context, command, name string) (string, error)
 
-func (f TaskRunnerFunc) RunTask(command, name string) (string, error) {
-	return f(command, name)
+func (f TaskRunnerFunc) RunTask(ctx context.Context, command, name string) (string, error) {
+	return f(ctx, command, name)
 }
 
 func NewRunTask(
@@ -46,8 +47,14 @@ func NewRunTask(
 }
 
 func (r *RunTask) Handle(req faas.Request) (faas.Response, error) {
+	return r.HandleContext(context.Background(), req)
+}
+
+// HandleContext runs the task. The context is cancelled once the request's
+// timeout passes.
+func (r *RunTask) HandleContext(ctx context.Context, req faas.Request) (faas.Response, error) {
 	name := r.encodeTaskName(req)
-	result, err := r.r.RunTask(r.command, name)
+	result, err := r.r.RunTask(ctx, r.command, name)
 	if err != nil {
 		return faas.Response{}, err
 	}
@@ -71,6 +78,12 @@ func (r *RunTask) encodeTaskName(req faas.Request) string {
 	}
 
 	req.Header = header
+
+	// These are different for every request.
+	req.Timeout = 0
+	req.RemoteAddr = ""
+	req.RequestID = ""
+
 	data, err := json.Marshal(req)
 	if err != nil {
 		r.log.Panic(err)
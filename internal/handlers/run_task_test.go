@@ -1,6 +1,7 @@
 package handlers_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -129,6 +130,28 @@ func TestRunTask(t *testing.T) {
 		}
 	})
 
+	o.Spec("it ignores what is different for every request in the name", func(t TT) {
+		t.h.Handle(faas.Request{Path: "/v1/some/path"})
+		name := t.spyTaskRunner.name
+
+		t.h.Handle(faas.Request{
+			Path:       "/v1/some/path",
+			Timeout:    time.Second,
+			RemoteAddr: "some-addr",
+			RequestID:  "some-id",
+		})
+		Expect(t, t.spyTaskRunner.name).To(Equal(name))
+	})
+
+	o.Spec("it gives the TaskRunner the request's context", func(t TT) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		_, err := t.h.(faas.ContextHandler).HandleContext(ctx, faas.Request{})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.spyTaskRunner.ctx == ctx).To(BeTrue())
+	})
+
 	o.Spec("it returns an error if the TaskRunner returns an error", func(t TT) {
 		t.spyTaskRunner.err = errors.New("some-error")
 		_, err := t.h.Handle(faas.Request{})
@@ -187,6 +210,7 @@ func (s *spyDoer) Reqs() []*http.Request {
 }
 
 type spyTaskRunner struct {
+	ctx     context.Context
 	command string
 	name    string
 	result  string
@@ -197,7 +221,8 @@ func newSpyTaskRunner() *spyTaskRunner {
 	return &spyTaskRunner{}
 }
 
-func (s *spyTaskRunner) RunTask(command, name string) (string, error) {
+func (s *spyTaskRunner) RunTask(ctx context.Context, command, name string) (string, error) {
+	s.ctx = ctx
 	s.command = command
 	s.name = name
 	return s.result, s.err
@@ -0,0 +1,178 @@
+package handlers
+
+import "time"
+
+// Scaler decides how many tasks the WorkerPool should start. It is consulted
+// periodically while there is work waiting for a worker.
+type Scaler interface {
+	Scale(s ScaleState) int
+}
+
+// LaunchLimiter is a Scaler that starts at most MaxLaunches tasks every 30
+// seconds. The WorkerPool holds the tasks it starts to keep workers warm to
+// the same limit.
+type LaunchLimiter interface {
+	MaxLaunches() int
+}
+
+// ScaleState is what the WorkerPool knows when it consults its Scaler.
+type ScaleState struct {
+	// Queued is how many pieces of work are waiting for a worker.
+	Queued int
+
+	// Overdue is how many of the queued pieces of work have waited longer
+	// than the WorkerPool's threshold.
+	Overdue int
+
+	// OldestWait is how long the oldest queued piece of work has waited.
+	OldestWait time.Duration
+
+	// Limited is how many pieces of work are waiting for a copy of their
+	// handler to finish because of its MaxConcurrency. More workers won't
+	// help them, so they aren't part of Queued.
+	Limited int
+
+	// IdleWorkers is how many workers are waiting for work.
+	IdleWorkers int
+
+	// RecentLaunches is how many tasks were started within the last 30
+	// seconds.
+	RecentLaunches int
+
+	// Starting is how many of the recently started tasks haven't reached
+	// the WorkerPool yet. They are on their way.
+	Starting int
+
+	// Workers is how many registered workers are sending heartbeats.
+	Workers int
+
+	// IdleRegistered is how many of the registered workers aren't running
+	// any work. They may be between asking for work, so they can take work
+	// like the IdleWorkers.
+	IdleRegistered int
+
+	// InFlight is how much work the registered workers are running.
+	InFlight int
+}
+
+// idleCapacity is how many workers can take queued work without starting
+// a task. A registered worker that is waiting for work is also one of the
+// IdleWorkers, so they aren't added up.
+func idleCapacity(s ScaleState) int {
+	if s.IdleRegistered > s.IdleWorkers {
+		return s.IdleRegistered
+	}
+
+	return s.IdleWorkers
+}
+
+// launchWindow is how far back ScaleState.RecentLaunches and
+// ScaleState.Starting go.
+const launchWindow = 30 * time.Second
+
+type ScalerFunc func(s ScaleState) int
+
+func (f ScalerFunc) Scale(s ScaleState) int {
+	return f(s)
+}
+
+// FixedScaler starts a task for each overdue piece of work that an idle
+// worker or a starting task isn't already on its way for. It starts at most
+// maxLaunches tasks every 30 seconds.
+type FixedScaler struct {
+	maxLaunches int
+}
+
+func NewFixedScaler(maxLaunches int) *FixedScaler {
+	return &FixedScaler{
+		maxLaunches: maxLaunches,
+	}
+}
+
+func (s *FixedScaler) Scale(state ScaleState) int {
+	return capLaunches(state.Overdue-idleCapacity(state)-state.Starting, s.maxLaunches, state)
+}
+
+func (s *FixedScaler) MaxLaunches() int {
+	return s.maxLaunches
+}
+
+// TargetLatencyScaler starts tasks once work has waited longer than the
+// target. It starts enough for all the queued work that isn't covered by
+// idle workers and starting tasks. It starts at most maxLaunches
+// tasks every 30 seconds.
+type TargetLatencyScaler struct {
+	target      time.Duration
+	maxLaunches int
+}
+
+func NewTargetLatencyScaler(target time.Duration, maxLaunches int) *TargetLatencyScaler {
+	return &TargetLatencyScaler{
+		target:      target,
+		maxLaunches: maxLaunches,
+	}
+}
+
+func (s *TargetLatencyScaler) Scale(state ScaleState) int {
+	if state.OldestWait < s.target {
+		return 0
+	}
+
+	return capLaunches(state.Queued-idleCapacity(state)-state.Starting, s.maxLaunches, state)
+}
+
+func (s *TargetLatencyScaler) MaxLaunches() int {
+	return s.maxLaunches
+}
+
+// ProportionalScaler keeps a task for every workPerTask pieces of work,
+// counting both the queued work and the work the registered workers are
+// running. The busy registered workers, idle workers and starting tasks are
+// the tasks it already has. It starts at most maxLaunches tasks every 30
+// seconds.
+type ProportionalScaler struct {
+	workPerTask int
+	maxLaunches int
+}
+
+func NewProportionalScaler(workPerTask, maxLaunches int) *ProportionalScaler {
+	if workPerTask < 1 {
+		workPerTask = 1
+	}
+
+	return &ProportionalScaler{
+		workPerTask: workPerTask,
+		maxLaunches: maxLaunches,
+	}
+}
+
+func (s *ProportionalScaler) Scale(state ScaleState) int {
+	idle := idleCapacity(state)
+	if state.Queued-idle <= 0 {
+		return 0
+	}
+
+	// Round up, any work deserves a task.
+	work := state.Queued + state.InFlight
+	desired := (work + s.workPerTask - 1) / s.workPerTask
+	busy := state.Workers - state.IdleRegistered
+
+	return capLaunches(desired-busy-idle-state.Starting, s.maxLaunches, state)
+}
+
+func (s *ProportionalScaler) MaxLaunches() int {
+	return s.maxLaunches
+}
+
+// capLaunches keeps n between 0 and what is left of maxLaunches.
+func capLaunches(n, maxLaunches int, state ScaleState) int {
+	if left := maxLaunches - state.RecentLaunches; n > left {
+		n = left
+	}
+
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
@@ -0,0 +1,134 @@
+package handlers_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestFixedScaler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) (*testing.T, *handlers.FixedScaler) {
+		return t, handlers.NewFixedScaler(5)
+	})
+
+	o.Spec("starts a task for each overdue piece of work", func(t *testing.T, s *handlers.FixedScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 2})).To(Equal(2))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3})).To(Equal(0))
+	})
+
+	o.Spec("takes starting tasks into account", func(t *testing.T, s *handlers.FixedScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, RecentLaunches: 2, Starting: 2})).To(Equal(1))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, RecentLaunches: 4, Starting: 4})).To(Equal(0))
+	})
+
+	o.Spec("takes idle registered workers into account", func(t *testing.T, s *handlers.FixedScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, Workers: 3, IdleRegistered: 1, InFlight: 2})).To(Equal(2))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, Workers: 3, IdleRegistered: 3})).To(Equal(0))
+
+		// A registered worker waiting for work is also an idle worker.
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, IdleWorkers: 1, Workers: 1, IdleRegistered: 1})).To(Equal(2))
+	})
+
+	o.Spec("counts registered launches towards the limit", func(t *testing.T, s *handlers.FixedScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, RecentLaunches: 4})).To(Equal(1))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Overdue: 3, RecentLaunches: 5})).To(Equal(0))
+	})
+
+	o.Spec("reports its launch limit", func(t *testing.T, s *handlers.FixedScaler) {
+		var l handlers.LaunchLimiter = s
+		Expect(t, l.MaxLaunches()).To(Equal(5))
+	})
+
+	o.Spec("starts at most 5 tasks", func(t *testing.T, s *handlers.FixedScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 10, Overdue: 10})).To(Equal(5))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 10, Overdue: 10, RecentLaunches: 4})).To(Equal(1))
+	})
+}
+
+func TestTargetLatencyScaler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) (*testing.T, *handlers.TargetLatencyScaler) {
+		return t, handlers.NewTargetLatencyScaler(time.Second, 5)
+	})
+
+	o.Spec("waits for the target", func(t *testing.T, s *handlers.TargetLatencyScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, OldestWait: 999 * time.Millisecond})).To(Equal(0))
+	})
+
+	o.Spec("starts a task for all the queued work", func(t *testing.T, s *handlers.TargetLatencyScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, OldestWait: time.Second})).To(Equal(3))
+	})
+
+	o.Spec("takes idle workers and starting tasks into account", func(t *testing.T, s *handlers.TargetLatencyScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 4, OldestWait: time.Second, IdleWorkers: 1, RecentLaunches: 1, Starting: 1})).To(Equal(2))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 4, OldestWait: time.Second, IdleWorkers: 5})).To(Equal(0))
+	})
+
+	o.Spec("takes idle registered workers into account", func(t *testing.T, s *handlers.TargetLatencyScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 4, OldestWait: time.Second, Workers: 3, IdleRegistered: 2, InFlight: 1})).To(Equal(2))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 4, OldestWait: time.Second, IdleWorkers: 1, Workers: 3, IdleRegistered: 2, InFlight: 1})).To(Equal(2))
+	})
+
+	o.Spec("reports its launch limit", func(t *testing.T, s *handlers.TargetLatencyScaler) {
+		var l handlers.LaunchLimiter = s
+		Expect(t, l.MaxLaunches()).To(Equal(5))
+	})
+
+	o.Spec("starts at most 5 tasks", func(t *testing.T, s *handlers.TargetLatencyScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 10, OldestWait: time.Second})).To(Equal(5))
+	})
+}
+
+func TestProportionalScaler(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) (*testing.T, *handlers.ProportionalScaler) {
+		return t, handlers.NewProportionalScaler(3, 5)
+	})
+
+	o.Spec("starts a task for every 3 pieces of queued work", func(t *testing.T, s *handlers.ProportionalScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 1})).To(Equal(1))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3})).To(Equal(1))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 7})).To(Equal(3))
+	})
+
+	o.Spec("takes idle workers and starting tasks into account", func(t *testing.T, s *handlers.ProportionalScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 7, IdleWorkers: 1})).To(Equal(2))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 7, RecentLaunches: 2, Starting: 2})).To(Equal(1))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 2, IdleWorkers: 2})).To(Equal(0))
+	})
+
+	o.Spec("counts the work the registered workers are running", func(t *testing.T, s *handlers.ProportionalScaler) {
+		// 6 pieces of work need 2 tasks. The busy worker is one of them.
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Workers: 1, InFlight: 3})).To(Equal(1))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 3, Workers: 2, InFlight: 3})).To(Equal(0))
+	})
+
+	o.Spec("takes idle registered workers into account", func(t *testing.T, s *handlers.ProportionalScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 7, Workers: 1, IdleRegistered: 1})).To(Equal(2))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 2, Workers: 2, IdleRegistered: 2})).To(Equal(0))
+	})
+
+	o.Spec("reports its launch limit", func(t *testing.T, s *handlers.ProportionalScaler) {
+		var l handlers.LaunchLimiter = s
+		Expect(t, l.MaxLaunches()).To(Equal(5))
+	})
+
+	o.Spec("starts at most 5 tasks", func(t *testing.T, s *handlers.ProportionalScaler) {
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 30})).To(Equal(5))
+		Expect(t, s.Scale(handlers.ScaleState{Queued: 30, RecentLaunches: 3})).To(Equal(2))
+	})
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrExpiredToken  = errors.New("expired token")
+	ErrReplayedToken = errors.New("token has already been used")
+)
+
+// replayWindow is how long after a token is exchanged that it can be
+// exchanged again for the same next token. The response with the next token
+// might have been lost.
+const replayWindow = time.Minute
+
+// Tokens signs and verifies short lived credentials for a path. A token can
+// only be redeemed once per scope (e.g., once for a GET and once for a POST).
+type Tokens struct {
+	key []byte
+	now func() time.Time
+
+	mu        sync.Mutex
+	used      map[string]redemption
+	lastPrune time.Time
+}
+
+type redemption struct {
+	// forget is when the redemption no longer has to be remembered.
+	forget time.Time
+
+	// next is the token it was exchanged for, if any.
+	next string
+	at   time.Time
+}
+
+// NewTokens returns a new Tokens. Every token is signed with the given key.
+func NewTokens(key []byte) *Tokens {
+	return &Tokens{
+		key:  key,
+		now:  time.Now,
+		used: make(map[string]redemption),
+	}
+}
+
+// NewRandomTokens returns a Tokens with a random key. The tokens can only be
+// verified by the same process.
+func NewRandomTokens() *Tokens {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return NewTokens(key)
+}
+
+// Sign returns a token for the path that expires after the ttl.
+func (t *Tokens) Sign(path string, ttl time.Duration) string {
+	expiry := t.now().Add(ttl).UnixNano()
+	return fmt.Sprintf("%d.%s", expiry, t.mac(path, expiry))
+}
+
+// Redeem verifies the token was signed for the path and has not expired or
+// been redeemed for the scope already.
+func (t *Tokens) Redeem(scope, path, token string) error {
+	_, err := t.redeem(scope, path, token, 0)
+	return err
+}
+
+// Exchange redeems the token and returns a new one for the path that
+// expires after the ttl. Exchanging the same token again within the
+// replayWindow returns the same new token instead of an error. That way a
+// client that didn't get the response can try again.
+func (t *Tokens) Exchange(scope, path, token string, ttl time.Duration) (string, error) {
+	return t.redeem(scope, path, token, ttl)
+}
+
+// redeem redeems the token. If the ttl is positive, it is exchanged for a
+// new one.
+func (t *Tokens) redeem(scope, path, token string, ttl time.Duration) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(t.mac(path, expiry))) {
+		return "", ErrInvalidToken
+	}
+
+	now := t.now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+
+	key := scope + " " + token
+	if r, ok := t.used[key]; ok {
+		// The token is still good for a replay after it expires as the
+		// replay is for the same request.
+		if r.next != "" && now.Sub(r.at) <= replayWindow {
+			return r.next, nil
+		}
+		return "", ErrReplayedToken
+	}
+
+	if now.UnixNano() > expiry {
+		return "", ErrExpiredToken
+	}
+
+	r := redemption{
+		forget: time.Unix(0, expiry),
+		at:     now,
+	}
+	if ttl > 0 {
+		r.next = t.Sign(path, ttl)
+		if end := now.Add(replayWindow); end.After(r.forget) {
+			r.forget = end
+		}
+	}
+	t.used[key] = r
+
+	return r.next, nil
+}
+
+// prune forgets about expired tokens once they can't be replayed either.
+// They can't be redeemed anyways. It must be called with the lock held.
+func (t *Tokens) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Second {
+		return
+	}
+	t.lastPrune = now
+
+	for k, r := range t.used {
+		if now.After(r.forget) {
+			delete(t.used, k)
+		}
+	}
+}
+
+func (t *Tokens) mac(path string, expiry int64) string {
+	h := hmac.New(sha256.New, t.key)
+	fmt.Fprintf(h, "%s\n%d", path, expiry)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// rejectToken writes a 401 for a token that could not be redeemed.
+func rejectToken(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, `{"error":%q}`, err.Error())
+}
@@ -0,0 +1,168 @@
+package handlers_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TTK struct {
+	*testing.T
+	tokens *handlers.Tokens
+	clock  *fakeClock
+}
+
+func TestTokens(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TTK {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		tokens := handlers.NewTokens([]byte("some-key"))
+		tokens.SetNow(clock.Now)
+
+		return TTK{
+			T:      t,
+			tokens: tokens,
+			clock:  clock,
+		}
+	})
+
+	o.Spec("it redeems a token once", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(BeNil())
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(Equal(handlers.ErrReplayedToken))
+	})
+
+	o.Spec("it redeems a token once for each scope", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		for _, scope := range []string{"GET", "POST", "pool", "heartbeat"} {
+			Expect(t, t.tokens.Redeem(scope, "/some-path", token)).To(BeNil())
+		}
+
+		for _, scope := range []string{"GET", "POST", "pool", "heartbeat"} {
+			Expect(t, t.tokens.Redeem(scope, "/some-path", token)).To(Equal(handlers.ErrReplayedToken))
+		}
+	})
+
+	o.Spec("it rejects a token for another path", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		Expect(t, t.tokens.Redeem("GET", "/other-path", token)).To(Equal(handlers.ErrInvalidToken))
+
+		// It wasn't redeemed.
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(BeNil())
+	})
+
+	o.Spec("it rejects a token signed with another key", func(t TTK) {
+		other := handlers.NewTokens([]byte("other-key"))
+		token := other.Sign("/some-path", time.Minute)
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(Equal(handlers.ErrInvalidToken))
+	})
+
+	o.Spec("it rejects a malformed token", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		for _, bad := range []string{"", "invalid", "x." + token, token + "x"} {
+			Expect(t, t.tokens.Redeem("GET", "/some-path", bad)).To(Equal(handlers.ErrInvalidToken))
+		}
+	})
+
+	o.Spec("it rejects an expired token", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		t.clock.advance(time.Minute + time.Second)
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(Equal(handlers.ErrExpiredToken))
+
+		_, err := t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(Equal(handlers.ErrExpiredToken))
+	})
+
+	o.Spec("it exchanges a token for a new one", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		next, err := t.tokens.Exchange("pool", "/some-path", token, 2*time.Minute)
+		Expect(t, err).To(BeNil())
+		Expect(t, next).To(Not(Equal(token)))
+
+		// The new token has its own ttl.
+		t.clock.advance(90 * time.Second)
+		Expect(t, t.tokens.Redeem("GET", "/some-path", next)).To(BeNil())
+	})
+
+	o.Spec("it returns the same new token for a replay within the window", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Second)
+		next, err := t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(BeNil())
+
+		// The replay is still good after the token expires.
+		t.clock.advance(handlers.ReplayWindow)
+		replayed, err := t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(BeNil())
+		Expect(t, replayed).To(Equal(next))
+
+		// Another scope doesn't share the replay.
+		_, err = t.tokens.Exchange("heartbeat", "/some-path", token, time.Minute)
+		Expect(t, err).To(Equal(handlers.ErrExpiredToken))
+	})
+
+	o.Spec("it rejects a replay after the window", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Hour)
+		_, err := t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(BeNil())
+
+		t.clock.advance(handlers.ReplayWindow + time.Second)
+		_, err = t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(Equal(handlers.ErrReplayedToken))
+	})
+
+	o.Spec("it doesn't replay a redeemed token", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Minute)
+		Expect(t, t.tokens.Redeem("pool", "/some-path", token)).To(BeNil())
+
+		_, err := t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(Equal(handlers.ErrReplayedToken))
+	})
+
+	o.Spec("it forgets tokens once they expire", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Second)
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(BeNil())
+
+		// Once it is forgotten, it is rejected for being expired instead.
+		t.clock.advance(2 * time.Second)
+		Expect(t, t.tokens.Redeem("GET", "/some-path", token)).To(Equal(handlers.ErrExpiredToken))
+	})
+
+	o.Spec("it forgets exchanged tokens once they can't be replayed", func(t TTK) {
+		token := t.tokens.Sign("/some-path", time.Second)
+		_, err := t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(BeNil())
+
+		t.clock.advance(2 * time.Second)
+		_, err = t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(BeNil())
+
+		t.clock.advance(handlers.ReplayWindow)
+		_, err = t.tokens.Exchange("pool", "/some-path", token, time.Minute)
+		Expect(t, err).To(Equal(handlers.ErrExpiredToken))
+	})
+}
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
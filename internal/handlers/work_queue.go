@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+// ErrMaxConcurrency is returned for work that rejects the excess while its
+// handler is at its MaxConcurrency.
+var ErrMaxConcurrency = errors.New("handler is at its max concurrency")
+
+// workQueue holds the work that is waiting for a worker. There is a queue
+// for each app so that a worker is only handed work it has a package for.
+//
+// Work with a MaxConcurrency is held back while that many copies of its
+// handler are running. A copy is running from when a worker takes it until
+// its context is done or it is released.
+//
+// Work with a higher Priority is always handed out first. Handlers with the
+// same Priority share the workers in proportion to their Weight (stride
+// scheduling). Each handler has a pass that is advanced by 1/Weight each
+// time it is handed out and the handler with the lowest pass goes next. A
+// handler's pass is never behind the queue's virtual time, so handlers
+// can't save up turns while they don't have any work.
+type workQueue struct {
+	mu      sync.Mutex
+	queues  map[string][]*queuedWork
+	waiters []*waiter
+	running map[handlerKey]int
+	passes  map[handlerKey]float64
+	vtime   float64
+}
+
+// handlerKey identifies a handler for its MaxConcurrency.
+type handlerKey struct {
+	appName string
+	command string
+}
+
+func keyFor(w internalapi.Work) handlerKey {
+	return handlerKey{appName: w.AppName, command: w.Command}
+}
+
+type queuedWork struct {
+	work
+	since time.Time
+
+	// taken is closed once a worker takes the work from the queue.
+	taken chan struct{}
+}
+
+// waiter is a worker waiting for work for any of its apps.
+type waiter struct {
+	apps map[string]bool
+	c    chan *queuedWork
+}
+
+func newWorkQueue() *workQueue {
+	return &workQueue{
+		queues:  make(map[string][]*queuedWork),
+		running: make(map[handlerKey]int),
+		passes:  make(map[handlerKey]float64),
+	}
+}
+
+// submit hands the work to a waiting worker or queues it. It blocks until a
+// worker takes it or the context is done. If the work's handler is at its
+// MaxConcurrency and the work rejects the excess, it returns an error right
+// away.
+func (q *workQueue) submit(ctx context.Context, wo work) error {
+	qw := &queuedWork{
+		work:  wo,
+		since: time.Now(),
+		taken: make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	if wo.w.RejectExcess && q.limited(wo.w, q.waiting(keyFor(wo.w))) {
+		q.mu.Unlock()
+		return fmt.Errorf("%w: %s allows %d", ErrMaxConcurrency, wo.w.Command, wo.w.MaxConcurrency)
+	}
+
+	if !q.limited(wo.w, 0) {
+		for i, wt := range q.waiters {
+			if !wt.apps[wo.w.AppName] {
+				continue
+			}
+
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			q.start(qw)
+			wt.c <- qw
+			q.mu.Unlock()
+			return nil
+		}
+	}
+	q.queues[wo.w.AppName] = append(q.queues[wo.w.AppName], qw)
+	q.mu.Unlock()
+
+	select {
+	case <-qw.taken:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if !q.remove(qw) {
+			// A worker took it in the meantime.
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+// take waits for work for any of the given apps. If there isn't any before
+// the context is done, it returns false along with how many other workers
+// are waiting.
+func (q *workQueue) take(ctx context.Context, apps []string) (work, bool, int) {
+	wt := &waiter{
+		apps: make(map[string]bool),
+		c:    make(chan *queuedWork, 1),
+	}
+	for _, app := range apps {
+		wt.apps[app] = true
+	}
+
+	q.mu.Lock()
+	if qw := q.pop(wt.apps); qw != nil {
+		q.mu.Unlock()
+		return qw.work, true, 0
+	}
+	q.waiters = append(q.waiters, wt)
+	q.mu.Unlock()
+
+	select {
+	case qw := <-wt.c:
+		return qw.work, true, 0
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, w := range q.waiters {
+		if w == wt {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			return work{}, false, len(q.waiters)
+		}
+	}
+
+	// The work was handed over while giving up.
+	qw := <-wt.c
+	return qw.work, true, 0
+}
+
+// pop takes the next work for any of the apps that isn't held back by its
+// MaxConcurrency. Each handler's oldest work competes by Priority, then pass
+// and then age. It must be called with the lock held.
+func (q *workQueue) pop(apps map[string]bool) *queuedWork {
+	var next *queuedWork
+	for app := range apps {
+		seen := make(map[handlerKey]bool)
+		for _, qw := range q.queues[app] {
+			k := keyFor(qw.w)
+			if seen[k] || q.limited(qw.w, 0) {
+				continue
+			}
+			seen[k] = true
+
+			if next == nil || q.before(qw, next) {
+				next = qw
+			}
+		}
+	}
+
+	if next == nil {
+		return nil
+	}
+
+	q.remove(next)
+	q.start(next)
+
+	return next
+}
+
+// before reports whether a should be handed out before b. It must be
+// called with the lock held.
+func (q *workQueue) before(a, b *queuedWork) bool {
+	if a.w.Priority != b.w.Priority {
+		return a.w.Priority > b.w.Priority
+	}
+
+	if pa, pb := q.pass(keyFor(a.w)), q.pass(keyFor(b.w)); pa != pb {
+		return pa < pb
+	}
+
+	return a.since.Before(b.since)
+}
+
+// pass returns the handler's pass. It is never behind the virtual time. It
+// must be called with the lock held.
+func (q *workQueue) pass(k handlerKey) float64 {
+	if p := q.passes[k]; p > q.vtime {
+		return p
+	}
+
+	return q.vtime
+}
+
+// charge advances the handler's pass for being handed out. It must be
+// called with the lock held.
+func (q *workQueue) charge(w internalapi.Work) {
+	weight := float64(w.Weight)
+	if weight <= 0 {
+		weight = 1
+	}
+
+	k := keyFor(w)
+	q.vtime = q.pass(k)
+	q.passes[k] = q.vtime + 1/weight
+}
+
+// start counts the work as running and tells the submitter it was taken.
+// It must be called with the lock held.
+func (q *workQueue) start(qw *queuedWork) {
+	close(qw.taken)
+	q.charge(qw.w)
+
+	if qw.w.MaxConcurrency <= 0 {
+		qw.release = func() {}
+		return
+	}
+
+	k := keyFor(qw.w)
+	q.running[k]++
+
+	var once sync.Once
+	qw.release = func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+
+			q.running[k]--
+			if q.running[k] == 0 {
+				delete(q.running, k)
+			}
+			q.dispatch()
+		})
+	}
+
+	go func(ctx context.Context, release func()) {
+		<-ctx.Done()
+		release()
+	}(qw.ctx, qw.release)
+}
+
+// dispatch hands work that is no longer held back to waiting workers. It
+// must be called with the lock held.
+func (q *workQueue) dispatch() {
+	for i := 0; i < len(q.waiters); {
+		wt := q.waiters[i]
+		qw := q.pop(wt.apps)
+		if qw == nil {
+			i++
+			continue
+		}
+
+		q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+		wt.c <- qw
+	}
+}
+
+// limited reports whether the work's handler has reached its
+// MaxConcurrency, counting the extra copies. It must be called with the lock
+// held.
+func (q *workQueue) limited(w internalapi.Work, extra int) bool {
+	return w.MaxConcurrency > 0 && q.running[keyFor(w)]+extra >= w.MaxConcurrency
+}
+
+// waiting returns how much queued work there is for the handler. It must be
+// called with the lock held.
+func (q *workQueue) waiting(k handlerKey) int {
+	var n int
+	for _, qw := range q.queues[k.appName] {
+		if keyFor(qw.w) == k {
+			n++
+		}
+	}
+
+	return n
+}
+
+// remove drops the work from its queue if it is still there and reports
+// whether it was. It must be called with the lock held.
+func (q *workQueue) remove(qw *queuedWork) bool {
+	app := qw.w.AppName
+	for i, x := range q.queues[app] {
+		if x != qw {
+			continue
+		}
+
+		q.queues[app] = append(q.queues[app][:i], q.queues[app][i+1:]...)
+		if len(q.queues[app]) == 0 {
+			delete(q.queues, app)
+		}
+		return true
+	}
+
+	return false
+}
+
+// state reports on the queued work and waiting workers. Work that has
+// waited longer than the threshold is overdue.
+func (q *workQueue) state(threshold time.Duration) ScaleState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := ScaleState{
+		IdleWorkers: len(q.waiters),
+	}
+
+	now := time.Now()
+	for _, queue := range q.queues {
+		for _, qw := range queue {
+			if q.limited(qw.w, 0) {
+				s.Limited++
+				continue
+			}
+			s.Queued++
+
+			wait := now.Sub(qw.since)
+			if wait >= threshold {
+				s.Overdue++
+			}
+
+			if wait > s.OldestWait {
+				s.OldestWait = wait
+			}
+		}
+	}
+
+	return s
+}
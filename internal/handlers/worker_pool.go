@@ -3,166 +3,455 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/poy/cf-faas/internal/internalapi"
-	gocapi "github.com/poy/go-capi"
 )
 
 type WorkerPool struct {
 	c           TaskCreator
-	q           chan work
+	q           *workQueue
 	log         *log.Logger
 	addIn       time.Duration
+	leaseTTL    time.Duration
+	leases      LeaseChecker
 	appInstance string
 	addr        string
+	path        string
 	appNames    []string
+	tokens      *Tokens
+	scaler      Scaler
+	queueDepth  func(value float64)
+	minWarm     int
+	idleTTL     time.Duration
+	registry    *WorkerRegistry
 
-	mu        sync.Mutex
-	taskCount int
+	mu       sync.Mutex
+	now      func() time.Time
+	launches []time.Time
+
+	// starting has the launches that haven't reached the WorkerPool yet by
+	// the token they were given.
+	starting map[string]time.Time
+
+	// late has the launches that didn't reach the WorkerPool within the
+	// launchWindow. They can still arrive until their token expires.
+	late map[string]time.Time
+
+	// lost is how many launches in a row didn't reach the WorkerPool
+	// within the launchWindow. Until warmAfter, tasks aren't created to
+	// keep minWarm workers around.
+	lost      int
+	warmAfter time.Time
 }
 
+const (
+	// bootstrapTokenTTL is how long a new task has to make its first
+	// request.
+	bootstrapTokenTTL = 10 * time.Minute
+
+	// nextTokenTTL is how long a worker has to make its next request. A
+	// worker that is too busy to ask for work keeps getting fresh tokens
+	// with its heartbeats.
+	nextTokenTTL = 2 * time.Minute
+
+	// maxWarmBackoff is the longest the WorkerPool waits to create tasks
+	// for minWarm workers after launches got lost.
+	maxWarmBackoff = 10 * time.Minute
+)
+
 type work struct {
 	w   internalapi.Work
 	ctx context.Context
+
+	// release frees the work's slot of its handler's MaxConcurrency. It is
+	// set once a worker takes the work and is called when the context is
+	// done.
+	release func()
+}
+
+// LeaseChecker reports whether a worker has fetched the relay request for
+// the given relay address.
+type LeaseChecker interface {
+	Fetched(href string) bool
 }
 
+// TaskCreator starts workers (e.g., as Cloud Foundry tasks). The env is
+// the worker's environment variables.
 type TaskCreator interface {
-	RunTask(ctx context.Context, command, name, dropletGuid, appGuid string) (gocapi.Task, error)
+	StartWorker(ctx context.Context, env map[string]string) error
 }
 
+// NewWorkerPool returns a new WorkerPool. Workers authenticate with single
+// use tokens signed by the given Tokens. The first is given to the worker
+// when its task is created and each response includes the next one. A
+// worker that didn't get a response can use the same token again (for a
+// little while) and gets the same next one. The Tokens are also used to
+// sign the relay token for each piece of work.
+//
+// Work is leased to a worker. If the relay request isn't fetched within the
+// leaseTTL (according to the LeaseChecker), the work is handed to another
+// worker.
+//
+// Each handler's MaxConcurrency is enforced across all the workers. A copy
+// of the handler is counted until the work's context is done.
+//
+// While work is waiting for a worker, the Scaler is consulted every
+// addTaskThreshold to decide how many tasks to create. The amount of
+// waiting work is published as the queue_depth metric. Regardless of the
+// Scaler, tasks are created to keep minWarm workers idle. If the Scaler is
+// a LaunchLimiter, its limit applies to them too. While the tasks that are
+// created don't reach the WorkerPool, it waits longer and longer to create
+// more for minWarm workers. Workers exit after the idleTTL without work,
+// unless they are needed to keep minWarm workers around.
+//
+// Workers register and send heartbeats by POSTing to the same address. The
+// registry (see Registry) lists them. The Scaler is told how many there are
+// and which started tasks haven't reached the WorkerPool yet (by the token
+// they were started with).
 func NewWorkerPool(
 	ctx context.Context,
 	addr string,
 	appNames []string,
 	appInstance string,
 	addTaskThreshold time.Duration,
+	leaseTTL time.Duration,
+	tokens *Tokens,
+	scaler Scaler,
+	minWarm int,
+	idleTTL time.Duration,
+	leases LeaseChecker,
 	c TaskCreator,
+	m Metrics,
 	log *log.Logger,
 ) *WorkerPool {
+	u, err := url.Parse(addr)
+	if err != nil {
+		log.Panicf("invalid worker pool address %s: %s", addr, err)
+	}
+
 	p := &WorkerPool{
-		log: log,
-		c:   c,
-		q:   make(chan work),
+		log:    log,
+		c:      c,
+		q:      newWorkQueue(),
+		tokens: tokens,
+		scaler: scaler,
 
+		queueDepth: m.NewGauge("queue_depth"),
+
+		minWarm:     minWarm,
+		idleTTL:     idleTTL,
+		registry:    NewWorkerRegistry(3*internalapi.HeartbeatInterval, 5*time.Minute),
 		appInstance: appInstance,
 		appNames:    appNames,
 		addIn:       addTaskThreshold,
+		leaseTTL:    leaseTTL,
+		leases:      leases,
 		addr:        addr,
+		path:        u.Path,
+		now:         time.Now,
+		starting:    make(map[string]time.Time),
+		late:        make(map[string]time.Time),
 	}
 
-	go p.taskThreshold(ctx)
+	go p.scale(ctx)
 
 	return p
 }
 
+// Registry returns the workers that have registered with the WorkerPool.
+func (p *WorkerPool) Registry() *WorkerRegistry {
+	return p.registry
+}
+
 func (p *WorkerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		p.heartbeat(w, r)
+		return
+	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	ctx, _ := context.WithTimeout(r.Context(), 30*time.Second)
+	token := r.Header.Get(internalapi.TokenHeader)
+	next, err := p.tokens.Exchange("pool", r.URL.Path, token, nextTokenTTL)
+	if err != nil {
+		p.log.Printf("rejecting worker: %s", err)
+		rejectToken(w, err)
+		return
+	}
+	w.Header().Set(internalapi.NextTokenHeader, next)
+	p.started(token)
 
-	var wo work
-	select {
-	case wo = <-p.q:
-	case <-ctx.Done():
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	wo, ok, keepWarm := p.next(ctx, readyApps(r.Header))
+	if !ok {
+		if keepWarm {
+			w.Header().Set(internalapi.KeepWarmHeader, "true")
+		}
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	data, err := json.Marshal(wo.w)
+	relayWork := wo.w
+	relayWork.Token = p.relayToken(wo)
+
+	data, err := json.Marshal(relayWork)
 	if err != nil {
 		p.log.Panicf("failed to marshal data: %s", err)
 	}
 
 	if _, err := w.Write(data); err != nil {
+		wo.release()
 		go p.SubmitWork(wo.ctx, wo.w)
+		return
+	}
+
+	go p.lease(wo)
+}
+
+// heartbeat registers the worker or records that it is still around.
+// Heartbeats have their own chain of tokens.
+func (p *WorkerPool) heartbeat(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(internalapi.TokenHeader)
+	next, err := p.tokens.Exchange("heartbeat", r.URL.Path, token, nextTokenTTL)
+	if err != nil {
+		p.log.Printf("rejecting heartbeat: %s", err)
+		rejectToken(w, err)
+		return
 	}
+	w.Header().Set(internalapi.NextTokenHeader, next)
+	p.started(token)
+
+	var hb internalapi.Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil || hb.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if p.registry.Heartbeat(hb) {
+		p.log.Printf("worker %s (%s) registered", hb.ID, hb.Version)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (p *WorkerPool) SubmitWork(ctx context.Context, w internalapi.Work) {
-	timer := time.NewTimer(p.addIn)
+// lease hands the work to another worker if the relay request isn't
+// fetched in time. The RequestRelayer only gives the request to the first
+// worker that fetches it.
+func (p *WorkerPool) lease(wo work) {
+	timer := time.NewTimer(p.leaseTTL)
 	defer timer.Stop()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case p.q <- work{w: w, ctx: ctx}:
-			return
-		case <-timer.C:
-			if p.tryAddToThreshold() {
-				go func() {
-					// Leave out name, droplet and app name. Their defaults
-					// are good enough.
-					if _, err := p.c.RunTask(context.Background(), p.buildCommand(), "", "", ""); err != nil {
-						log.Printf("creating a task failed: %s", err)
-					}
-				}()
-			}
+	select {
+	case <-timer.C:
+	case <-wo.ctx.Done():
+		return
+	}
+
+	if p.leases.Fetched(wo.w.Href) {
+		return
+	}
+
+	p.log.Printf("relay request %s was not fetched within %s, handing it to another worker", wo.w.Href, p.leaseTTL)
+	wo.release()
+	if err := p.SubmitWork(wo.ctx, wo.w); err != nil {
+		p.log.Printf("failed to hand %s to another worker: %s", wo.w.Href, err)
+	}
+}
+
+// next waits for work for any of the apps. The worker is idle until then.
+// If there isn't any work, it reports whether the worker is needed to keep
+// minWarm workers around.
+func (p *WorkerPool) next(ctx context.Context, apps []string) (work, bool, bool) {
+	wo, ok, others := p.q.take(ctx, apps)
+	if !ok {
+		return work{}, false, others < p.minWarm
+	}
+
+	return wo, true, false
+}
+
+// SubmitWork blocks until a worker with a package for the work's AppName
+// takes it. It returns an error if the context is done first. Work past its
+// MaxConcurrency waits for a copy of its handler to finish or, if it
+// RejectExcess, returns an error right away.
+func (p *WorkerPool) SubmitWork(ctx context.Context, w internalapi.Work) error {
+	// Work that stops waiting after a MaxWait still keeps its slot (and
+	// lease) for as long as the request once a worker takes it.
+	return p.q.submit(ctx, work{w: w, ctx: requestContext(ctx)})
+}
+
+// readyApps returns the apps the worker has packages for.
+func readyApps(h http.Header) []string {
+	var apps []string
+	for _, app := range strings.Split(h.Get(internalapi.AppsHeader), ",") {
+		if app = strings.TrimSpace(app); app != "" {
+			apps = append(apps, app)
 		}
 	}
+
+	return apps
 }
 
-func (p *WorkerPool) tryAddToThreshold() bool {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	if p.taskCount < 5 {
-		p.taskCount++
-		return true
+// relayToken signs a token for the relay path. It expires with the request.
+func (p *WorkerPool) relayToken(wo work) string {
+	u, err := url.Parse(wo.w.Href)
+	if err != nil {
+		p.log.Printf("invalid relay address %s: %s", wo.w.Href, err)
+		return ""
+	}
+
+	ttl := time.Minute
+	if deadline, ok := wo.ctx.Deadline(); ok {
+		ttl = time.Until(deadline)
 	}
 
-	return false
+	return p.tokens.Sign(u.Path, ttl)
 }
 
-func (p *WorkerPool) taskThreshold(ctx context.Context) {
-	ticker := time.NewTicker(30 * time.Second)
+// scale keeps minWarm workers around and consults the Scaler while there
+// is work waiting.
+func (p *WorkerPool) scale(ctx context.Context) {
+	ticker := time.NewTicker(p.addIn)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			p.mu.Lock()
-			p.taskCount = 0
-			p.mu.Unlock()
+			state := p.state()
+			p.queueDepth(float64(state.Queued + state.Limited))
+
+			n := p.warmLaunches(state)
+			if state.Queued > 0 {
+				if scaled := p.scaler.Scale(state); scaled > n {
+					n = scaled
+				}
+			}
+
+			for i := 0; i < n; i++ {
+				p.launch()
+			}
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (p *WorkerPool) buildCommand() string {
-	return fmt.Sprintf(`#!/bin/bash
+func (p *WorkerPool) state() ScaleState {
+	s := p.q.state(p.addIn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Forget about launches that are outside the window.
+	now := p.now()
+	for len(p.launches) > 0 && now.Sub(p.launches[0]) > launchWindow {
+		p.launches = p.launches[1:]
+	}
+	for token, at := range p.starting {
+		if now.Sub(at) > launchWindow {
+			delete(p.starting, token)
+			p.late[token] = at
+			p.lost++
+			p.warmAfter = now.Add(warmBackoff(p.lost))
+		}
+	}
+	for token, at := range p.late {
+		if now.Sub(at) > bootstrapTokenTTL {
+			delete(p.late, token)
+		}
+	}
+	s.RecentLaunches = len(p.launches)
+	s.Starting = len(p.starting)
+	s.Workers, s.IdleRegistered, s.InFlight = p.registry.Live()
+
+	return s
+}
+
+// warmLaunches returns how many tasks to create to keep minWarm workers
+// around. It is held to the Scaler's launch limit and backs off while
+// launches get lost.
+func (p *WorkerPool) warmLaunches(state ScaleState) int {
+	n := p.minWarm - idleCapacity(state) - state.Starting
+	if l, ok := p.scaler.(LaunchLimiter); ok {
+		n = capLaunches(n, l.MaxLaunches(), state)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.now().Before(p.warmAfter) {
+		return 0
+	}
+
+	return n
+}
+
+// warmBackoff is how long to wait to create tasks for minWarm workers after
+// lost launches in a row. It doubles with each one.
+func warmBackoff(lost int) time.Duration {
+	d := launchWindow
+	for i := 1; i < lost && d < maxWarmBackoff; i++ {
+		d *= 2
+	}
+
+	if d > maxWarmBackoff {
+		return maxWarmBackoff
+	}
+	return d
+}
+
+func (p *WorkerPool) launch() {
+	token := p.tokens.Sign(p.path, bootstrapTokenTTL)
 
-PORT=9999 PROXY_HEALTH_PORT=10000 ./proxy &
-echo $! > /tmp/pids
-sleep 2
+	p.mu.Lock()
+	now := p.now()
+	p.launches = append(p.launches, now)
+	p.starting[token] = now
+	p.mu.Unlock()
 
-X_CF_APP_INSTANCE=%q APP_NAMES=%q HTTP_PROXY=http://localhost:9999 POOL_ADDR=%q ./worker &
-echo $! >> /tmp/pids
+	go func() {
+		if err := p.c.StartWorker(context.Background(), p.workerEnv(token)); err != nil {
+			p.log.Printf("starting a worker failed: %s", err)
+		}
+	}()
+}
 
-# Close everything, otherwise the container won't be reset
-function kill_everything {
-    for pid in $(cat /tmp/pids)
-    do
-        kill -9 $pid &>/dev/null || true
-    done
-	exit 0
+// started records that the task started with the token (if any) has
+// reached the WorkerPool. Tasks are arriving, so the backoff for minWarm
+// workers is over.
+func (p *WorkerPool) started(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, starting := p.starting[token]
+	_, late := p.late[token]
+	if !starting && !late {
+		return
+	}
+
+	delete(p.starting, token)
+	delete(p.late, token)
+	p.lost = 0
+	p.warmAfter = time.Time{}
 }
 
-# Watch pids
-while true
-do
-    for pid in $(cat /tmp/pids)
-    do
-        ps -p $pid &> /dev/null || kill_everything
-    done
-    sleep 10
-done
-`, p.appInstance, strings.Join(p.appNames, ","), p.addr)
+// workerEnv returns the environment variables for a new worker. The token
+// is its first one.
+func (p *WorkerPool) workerEnv(token string) map[string]string {
+	return map[string]string{
+		"X_CF_APP_INSTANCE": p.appInstance,
+		"APP_NAMES":         strings.Join(p.appNames, ","),
+		"POOL_ADDR":         p.addr,
+		"POOL_TOKEN":        token,
+		"IDLE_TTL":          p.idleTTL.String(),
+	}
 }
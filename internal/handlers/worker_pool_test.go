@@ -1,7 +1,10 @@
 package handlers_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,7 +15,6 @@ import (
 
 	"github.com/poy/cf-faas/internal/handlers"
 	"github.com/poy/cf-faas/internal/internalapi"
-	gocapi "github.com/poy/go-capi"
 	"github.com/poy/onpar"
 	. "github.com/poy/onpar/expect"
 	. "github.com/poy/onpar/matchers"
@@ -20,9 +22,12 @@ import (
 
 type TP struct {
 	*testing.T
-	spyTaskCreator *spyTaskCreator
-	p              *handlers.WorkerPool
-	recorder       *httptest.ResponseRecorder
+	tokens          *handlers.Tokens
+	spyTaskCreator  *spyTaskCreator
+	spyLeaseChecker *spyLeaseChecker
+	spyMetrics      *spyMetrics
+	p               *handlers.WorkerPool
+	recorder        *httptest.ResponseRecorder
 }
 
 func TestWorkerPool(t *testing.T) {
@@ -32,33 +37,248 @@ func TestWorkerPool(t *testing.T) {
 
 	o.BeforeEach(func(t *testing.T) TP {
 		spyTaskCreator := newSpyTaskCreator()
+		spyLeaseChecker := newSpyLeaseChecker()
+		spyMetrics := newSpyMetrics()
+		tokens := handlers.NewRandomTokens()
 
 		return TP{
-			T:              t,
-			spyTaskCreator: spyTaskCreator,
-			recorder:       httptest.NewRecorder(),
-			p:              handlers.NewWorkerPool(context.Background(), "https://some.url", []string{"a", "b"}, "app-instance", time.Millisecond, spyTaskCreator, log.New(ioutil.Discard, "", 0)),
+			T:               t,
+			tokens:          tokens,
+			spyTaskCreator:  spyTaskCreator,
+			spyLeaseChecker: spyLeaseChecker,
+			spyMetrics:      spyMetrics,
+			recorder:        httptest.NewRecorder(),
+			p:               handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", []string{"a", "b"}, "app-instance", time.Millisecond, time.Minute, tokens, handlers.NewFixedScaler(5), 0, time.Minute, spyLeaseChecker, spyTaskCreator, spyMetrics, log.New(ioutil.Discard, "", 0)),
 		}
 	})
 
 	o.Spec("returns address to find work", func(t TP) {
-		go t.p.SubmitWork(context.Background(), internalapi.Work{
-			Href:    "http://some.url",
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		go t.p.SubmitWork(ctx, internalapi.Work{
+			Href:    "http://some.url/some-relay",
 			Command: "some-command",
 			AppName: "some-app",
 		})
 
-		req, err := http.NewRequest("GET", "http://some.url", nil)
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
 		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+		req.Header.Set("X-CF-FAAS-APPS", "some-app")
 
 		t.p.ServeHTTP(t.recorder, req)
-		Expect(t, t.recorder.Body.String()).To(MatchJSON(`{"href": "http://some.url","command":"some-command","app_name":"some-app"}`))
 		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		var w internalapi.Work
+		Expect(t, json.Unmarshal(t.recorder.Body.Bytes(), &w)).To(BeNil())
+		Expect(t, w.Href).To(Equal("http://some.url/some-relay"))
+		Expect(t, w.Command).To(Equal("some-command"))
+		Expect(t, w.AppName).To(Equal("some-app"))
+
+		// The token is for the relay path.
+		Expect(t, t.tokens.Redeem("GET", "/some-relay", w.Token)).To(BeNil())
+		Expect(t, t.tokens.Redeem("GET", "/some-other-relay", w.Token)).To(Not(BeNil()))
+	})
+
+	o.Spec("only hands out work for the apps the worker has packages for", func(t TP) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		go t.p.SubmitWork(ctx, internalapi.Work{
+			Href:    "http://some.url/some-relay",
+			AppName: "other-app",
+		})
+
+		poll := func(apps string, d time.Duration) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+			req.Header.Set("X-CF-FAAS-APPS", apps)
+			ctx, cancel := context.WithTimeout(context.Background(), d)
+			defer cancel()
+
+			recorder := httptest.NewRecorder()
+			t.p.ServeHTTP(recorder, req.WithContext(ctx))
+			return recorder
+		}
+
+		Expect(t, poll("", 100*time.Millisecond).Code).To(Equal(http.StatusNoContent))
+		Expect(t, poll("some-app", 100*time.Millisecond).Code).To(Equal(http.StatusNoContent))
+
+		recorder := poll("some-app,other-app", time.Minute)
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+		var w internalapi.Work
+		Expect(t, json.Unmarshal(recorder.Body.Bytes(), &w)).To(BeNil())
+		Expect(t, w.AppName).To(Equal("other-app"))
+	})
+
+	o.Spec("hands out the oldest work first", func(t TP) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		submitInOrder(t, ctx,
+			internalapi.Work{
+				Href:    "http://some.url/relay-1",
+				AppName: "app-1",
+			},
+			internalapi.Work{
+				Href:    "http://some.url/relay-2",
+				AppName: "app-2",
+			},
+		)
+
+		var hrefs []string
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+			req.Header.Set("X-CF-FAAS-APPS", "app-2,app-1")
+
+			recorder := httptest.NewRecorder()
+			t.p.ServeHTTP(recorder, req)
+
+			var w internalapi.Work
+			Expect(t, json.Unmarshal(recorder.Body.Bytes(), &w)).To(BeNil())
+			hrefs = append(hrefs, w.Href)
+		}
+
+		Expect(t, hrefs).To(Equal([]string{"http://some.url/relay-1", "http://some.url/relay-2"}))
+	})
+
+	o.Spec("hands work to another worker if the relay request isn't fetched", func(t TP) {
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Hour, 50*time.Millisecond, t.tokens, handlers.NewFixedScaler(5), 0, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		go p.SubmitWork(ctx, internalapi.Work{
+			Href:    "http://some.url/some-relay",
+			AppName: "some-app",
+		})
+
+		var tokens []string
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+			req.Header.Set("X-CF-FAAS-APPS", "some-app")
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req)
+			Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+			var w internalapi.Work
+			Expect(t, json.Unmarshal(recorder.Body.Bytes(), &w)).To(BeNil())
+			Expect(t, w.Href).To(Equal("http://some.url/some-relay"))
+			tokens = append(tokens, w.Token)
+		}
+
+		Expect(t, t.spyLeaseChecker.Hrefs()).To(Contain("http://some.url/some-relay"))
+
+		// Each worker gets its own relay token.
+		Expect(t, tokens[0]).To(Not(Equal(tokens[1])))
+	})
+
+	o.Spec("does not hand out work again once it is fetched", func(t TP) {
+		t.spyLeaseChecker.fetched = true
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Hour, 50*time.Millisecond, t.tokens, handlers.NewFixedScaler(5), 0, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		go p.SubmitWork(ctx, internalapi.Work{
+			Href:    "http://some.url/some-relay",
+			AppName: "some-app",
+		})
+
+		poll := func(d time.Duration) int {
+			req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+			req.Header.Set("X-CF-FAAS-APPS", "some-app")
+			ctx, cancel := context.WithTimeout(context.Background(), d)
+			defer cancel()
+
+			recorder := httptest.NewRecorder()
+			p.ServeHTTP(recorder, req.WithContext(ctx))
+			return recorder.Code
+		}
+
+		Expect(t, poll(time.Minute)).To(Equal(http.StatusOK))
+		Expect(t, poll(200*time.Millisecond)).To(Equal(http.StatusNoContent))
+		Expect(t, t.spyLeaseChecker.Hrefs()).To(Contain("http://some.url/some-relay"))
+	})
+
+	o.Spec("rejects workers without a valid token", func(t TP) {
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+
+		t.p.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		recorder := httptest.NewRecorder()
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-other-pool", time.Minute))
+		t.p.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		recorder = httptest.NewRecorder()
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", -time.Second))
+		t.p.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("hands out the next token and the same one for a replay", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+		req = req.WithContext(ctx)
+
+		t.p.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusNoContent))
+		next := t.recorder.Header().Get("X-CF-FAAS-NEXT-TOKEN")
+		Expect(t, next).To(Not(Equal("")))
+
+		// The worker might not have gotten the response.
+		recorder := httptest.NewRecorder()
+		t.p.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(t, recorder.Header().Get("X-CF-FAAS-NEXT-TOKEN")).To(Equal(next))
+
+		recorder = httptest.NewRecorder()
+		req.Header.Set("X-CF-FAAS-TOKEN", next)
+		t.p.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(t, recorder.Header().Get("X-CF-FAAS-NEXT-TOKEN")).To(Not(Equal(next)))
+	})
+
+	o.Spec("rejects tokens that were only redeemed", func(t TP) {
+		token := t.tokens.Sign("/some-pool", time.Minute)
+		Expect(t, t.tokens.Redeem("pool", "/some-pool", token)).To(BeNil())
+
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", token)
+
+		t.p.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	o.Spec("gives new tasks a token", func(t TP) {
+		go t.p.SubmitWork(context.Background(), internalapi.Work{
+			Href:    "http://some.url/some-relay",
+			Command: "some-command",
+			AppName: "some-app",
+		})
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Not(Equal(0))))
+
+		token := t.spyTaskCreator.Env()["POOL_TOKEN"]
+		Expect(t, t.tokens.Redeem("pool", "/some-pool", token)).To(BeNil())
 	})
 
 	o.Spec("adheres to the request context", func(t TP) {
-		req, err := http.NewRequest("GET", "http://some.url", nil)
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
 		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
 		ctx, cancel := context.WithCancel(context.Background())
 		req = req.WithContext(ctx)
 		cancel()
@@ -67,6 +287,339 @@ func TestWorkerPool(t *testing.T) {
 		Expect(t, t.recorder.Body.Bytes()).To(HaveLen(0))
 	})
 
+	o.Spec("responds with a 204 when there isn't any work", func(t TP) {
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+		ctx, cancel := context.WithCancel(context.Background())
+		req = req.WithContext(ctx)
+		cancel()
+
+		t.p.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(t, t.recorder.Header().Get("X-CF-FAAS-KEEP-WARM")).To(Equal(""))
+	})
+
+	o.Spec("asks workers to keep warm", func(t TP) {
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Hour, time.Minute, t.tokens, handlers.NewFixedScaler(5), 1, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+		ctx, cancel := context.WithCancel(context.Background())
+		req = req.WithContext(ctx)
+		cancel()
+
+		p.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(t, t.recorder.Header().Get("X-CF-FAAS-KEEP-WARM")).To(Equal("true"))
+	})
+
+	o.Spec("keeps the minimum number of workers warm", func(t TP) {
+		handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, handlers.NewFixedScaler(5), 2, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(2)))
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(2)))
+	})
+
+	o.Spec("holds warm workers to the Scaler's launch limit", func(t TP) {
+		handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, handlers.NewFixedScaler(2), 5, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(2)))
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(2)))
+	})
+
+	o.Spec("backs off warm workers while launches get lost", func(t TP) {
+		clock := &fakeClock{now: time.Now()}
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, handlers.NewFixedScaler(100), 1, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+		p.SetNow(clock.Now)
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(1)))
+
+		// The first launch is lost. The next one waits a launch window.
+		clock.advance(handlers.LaunchWindow + time.Second)
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(1)))
+		clock.advance(handlers.LaunchWindow)
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(2)))
+
+		// The second is lost too. The next one waits twice as long.
+		clock.advance(handlers.LaunchWindow + time.Second)
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(2)))
+		clock.advance(handlers.LaunchWindow + time.Second)
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(2)))
+		clock.advance(handlers.LaunchWindow)
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(3)))
+	})
+
+	o.Spec("stops backing off once a lost launch arrives", func(t TP) {
+		clock := &fakeClock{now: time.Now()}
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, handlers.NewFixedScaler(100), 1, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+		p.SetNow(clock.Now)
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(1)))
+		token := t.spyTaskCreator.Env()["POOL_TOKEN"]
+
+		clock.advance(handlers.LaunchWindow + time.Second)
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(1)))
+
+		// It is busy, so another warm worker is needed right away.
+		sendHeartbeat(t, p, token, internalapi.Heartbeat{ID: "some-id", InFlight: 1})
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(2)))
+	})
+
+	o.Spec("publishes the queue depth", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go t.p.SubmitWork(ctx, internalapi.Work{Href: "http://some.url/relay-1", AppName: "some-app"})
+		go t.p.SubmitWork(ctx, internalapi.Work{Href: "http://some.url/relay-2", AppName: "other-app"})
+
+		Expect(t, func() float64 {
+			return t.spyMetrics.Gauge("queue_depth")
+		}).To(ViaPolling(Equal(2.0)))
+	})
+
+	o.Spec("returns an error if the work isn't taken", func(t TP) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := t.p.SubmitWork(ctx, internalapi.Work{Href: "http://some.url/relay-1", AppName: "some-app"})
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("holds back work past the handler's max concurrency", func(t TP) {
+		ctx1, cancel1 := context.WithCancel(context.Background())
+		defer cancel1()
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		defer cancel2()
+
+		submitInOrder(t, ctx1, internalapi.Work{Href: "http://some.url/relay-1", AppName: "some-app", Command: "some-command", MaxConcurrency: 1})
+		submitInOrder(t, ctx2,
+			internalapi.Work{Href: "http://some.url/relay-2", AppName: "some-app", Command: "some-command", MaxConcurrency: 1},
+			internalapi.Work{Href: "http://some.url/relay-3", AppName: "some-app", Command: "other-command", MaxConcurrency: 1},
+		)
+
+		poll := func(d time.Duration) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+			Expect(t, err).To(BeNil())
+			req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+			req.Header.Set("X-CF-FAAS-APPS", "some-app")
+			ctx, cancel := context.WithTimeout(context.Background(), d)
+			defer cancel()
+
+			recorder := httptest.NewRecorder()
+			t.p.ServeHTTP(recorder, req.WithContext(ctx))
+			return recorder
+		}
+
+		href := func(recorder *httptest.ResponseRecorder) string {
+			var w internalapi.Work
+			Expect(t, json.Unmarshal(recorder.Body.Bytes(), &w)).To(BeNil())
+			return w.Href
+		}
+
+		Expect(t, href(poll(time.Minute))).To(Equal("http://some.url/relay-1"))
+
+		// Other handlers are not held back.
+		Expect(t, href(poll(time.Minute))).To(Equal("http://some.url/relay-3"))
+		Expect(t, poll(100*time.Millisecond).Code).To(Equal(http.StatusNoContent))
+
+		Expect(t, func() float64 {
+			return t.spyMetrics.Gauge("queue_depth")
+		}).To(ViaPolling(Equal(1.0)))
+
+		// The first request finishing frees up its slot.
+		cancel1()
+		Expect(t, href(poll(time.Minute))).To(Equal("http://some.url/relay-2"))
+	})
+
+	o.Spec("rejects work past the handler's max concurrency", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		w := internalapi.Work{
+			Href:           "http://some.url/relay-1",
+			AppName:        "some-app",
+			Command:        "some-command",
+			MaxConcurrency: 1,
+			RejectExcess:   true,
+		}
+		go t.p.SubmitWork(ctx, w)
+
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+		req.Header.Set("X-CF-FAAS-APPS", "some-app")
+		t.p.ServeHTTP(t.recorder, req)
+		Expect(t, t.recorder.Code).To(Equal(http.StatusOK))
+
+		w.Href = "http://some.url/relay-2"
+		Expect(t, t.p.SubmitWork(ctx, w)).To(Not(BeNil()))
+	})
+
+	o.Spec("doesn't let a flood on one handler starve another", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for i := 0; i < 20; i++ {
+			submitInOrder(t, ctx, internalapi.Work{Href: fmt.Sprintf("http://some.url/flood-%d", i), AppName: "some-app", Command: "flood"})
+		}
+		for i := 0; i < 2; i++ {
+			submitInOrder(t, ctx, internalapi.Work{Href: fmt.Sprintf("http://some.url/other-%d", i), AppName: "some-app", Command: "other"})
+		}
+
+		var hrefs []string
+		for i := 0; i < 4; i++ {
+			hrefs = append(hrefs, takeWork(t, t.p).Href)
+		}
+
+		Expect(t, hrefs).To(Equal([]string{
+			"http://some.url/flood-0",
+			"http://some.url/other-0",
+			"http://some.url/flood-1",
+			"http://some.url/other-1",
+		}))
+	})
+
+	o.Spec("shares the workers in proportion to the handlers' weights", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for i := 0; i < 8; i++ {
+			submitInOrder(t, ctx,
+				internalapi.Work{Href: "http://some.url/heavy", AppName: "some-app", Command: "heavy", Weight: 3},
+				internalapi.Work{Href: "http://some.url/light", AppName: "some-app", Command: "light"},
+			)
+		}
+
+		counts := make(map[string]int)
+		for i := 0; i < 8; i++ {
+			counts[takeWork(t, t.p).Command]++
+		}
+
+		Expect(t, counts["heavy"]).To(Equal(6))
+		Expect(t, counts["light"]).To(Equal(2))
+	})
+
+	o.Spec("hands out higher priority work first", func(t TP) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for i := 0; i < 5; i++ {
+			submitInOrder(t, ctx, internalapi.Work{Href: "http://some.url/flood", AppName: "some-app", Command: "flood", Weight: 100})
+		}
+		submitInOrder(t, ctx, internalapi.Work{Href: "http://some.url/urgent", AppName: "some-app", Command: "urgent", Priority: 1})
+
+		Expect(t, takeWork(t, t.p).Href).To(Equal("http://some.url/urgent"))
+	})
+
+	o.Spec("registers workers that send heartbeats", func(t TP) {
+		token := t.tokens.Sign("/some-pool", time.Minute)
+		hb := internalapi.Heartbeat{
+			ID:          "some-id",
+			AppInstance: "app-instance",
+			Apps:        []string{"some-app"},
+			InFlight:    2,
+			Version:     "some-version",
+		}
+
+		recorder := sendHeartbeat(t, t.p, token, hb)
+		Expect(t, recorder.Code).To(Equal(http.StatusNoContent))
+		next := recorder.Header().Get("X-CF-FAAS-NEXT-TOKEN")
+		Expect(t, next).To(Not(Equal("")))
+
+		ws := t.p.Registry().Workers()
+		Expect(t, ws).To(HaveLen(1))
+		Expect(t, ws[0].Heartbeat).To(Equal(hb))
+		Expect(t, ws[0].Stale).To(BeFalse())
+
+		// Heartbeats are authenticated. A replay gets the same next token.
+		recorder = sendHeartbeat(t, t.p, token, hb)
+		Expect(t, recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(t, recorder.Header().Get("X-CF-FAAS-NEXT-TOKEN")).To(Equal(next))
+		Expect(t, sendHeartbeat(t, t.p, "invalid", hb).Code).To(Equal(http.StatusUnauthorized))
+
+		// The token for work can also be used for the first heartbeat.
+		takeToken := t.tokens.Sign("/some-pool", time.Minute)
+		go t.p.SubmitWork(context.Background(), internalapi.Work{Href: "http://some.url/relay-1", AppName: "some-app"})
+		req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+		Expect(t, err).To(BeNil())
+		req.Header.Set("X-CF-FAAS-TOKEN", takeToken)
+		req.Header.Set("X-CF-FAAS-APPS", "some-app")
+		t.p.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(t, sendHeartbeat(t, t.p, takeToken, hb).Code).To(Equal(http.StatusNoContent))
+	})
+
+	o.Spec("forgets about workers that are exiting", func(t TP) {
+		hb := internalapi.Heartbeat{ID: "some-id"}
+		sendHeartbeat(t, t.p, t.tokens.Sign("/some-pool", time.Minute), hb)
+		Expect(t, t.p.Registry().Workers()).To(HaveLen(1))
+
+		hb.Exiting = true
+		sendHeartbeat(t, t.p, t.tokens.Sign("/some-pool", time.Minute), hb)
+		Expect(t, t.p.Registry().Workers()).To(HaveLen(0))
+	})
+
+	o.Spec("tells the Scaler about the registered workers", func(t TP) {
+		var mu sync.Mutex
+		var last handlers.ScaleState
+		scaler := handlers.ScalerFunc(func(s handlers.ScaleState) int {
+			mu.Lock()
+			defer mu.Unlock()
+			last = s
+			if s.RecentLaunches > 0 || s.Workers > 0 {
+				return 0
+			}
+			return 2
+		})
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, scaler, 0, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go p.SubmitWork(ctx, internalapi.Work{Href: "http://some.url"})
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(2)))
+
+		// This worker is from one of the launched tasks. The other one
+		// isn't from a launch.
+		env := t.spyTaskCreator.Env()
+		sendHeartbeat(t, p, env["POOL_TOKEN"], internalapi.Heartbeat{ID: "some-id", InFlight: 3})
+		sendHeartbeat(t, p, t.tokens.Sign("/some-pool", time.Minute), internalapi.Heartbeat{ID: "other-id"})
+
+		Expect(t, func() handlers.ScaleState {
+			mu.Lock()
+			defer mu.Unlock()
+			s := last
+			s.OldestWait = 0
+			return s
+		}).To(ViaPolling(Equal(handlers.ScaleState{
+			Queued:         1,
+			Overdue:        1,
+			RecentLaunches: 2,
+			Starting:       1,
+			Workers:        2,
+			IdleRegistered: 1,
+			InFlight:       3,
+		})))
+	})
+
+	o.Spec("gives new tasks an idle TTL", func(t TP) {
+		go t.p.SubmitWork(context.Background(), internalapi.Work{
+			Href: "http://some.url/some-relay",
+		})
+		Expect(t, func() string { return t.spyTaskCreator.Env()["IDLE_TTL"] }).To(ViaPolling(Equal("1m0s")))
+	})
+
+	o.Spec("gives new tasks the worker's environment", func(t TP) {
+		go t.p.SubmitWork(context.Background(), internalapi.Work{
+			Href: "http://some.url/some-relay",
+		})
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Not(Equal(0))))
+
+		env := t.spyTaskCreator.Env()
+		Expect(t, env).To(HaveLen(5))
+		Expect(t, env["X_CF_APP_INSTANCE"]).To(Equal("app-instance"))
+		Expect(t, env["APP_NAMES"]).To(Equal("a,b"))
+		Expect(t, env["POOL_ADDR"]).To(Equal("https://some.url/some-pool"))
+		Expect(t, env["IDLE_TTL"]).To(Equal("1m0s"))
+		Expect(t, t.tokens.Redeem("pool", "/some-pool", env["POOL_TOKEN"])).To(BeNil())
+	})
+
 	o.Spec("only spin up 5 tasks at a time", func(t TP) {
 		go t.p.SubmitWork(context.Background(), internalapi.Work{
 			Href:    "http://some.url",
@@ -85,11 +638,62 @@ func TestWorkerPool(t *testing.T) {
 			AppName: "some-app",
 		})
 
-		Expect(t, t.spyTaskCreator.Command).To(ViaPolling(Not(HaveLen(0))))
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Not(Equal(0))))
+	})
+
+	o.Spec("consults the Scaler while work is waiting", func(t TP) {
+		spyScaler := newSpyScaler()
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, spyScaler, 0, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		// Nothing is waiting.
+		time.Sleep(50 * time.Millisecond)
+		Expect(t, spyScaler.States()).To(HaveLen(0))
+
+		go p.SubmitWork(context.Background(), internalapi.Work{Href: "http://some.url"})
+		go p.SubmitWork(context.Background(), internalapi.Work{Href: "http://some.url"})
+
+		Expect(t, func() int {
+			return spyScaler.Last().Overdue
+		}).To(ViaPolling(Equal(2)))
+
+		s := spyScaler.Last()
+		Expect(t, s.Queued).To(Equal(2))
+		Expect(t, s.IdleWorkers).To(Equal(0))
+		Expect(t, s.RecentLaunches).To(Equal(0))
+		Expect(t, float64(s.OldestWait)).To(BeAbove(float64(time.Millisecond)))
+	})
+
+	o.Spec("starts as many tasks as the Scaler says", func(t TP) {
+		var mu sync.Mutex
+		var recentLaunches int
+		scaler := handlers.ScalerFunc(func(s handlers.ScaleState) int {
+			mu.Lock()
+			defer mu.Unlock()
+			recentLaunches = s.RecentLaunches
+			if s.RecentLaunches > 0 {
+				return 0
+			}
+			return 3
+		})
+		p := handlers.NewWorkerPool(context.Background(), "https://some.url/some-pool", nil, "app-instance", time.Millisecond, time.Minute, t.tokens, scaler, 0, time.Minute, t.spyLeaseChecker, t.spyTaskCreator, t.spyMetrics, log.New(ioutil.Discard, "", 0))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go p.SubmitWork(ctx, internalapi.Work{Href: "http://some.url"})
+
+		Expect(t, t.spyTaskCreator.Called).To(ViaPolling(Equal(3)))
+
+		// Launches are remembered.
+		Expect(t, func() int {
+			mu.Lock()
+			defer mu.Unlock()
+			return recentLaunches
+		}).To(ViaPolling(Equal(3)))
+		Expect(t, t.spyTaskCreator.Called).To(Always(Equal(3)))
 	})
 
-	o.Spec("returns a 405 for anything other than a GET", func(t TP) {
-		req, err := http.NewRequest("POST", "http://some.url", nil)
+	o.Spec("returns a 405 for anything other than a GET or POST", func(t TP) {
+		req, err := http.NewRequest("DELETE", "http://some.url", nil)
 		Expect(t, err).To(BeNil())
 
 		t.p.ServeHTTP(t.recorder, req)
@@ -97,31 +701,75 @@ func TestWorkerPool(t *testing.T) {
 	})
 }
 
+// sendHeartbeat sends the heartbeat to the pool like a worker.
+func sendHeartbeat(t TP, p *handlers.WorkerPool, token string, hb internalapi.Heartbeat) *httptest.ResponseRecorder {
+	data, err := json.Marshal(hb)
+	Expect(t, err).To(BeNil())
+
+	req, err := http.NewRequest("POST", "http://some.url/some-pool", bytes.NewReader(data))
+	Expect(t, err).To(BeNil())
+	req.Header.Set("X-CF-FAAS-TOKEN", token)
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// takeWork fetches work from the pool like a worker with a package for
+// some-app.
+// submitInOrder submits the work to the WorkerPool one at a time. It waits
+// for each to be queued (via the queue_depth) before submitting the next.
+func submitInOrder(t TP, ctx context.Context, ws ...internalapi.Work) {
+	for _, w := range ws {
+		depth := t.spyMetrics.Gauge("queue_depth")
+		go t.p.SubmitWork(ctx, w)
+
+		Expect(t, func() float64 {
+			return t.spyMetrics.Gauge("queue_depth")
+		}).To(ViaPolling(Equal(depth + 1)))
+	}
+}
+
+func takeWork(t TP, p *handlers.WorkerPool) internalapi.Work {
+	req, err := http.NewRequest("GET", "http://some.url/some-pool", nil)
+	Expect(t, err).To(BeNil())
+	req.Header.Set("X-CF-FAAS-TOKEN", t.tokens.Sign("/some-pool", time.Minute))
+	req.Header.Set("X-CF-FAAS-APPS", "some-app")
+
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, req)
+	Expect(t, recorder.Code).To(Equal(http.StatusOK))
+
+	var w internalapi.Work
+	Expect(t, json.Unmarshal(recorder.Body.Bytes(), &w)).To(BeNil())
+	return w
+}
+
 type spyTaskCreator struct {
-	mu      sync.Mutex
-	ctx     context.Context
-	command string
-	err     error
-	called  int
+	mu     sync.Mutex
+	ctx    context.Context
+	env    map[string]string
+	err    error
+	called int
 }
 
 func newSpyTaskCreator() *spyTaskCreator {
 	return &spyTaskCreator{}
 }
 
-func (s *spyTaskCreator) RunTask(ctx context.Context, command, name, dropletGuid, appName string) (gocapi.Task, error) {
+func (s *spyTaskCreator) StartWorker(ctx context.Context, env map[string]string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.called++
 	s.ctx = ctx
-	s.command = command
-	return gocapi.Task{}, s.err
+	s.env = env
+	return s.err
 }
 
-func (s *spyTaskCreator) Command() string {
+func (s *spyTaskCreator) Env() map[string]string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.command
+	return s.env
 }
 
 func (s *spyTaskCreator) Called() int {
@@ -130,6 +778,60 @@ func (s *spyTaskCreator) Called() int {
 	return s.called
 }
 
+type spyScaler struct {
+	mu     sync.Mutex
+	states []handlers.ScaleState
+}
+
+func newSpyScaler() *spyScaler {
+	return &spyScaler{}
+}
+
+func (s *spyScaler) Scale(state handlers.ScaleState) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states = append(s.states, state)
+	return 0
+}
+
+func (s *spyScaler) States() []handlers.ScaleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]handlers.ScaleState(nil), s.states...)
+}
+
+func (s *spyScaler) Last() handlers.ScaleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.states) == 0 {
+		return handlers.ScaleState{}
+	}
+	return s.states[len(s.states)-1]
+}
+
+type spyLeaseChecker struct {
+	mu      sync.Mutex
+	hrefs   []string
+	fetched bool
+}
+
+func newSpyLeaseChecker() *spyLeaseChecker {
+	return &spyLeaseChecker{}
+}
+
+func (s *spyLeaseChecker) Fetched(href string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hrefs = append(s.hrefs, href)
+	return s.fetched
+}
+
+func (s *spyLeaseChecker) Hrefs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.hrefs...)
+}
+
 type spyTokenFetcher struct {
 	token string
 	err   error
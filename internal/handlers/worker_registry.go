@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+// WorkerRegistry keeps track of the workers that have registered with a
+// WorkerPool. A worker that hasn't sent a heartbeat within the staleAfter is
+// stale. Stale workers are forgotten after the forgetAfter.
+//
+// It serves the registry as JSON for operators.
+type WorkerRegistry struct {
+	staleAfter  time.Duration
+	forgetAfter time.Duration
+
+	mu      sync.Mutex
+	workers map[string]*WorkerStatus
+}
+
+// WorkerStatus is the last heartbeat from a worker.
+type WorkerStatus struct {
+	internalapi.Heartbeat
+
+	Registered time.Time `json:"registered"`
+	LastSeen   time.Time `json:"last_seen"`
+	Stale      bool      `json:"stale"`
+}
+
+// NewWorkerRegistry returns a new WorkerRegistry.
+func NewWorkerRegistry(staleAfter, forgetAfter time.Duration) *WorkerRegistry {
+	return &WorkerRegistry{
+		staleAfter:  staleAfter,
+		forgetAfter: forgetAfter,
+		workers:     make(map[string]*WorkerStatus),
+	}
+}
+
+// Heartbeat records the heartbeat. It reports whether it registered a new
+// worker.
+func (r *WorkerRegistry) Heartbeat(hb internalapi.Heartbeat) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+
+	if hb.Exiting {
+		delete(r.workers, hb.ID)
+		return false
+	}
+
+	s, ok := r.workers[hb.ID]
+	if !ok {
+		s = &WorkerStatus{Registered: now}
+		r.workers[hb.ID] = s
+	}
+	s.Heartbeat = hb
+	s.LastSeen = now
+
+	return !ok
+}
+
+// Workers returns every worker the registry knows about, sorted by ID.
+func (r *WorkerRegistry) Workers() []WorkerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+
+	ws := make([]WorkerStatus, 0, len(r.workers))
+	for _, s := range r.workers {
+		w := *s
+		w.Stale = now.Sub(s.LastSeen) > r.staleAfter
+		ws = append(ws, w)
+	}
+
+	sort.Slice(ws, func(i, j int) bool {
+		return ws[i].ID < ws[j].ID
+	})
+
+	return ws
+}
+
+// Live returns how many workers aren't stale, how many of them aren't
+// running any work and how much work they are running.
+func (r *WorkerRegistry) Live() (workers, idle, inFlight int) {
+	for _, w := range r.Workers() {
+		if w.Stale {
+			continue
+		}
+
+		workers++
+		inFlight += w.InFlight
+		if w.InFlight == 0 {
+			idle++
+		}
+	}
+
+	return workers, idle, inFlight
+}
+
+func (r *WorkerRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Workers []WorkerStatus `json:"workers"`
+	}{
+		Workers: r.Workers(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// prune forgets about workers that have been stale for too long. It must be
+// called with the lock held.
+func (r *WorkerRegistry) prune(now time.Time) {
+	for id, s := range r.workers {
+		if now.Sub(s.LastSeen) > r.forgetAfter {
+			delete(r.workers, id)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TWR struct {
+	*testing.T
+	r *handlers.WorkerRegistry
+}
+
+func TestWorkerRegistry(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TWR {
+		return TWR{
+			T: t,
+			r: handlers.NewWorkerRegistry(50*time.Millisecond, time.Minute),
+		}
+	})
+
+	o.Spec("it reports whether a worker is new", func(t TWR) {
+		Expect(t, t.r.Heartbeat(internalapi.Heartbeat{ID: "a"})).To(BeTrue())
+		Expect(t, t.r.Heartbeat(internalapi.Heartbeat{ID: "a", InFlight: 1})).To(BeFalse())
+		Expect(t, t.r.Heartbeat(internalapi.Heartbeat{ID: "b"})).To(BeTrue())
+
+		ws := t.r.Workers()
+		Expect(t, ws).To(HaveLen(2))
+		Expect(t, ws[0].ID).To(Equal("a"))
+		Expect(t, ws[0].InFlight).To(Equal(1))
+		Expect(t, ws[1].ID).To(Equal("b"))
+	})
+
+	o.Spec("it marks workers without a recent heartbeat as stale", func(t TWR) {
+		t.r.Heartbeat(internalapi.Heartbeat{ID: "a", InFlight: 2})
+		t.r.Heartbeat(internalapi.Heartbeat{ID: "b"})
+		workers, idle, inFlight := t.r.Live()
+		Expect(t, workers).To(Equal(2))
+		Expect(t, idle).To(Equal(1))
+		Expect(t, inFlight).To(Equal(2))
+
+		Expect(t, func() bool {
+			ws := t.r.Workers()
+			return ws[0].Stale && ws[1].Stale
+		}).To(ViaPolling(BeTrue()))
+
+		workers, idle, inFlight = t.r.Live()
+		Expect(t, workers).To(Equal(0))
+		Expect(t, idle).To(Equal(0))
+		Expect(t, inFlight).To(Equal(0))
+	})
+
+	o.Spec("it forgets about stale workers eventually", func(t TWR) {
+		r := handlers.NewWorkerRegistry(time.Millisecond, 50*time.Millisecond)
+		r.Heartbeat(internalapi.Heartbeat{ID: "a"})
+
+		Expect(t, func() int {
+			return len(r.Workers())
+		}).To(ViaPolling(Equal(0)))
+	})
+
+	o.Spec("it lists the workers", func(t TWR) {
+		t.r.Heartbeat(internalapi.Heartbeat{
+			ID:      "a",
+			Version: "some-version",
+			Metrics: json.RawMessage(`{"poll_retries":2}`),
+		})
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://some.url/_cf_faas/workers", nil)
+		t.r.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var result struct {
+			Workers []struct {
+				ID      string `json:"id"`
+				Version string `json:"version"`
+				Stale   bool   `json:"stale"`
+				Metrics struct {
+					PollRetries int `json:"poll_retries"`
+				} `json:"metrics"`
+			} `json:"workers"`
+		}
+		Expect(t, json.Unmarshal(recorder.Body.Bytes(), &result)).To(BeNil())
+		Expect(t, result.Workers).To(HaveLen(1))
+		Expect(t, result.Workers[0].ID).To(Equal("a"))
+		Expect(t, result.Workers[0].Version).To(Equal("some-version"))
+		Expect(t, result.Workers[0].Stale).To(BeFalse())
+		Expect(t, result.Workers[0].Metrics.PollRetries).To(Equal(2))
+	})
+}
@@ -0,0 +1,30 @@
+package internalapi
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Heartbeat is POSTed by a worker to the worker pool. The first one
+// registers the worker. Each one is authenticated like a request for work
+// (with TokenHeader) and each response includes the token for the next one
+// (with NextTokenHeader).
+type Heartbeat struct {
+	ID          string   `json:"id"`
+	AppInstance string   `json:"app_instance"`
+	Apps        []string `json:"apps"`
+	InFlight    int      `json:"in_flight"`
+	Version     string   `json:"version"`
+
+	// Metrics are the worker's metrics (e.g., how often it had to retry
+	// asking for work).
+	Metrics json.RawMessage `json:"metrics,omitempty"`
+
+	// Exiting is set on the last Heartbeat. The worker pool forgets about
+	// the worker.
+	Exiting bool `json:"exiting,omitempty"`
+}
+
+// HeartbeatInterval is how often a worker sends a Heartbeat. A worker that
+// misses three in a row is considered stale.
+const HeartbeatInterval = 10 * time.Second
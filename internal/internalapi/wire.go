@@ -0,0 +1,144 @@
+package internalapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// MultipartType is the media type of the binary relay encoding. A JSON
+// envelope is followed by a part with the raw body. This avoids base64
+// encoding the body. JSON is used when either side does not support it.
+const MultipartType = "multipart/mixed"
+
+// AcceptsMultipart reports whether the Accept header allows the multipart
+// encoding.
+func AcceptsMultipart(h http.Header) bool {
+	for _, v := range h["Accept"] {
+		for _, t := range strings.Split(v, ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(t))
+			if err == nil && mt == MultipartType {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsMultipart reports whether the Content-Type is the multipart encoding.
+func IsMultipart(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == MultipartType
+}
+
+// MultipartWriter writes the multipart encoding while the body is still
+// being generated.
+type MultipartWriter struct {
+	w *multipart.Writer
+}
+
+// NewMultipartWriter returns a MultipartWriter that writes to w.
+func NewMultipartWriter(w io.Writer) *MultipartWriter {
+	return &MultipartWriter{
+		w: multipart.NewWriter(w),
+	}
+}
+
+// ContentType returns the Content-Type to use. It is known before anything
+// is written.
+func (w *MultipartWriter) ContentType() string {
+	return fmt.Sprintf("%s; boundary=%s", MultipartType, w.w.Boundary())
+}
+
+// WriteEnvelope writes the envelope as JSON and returns the writer for the
+// raw body. The envelope should not include the body.
+func (w *MultipartWriter) WriteEnvelope(envelope interface{}) (io.Writer, error) {
+	pw, err := w.w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"application/json"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.NewEncoder(pw).Encode(envelope); err != nil {
+		return nil, err
+	}
+
+	return w.w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"application/octet-stream"},
+	})
+}
+
+// Close finishes the body. It does not close the underlying writer.
+func (w *MultipartWriter) Close() error {
+	return w.w.Close()
+}
+
+// EncodeMultipart writes the envelope as JSON followed by the raw body. It
+// returns the Content-Type to use. The envelope should not include the body.
+func EncodeMultipart(envelope interface{}, body []byte) (string, []byte, error) {
+	var buf bytes.Buffer
+	w := NewMultipartWriter(&buf)
+
+	pw, err := w.WriteEnvelope(envelope)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := pw.Write(body); err != nil {
+		return "", nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+
+	return w.ContentType(), buf.Bytes(), nil
+}
+
+// Decode reads the envelope and returns the raw body. If the Content-Type is
+// not the multipart encoding, the whole body is decoded as JSON into the
+// envelope and the returned body is nil.
+func Decode(r io.Reader, contentType string, envelope interface{}) ([]byte, error) {
+	body, err := DecodeStream(r, contentType, envelope)
+	if err != nil || body == nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(body)
+}
+
+// DecodeStream is like Decode, however it returns a reader for the raw body
+// instead of reading it. The body is only valid until r is closed.
+func DecodeStream(r io.Reader, contentType string, envelope interface{}) (io.Reader, error) {
+	if !IsMultipart(contentType) {
+		return nil, json.NewDecoder(r).Decode(envelope)
+	}
+
+	_, params, _ := mime.ParseMediaType(contentType)
+	mr := multipart.NewReader(r, params["boundary"])
+
+	p, err := mr.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read envelope: %s", err)
+	}
+
+	if err := json.NewDecoder(p).Decode(envelope); err != nil {
+		return nil, err
+	}
+
+	p, err = mr.NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %s", err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,69 @@
+package internalapi_test
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type envelope struct {
+	Name string `json:"name"`
+	Body []byte `json:"body"`
+}
+
+func TestWire(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it round trips the envelope and raw body", func(t *testing.T) {
+		body := []byte{0, 1, 2, 255}
+		contentType, data, err := internalapi.EncodeMultipart(envelope{Name: "some-name"}, body)
+		Expect(t, err).To(BeNil())
+		Expect(t, internalapi.IsMultipart(contentType)).To(BeTrue())
+		Expect(t, bytes.Contains(data, body)).To(BeTrue())
+
+		var e envelope
+		b, err := internalapi.Decode(bytes.NewReader(data), contentType, &e)
+		Expect(t, err).To(BeNil())
+		Expect(t, e.Name).To(Equal("some-name"))
+		Expect(t, b).To(Equal(body))
+	})
+
+	o.Spec("it falls back to JSON", func(t *testing.T) {
+		var e envelope
+		b, err := internalapi.Decode(strings.NewReader(`{"name":"some-name","body":"AAE="}`), "application/json", &e)
+		Expect(t, err).To(BeNil())
+		Expect(t, b).To(BeNil())
+		Expect(t, e.Name).To(Equal("some-name"))
+		Expect(t, e.Body).To(Equal([]byte{0, 1}))
+
+		_, err = internalapi.Decode(strings.NewReader(`{"name":"some-name"}`), "", &e)
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it returns an error for a truncated multipart body", func(t *testing.T) {
+		contentType, data, err := internalapi.EncodeMultipart(envelope{Name: "some-name"}, []byte("some-body"))
+		Expect(t, err).To(BeNil())
+
+		var e envelope
+		_, err = internalapi.Decode(bytes.NewReader(data[:len(data)/2]), contentType, &e)
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it checks the Accept header", func(t *testing.T) {
+		Expect(t, internalapi.AcceptsMultipart(http.Header{})).To(BeFalse())
+		Expect(t, internalapi.AcceptsMultipart(http.Header{
+			"Accept": []string{"application/json"},
+		})).To(BeFalse())
+		Expect(t, internalapi.AcceptsMultipart(http.Header{
+			"Accept": []string{"multipart/mixed, application/json;q=0.9"},
+		})).To(BeTrue())
+	})
+}
@@ -1,7 +1,87 @@
 package internalapi
 
+import "time"
+
 type Work struct {
-	Href    string `json:"href"`
-	AppName string `json:"app_name"`
-	Command string `json:"command"`
+	Href     string `json:"href"`
+	AppName  string `json:"app_name"`
+	Command  string `json:"command"`
+	Resident bool   `json:"resident,omitempty"`
+
+	// Timeout is how long the caller waits for the function. The worker stops
+	// the command once it passes.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// Stream is set when the function streams its response. The Timeout
+	// only applies until the response is started, so the worker doesn't
+	// stop the command once it passes.
+	Stream bool `json:"stream,omitempty"`
+
+	// MaxConcurrency limits how many copies of the command run at once
+	// across all the workers. Zero is no limit. It is enforced by the worker
+	// pool and isn't sent to workers.
+	MaxConcurrency int `json:"-"`
+
+	// RejectExcess has the worker pool reject work past the MaxConcurrency
+	// instead of queueing it.
+	RejectExcess bool `json:"-"`
+
+	// Priority and Weight decide which work the worker pool hands out
+	// first. Work with a higher Priority always goes first. Otherwise,
+	// handlers share the workers in proportion to their Weight. They aren't
+	// sent to workers.
+	Priority int `json:"-"`
+	Weight   int `json:"-"`
+
+	// RequestID identifies the request the work is for. The worker logs it
+	// when the command fails.
+	RequestID string `json:"request_id,omitempty"`
+
+	// Debug has the worker include the exit code and output of a failed
+	// command in its 500.
+	Debug bool `json:"debug,omitempty"`
+
+	// Limits are the resources the command gets.
+	Limits Limits `json:"limits"`
+
+	// Isolate runs the command in a read-only copy of the package with a
+	// scratch directory of its own (CF_FAAS_SCRATCH_DIR).
+	Isolate bool `json:"isolate,omitempty"`
+
+	// Token authorizes a single GET and POST to the Href. It is set by the
+	// worker pool when the work is handed out.
+	Token string `json:"token,omitempty"`
 }
+
+// Limits are the resources a command gets. Zero is no limit. The worker
+// enforces them.
+type Limits struct {
+	MemoryMB  int           `json:"memory_mb,omitempty"`
+	CPUTime   time.Duration `json:"cpu_time,omitempty"`
+	OpenFiles int           `json:"open_files,omitempty"`
+	Processes int           `json:"processes,omitempty"`
+	OutputKB  int           `json:"output_kb,omitempty"`
+}
+
+// TokenHeader carries the token for the relay or the worker pool.
+const TokenHeader = "X-CF-FAAS-TOKEN"
+
+// NextTokenHeader is set by the worker pool on each response. It is the
+// token for the next request. Using a token again within a minute (e.g.,
+// after the response was lost) gets the same next token. After that, it
+// is rejected.
+const NextTokenHeader = "X-CF-FAAS-NEXT-TOKEN"
+
+// ForwardedHeader is set by a cf-faas instance that forwards a relay request
+// to the instance that owns it. It is set to the forwarding instance's index
+// and prevents forwarding loops.
+const ForwardedHeader = "X-CF-FAAS-FORWARDED"
+
+// KeepWarmHeader is set by the worker pool on a 204 (no work) when it wants
+// the worker to stay around regardless of its idle TTL.
+const KeepWarmHeader = "X-CF-FAAS-KEEP-WARM"
+
+// AppsHeader is set by the worker on each request to the worker pool. It
+// is a comma separated list of the apps it has packages for. The worker is
+// only handed work for those apps.
+const AppsHeader = "X-CF-FAAS-APPS"
@@ -0,0 +1,54 @@
+package local
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// PackageManager serves packages from local directories instead of
+// downloading them from Cloud Foundry. Each app has a directory with its
+// (already extracted) package.
+type PackageManager struct {
+	dirs map[string]string
+}
+
+// NewPackageManager returns a new PackageManager. The dirs are app names to
+// directories.
+func NewPackageManager(dirs map[string]string) *PackageManager {
+	return &PackageManager{
+		dirs: dirs,
+	}
+}
+
+func (m *PackageManager) PackageForApp(appName string) (string, error) {
+	dir, ok := m.dirs[appName]
+	if !ok {
+		return "", errors.New("unknown app")
+	}
+
+	if !isDir(dir) {
+		return "", errors.New("package directory does not exist")
+	}
+
+	return filepath.Abs(dir)
+}
+
+// ReadyApps returns the apps whose directories exist.
+func (m *PackageManager) ReadyApps() []string {
+	var apps []string
+	for appName, dir := range m.dirs {
+		if isDir(dir) {
+			apps = append(apps, appName)
+		}
+	}
+	sort.Strings(apps)
+
+	return apps
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
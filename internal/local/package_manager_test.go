@@ -0,0 +1,72 @@
+package local_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/poy/cf-faas/internal/local"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TPM struct {
+	*testing.T
+	tempDir string
+	m       *local.PackageManager
+}
+
+func TestPackageManager(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TPM {
+		tempDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			panic(err)
+		}
+
+		if err := os.Mkdir(path.Join(tempDir, "a"), os.ModePerm); err != nil {
+			panic(err)
+		}
+
+		return TPM{
+			T:       t,
+			tempDir: tempDir,
+			m: local.NewPackageManager(map[string]string{
+				"a": path.Join(tempDir, "a"),
+				"b": path.Join(tempDir, "b"),
+			}),
+		}
+	})
+
+	o.AfterEach(func(t TPM) {
+		os.RemoveAll(t.tempDir)
+	})
+
+	o.Spec("it returns the directory for the app", func(t TPM) {
+		dir, err := t.m.PackageForApp("a")
+		Expect(t, err).To(BeNil())
+		Expect(t, dir).To(Equal(path.Join(t.tempDir, "a")))
+	})
+
+	o.Spec("it returns an error for an unknown app", func(t TPM) {
+		_, err := t.m.PackageForApp("c")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if the directory does not exist", func(t TPM) {
+		_, err := t.m.PackageForApp("b")
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it only lists the apps whose directories exist", func(t TPM) {
+		Expect(t, t.m.ReadyApps()).To(Equal([]string{"a"}))
+
+		Expect(t, os.Mkdir(path.Join(t.tempDir, "b"), os.ModePerm)).To(BeNil())
+		Expect(t, t.m.ReadyApps()).To(Equal([]string{"a", "b"}))
+	})
+}
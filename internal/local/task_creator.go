@@ -0,0 +1,93 @@
+// Package local runs CF-FaaS without Cloud Foundry. Workers are started as
+// local processes and packages are read from local directories. It is meant
+// for development and integration tests.
+package local
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// TaskCreator starts each worker as a local process instead of a Cloud
+// Foundry task.
+type TaskCreator struct {
+	workerPath string
+	env        map[string]string
+	log        *log.Logger
+
+	mu    sync.Mutex
+	procs map[int]*os.Process
+}
+
+// NewTaskCreator returns a new TaskCreator. The workerPath is the worker
+// binary (cmd/worker). It is given the environment the WorkerPool gives to
+// workers along with the env (e.g., PACKAGE_DIRS). The HTTP_PROXY of
+// cf-faas isn't passed on. Workers reach the relays directly.
+func NewTaskCreator(workerPath string, env map[string]string, log *log.Logger) *TaskCreator {
+	return &TaskCreator{
+		workerPath: workerPath,
+		env:        env,
+		log:        log,
+		procs:      make(map[int]*os.Process),
+	}
+}
+
+// StartWorker starts a worker with the given environment variables. The
+// worker keeps running after the context is done.
+func (c *TaskCreator) StartWorker(ctx context.Context, env map[string]string) error {
+	cmd := exec.Command(c.workerPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(strings.ToUpper(e), "HTTP_PROXY=") {
+			continue
+		}
+		cmd.Env = append(cmd.Env, e)
+	}
+	for _, env := range []map[string]string{env, c.env} {
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	pid := cmd.Process.Pid
+	c.mu.Lock()
+	c.procs[pid] = cmd.Process
+	c.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		c.log.Printf("worker %d exited: %v", pid, err)
+
+		c.mu.Lock()
+		delete(c.procs, pid)
+		c.mu.Unlock()
+	}()
+
+	return nil
+}
+
+// Running returns how many workers are running.
+func (c *TaskCreator) Running() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.procs)
+}
+
+// Stop kills every running worker. Otherwise, they outlive cf-faas.
+func (c *TaskCreator) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.procs {
+		p.Kill()
+	}
+}
@@ -0,0 +1,98 @@
+package local_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/poy/cf-faas/internal/local"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TTC struct {
+	*testing.T
+	tempDir string
+	c       *local.TaskCreator
+}
+
+func TestTaskCreator(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TTC {
+		tempDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			panic(err)
+		}
+
+		// The "worker" writes its environment and waits to be killed.
+		worker := path.Join(tempDir, "worker")
+		script := fmt.Sprintf("#!/bin/bash\nenv > %s.tmp\nmv %s.tmp %s\nexec sleep 60\n",
+			path.Join(tempDir, "env"),
+			path.Join(tempDir, "env"),
+			path.Join(tempDir, "env"),
+		)
+		if err := ioutil.WriteFile(worker, []byte(script), 0755); err != nil {
+			panic(err)
+		}
+
+		return TTC{
+			T:       t,
+			tempDir: tempDir,
+			c: local.NewTaskCreator(
+				worker,
+				map[string]string{"PACKAGE_DIRS": "a:/some/dir"},
+				log.New(ioutil.Discard, "", 0),
+			),
+		}
+	})
+
+	o.AfterEach(func(t TTC) {
+		t.c.Stop()
+		os.RemoveAll(t.tempDir)
+	})
+
+	o.Spec("it starts a worker with the given environment", func(t TTC) {
+		err := t.c.StartWorker(context.Background(), map[string]string{
+			"X_CF_APP_INSTANCE": "app-instance",
+			"APP_NAMES":         "a,b",
+			"POOL_ADDR":         "http://some.url/pool",
+			"POOL_TOKEN":        "some-token",
+			"IDLE_TTL":          "1m0s",
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, t.c.Running()).To(Equal(1))
+
+		env := func() string {
+			data, _ := ioutil.ReadFile(path.Join(t.tempDir, "env"))
+			return string(data)
+		}
+		Expect(t, env).To(ViaPolling(ContainSubstring("POOL_ADDR=http://some.url/pool")))
+
+		lines := strings.Split(env(), "\n")
+		Expect(t, lines).To(Contain("X_CF_APP_INSTANCE=app-instance"))
+		Expect(t, lines).To(Contain("APP_NAMES=a,b"))
+		Expect(t, lines).To(Contain("POOL_TOKEN=some-token"))
+		Expect(t, lines).To(Contain("IDLE_TTL=1m0s"))
+		Expect(t, lines).To(Contain("PACKAGE_DIRS=a:/some/dir"))
+		Expect(t, env()).To(Not(ContainSubstring("HTTP_PROXY=")))
+
+		t.c.Stop()
+		Expect(t, t.c.Running).To(ViaPolling(Equal(0)))
+	})
+
+	o.Spec("it returns an error if the worker can't be started", func(t TTC) {
+		c := local.NewTaskCreator(path.Join(t.tempDir, "missing"), nil, log.New(ioutil.Discard, "", 0))
+		err := c.StartWorker(context.Background(), map[string]string{"POOL_TOKEN": "some-token"})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, c.Running()).To(Equal(0))
+	})
+}
@@ -2,6 +2,7 @@ package manifest
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"time"
@@ -21,18 +22,113 @@ type Function struct {
 }
 
 type Handler struct {
-	Command string `yaml:"command"`
-	AppName string `yaml:"app_name"`
+	Command  string `yaml:"command"`
+	AppName  string `yaml:"app_name"`
+	Resident bool   `yaml:"resident"`
+
+	// MaxConcurrency limits how many copies of the handler run at once
+	// across all the workers. Zero is no limit.
+	MaxConcurrency int `yaml:"max_concurrency"`
+
+	// ConcurrencyPolicy decides what happens to requests past the
+	// MaxConcurrency. They are either queued (the default) or rejected.
+	ConcurrencyPolicy string `yaml:"concurrency_policy"`
+
+	// Priority and Weight decide whose requests get a worker first. A
+	// higher Priority always goes first. Handlers with the same Priority
+	// share the workers in proportion to their Weight. It defaults to 1.
+	Priority int `yaml:"priority"`
+	Weight   int `yaml:"weight"`
+
+	// Debug includes the exit code and output of a failed command in the
+	// body of its 500.
+	Debug bool `yaml:"debug"`
+
+	// Limits are the resources each run of the command gets. They can't be
+	// set for a resident handler.
+	Limits Limits `yaml:"limits"`
+
+	// Isolate runs each run of the command in a read-only copy of the
+	// package with a scratch directory of its own.
+	Isolate bool `yaml:"isolate"`
+}
+
+// Limits are the resources a command gets. Zero is no limit.
+type Limits struct {
+	MemoryMB  int           `yaml:"memory_mb"`
+	CPUTime   time.Duration `yaml:"cpu_time"`
+	OpenFiles int           `yaml:"open_files"`
+	Processes int           `yaml:"processes"`
+
+	// OutputKB limits how much the command writes to stdout and stderr.
+	OutputKB int `yaml:"output_kb"`
+}
+
+const (
+	// QueuePolicy has requests past the MaxConcurrency wait for a copy of
+	// the handler to finish.
+	QueuePolicy = "queue"
+
+	// RejectPolicy answers requests past the MaxConcurrency with a 503.
+	RejectPolicy = "reject"
+)
+
+func (h Handler) validate() error {
+	if h.Command == "" {
+		return errors.New("invalid empty command")
+	}
+
+	if h.MaxConcurrency < 0 {
+		return errors.New("invalid negative max concurrency")
+	}
+
+	if h.Weight < 0 {
+		return errors.New("invalid negative weight")
+	}
+
+	l := h.Limits
+	if l.MemoryMB < 0 || l.CPUTime < 0 || l.OpenFiles < 0 || l.Processes < 0 || l.OutputKB < 0 {
+		return errors.New("invalid negative limit")
+	}
+
+	// A resident process outlives each request, so the limits can't be
+	// enforced for it.
+	if h.Resident && l != (Limits{}) {
+		return errors.New("invalid limits for a resident handler")
+	}
+
+	switch h.ConcurrencyPolicy {
+	case "", QueuePolicy, RejectPolicy:
+	default:
+		return fmt.Errorf("invalid concurrency policy %q", h.ConcurrencyPolicy)
+	}
+
+	return nil
 }
 
 type HTTPEvent struct {
 	Path   string `yaml:"path"`
 	Method string `yaml:"method"`
 	NoAuth bool   `yaml:"no_auth"`
-	Cache  struct {
+
+	// Stream relays the request and response bodies as they are read and
+	// written. It can't be used with Cache.
+	Stream bool `yaml:"stream"`
+
+	// Timeout is how long to wait for the function. It defaults to 10s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	Cache struct {
 		Duration time.Duration `yaml:"duration"`
 		Header   []string      `yaml:"header"`
 	} `yaml:"cache"`
+
+	// Queue limits how many requests wait for a worker and for how long.
+	// Past either, requests are answered with a 503. Zero is no limit.
+	Queue struct {
+		MaxLength int           `yaml:"max_length"`
+		MaxWait   time.Duration `yaml:"max_wait"`
+	} `yaml:"queue"`
 }
 
 type HTTPManifest struct {
@@ -49,8 +145,8 @@ func (m *HTTPManifest) UnmarshalEnv(data string) error {
 	}
 
 	for _, f := range m.Functions {
-		if f.Handler.Command == "" {
-			return errors.New("invalid empty command")
+		if err := f.Handler.validate(); err != nil {
+			return err
 		}
 
 		if len(f.Events) == 0 {
@@ -85,8 +181,8 @@ type HTTPFunction struct {
 }
 
 func (f HTTPFunction) Validate() error {
-	if f.Handler.Command == "" {
-		return errors.New("invalid empty command")
+	if err := f.Handler.validate(); err != nil {
+		return err
 	}
 
 	if len(f.Events) == 0 {
@@ -101,6 +197,18 @@ func (f HTTPFunction) Validate() error {
 		if e.Method == "" {
 			return errors.New("invalid empty method")
 		}
+
+		if e.Stream && e.Cache.Duration > 0 {
+			return errors.New("invalid cache for streamed event")
+		}
+
+		if e.Timeout < 0 {
+			return errors.New("invalid negative timeout")
+		}
+
+		if e.Queue.MaxLength < 0 || e.Queue.MaxWait < 0 {
+			return errors.New("invalid negative queue limit")
+		}
 	}
 
 	return nil
@@ -116,8 +224,8 @@ func (m *Manifest) UnmarshalEnv(data string) error {
 	}
 
 	for _, f := range m.Functions {
-		if f.Handler.Command == "" {
-			return errors.New("invalid empty command")
+		if err := f.Handler.validate(); err != nil {
+			return err
 		}
 
 		if len(f.Events) == 0 {
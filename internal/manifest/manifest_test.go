@@ -285,6 +285,124 @@ func TestHTTPFunctionValidate(t *testing.T) {
 		Expect(t, f.Validate()).To(Not(BeNil()))
 	})
 
+	o.Spec("it returns an error if the timeout is negative", func(t *testing.T) {
+		f := manifest.HTTPFunction{
+			Handler: manifest.Handler{
+				Command: "some-command",
+			},
+			Events: []manifest.HTTPEvent{
+				{
+					Path:    "/v1/path",
+					Method:  "GET",
+					Timeout: -time.Second,
+				},
+			},
+		}
+
+		Expect(t, f.Validate()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for an invalid max concurrency", func(t *testing.T) {
+		f := manifest.HTTPFunction{
+			Handler: manifest.Handler{
+				Command:        "some-command",
+				MaxConcurrency: -1,
+			},
+			Events: []manifest.HTTPEvent{
+				{
+					Path:   "/v1/path",
+					Method: "GET",
+				},
+			},
+		}
+		Expect(t, f.Validate()).To(Not(BeNil()))
+
+		f.Handler.MaxConcurrency = 1
+		f.Handler.ConcurrencyPolicy = "invalid"
+		Expect(t, f.Validate()).To(Not(BeNil()))
+
+		f.Handler.ConcurrencyPolicy = manifest.RejectPolicy
+		Expect(t, f.Validate()).To(BeNil())
+	})
+
+	o.Spec("it returns an error for a negative weight", func(t *testing.T) {
+		f := manifest.HTTPFunction{
+			Handler: manifest.Handler{
+				Command: "some-command",
+				Weight:  -1,
+			},
+			Events: []manifest.HTTPEvent{
+				{
+					Path:   "/v1/path",
+					Method: "GET",
+				},
+			},
+		}
+
+		Expect(t, f.Validate()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for a negative resource limit", func(t *testing.T) {
+		f := manifest.HTTPFunction{
+			Handler: manifest.Handler{
+				Command: "some-command",
+			},
+			Events: []manifest.HTTPEvent{
+				{
+					Path:   "/v1/path",
+					Method: "GET",
+				},
+			},
+		}
+		f.Handler.Limits.CPUTime = -time.Second
+		Expect(t, f.Validate()).To(Not(BeNil()))
+
+		f.Handler.Limits.CPUTime = time.Second
+		f.Handler.Limits.MemoryMB = 128
+		Expect(t, f.Validate()).To(BeNil())
+	})
+
+	o.Spec("it returns an error for limits on a resident handler", func(t *testing.T) {
+		f := manifest.HTTPFunction{
+			Handler: manifest.Handler{
+				Command:  "some-command",
+				Resident: true,
+			},
+			Events: []manifest.HTTPEvent{
+				{
+					Path:   "/v1/path",
+					Method: "GET",
+				},
+			},
+		}
+		Expect(t, f.Validate()).To(BeNil())
+
+		f.Handler.Limits.OutputKB = 64
+		Expect(t, f.Validate()).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error if a queue limit is negative", func(t *testing.T) {
+		e := manifest.HTTPEvent{
+			Path:   "/v1/path",
+			Method: "GET",
+		}
+		e.Queue.MaxWait = -time.Second
+
+		f := manifest.HTTPFunction{
+			Handler: manifest.Handler{
+				Command: "some-command",
+			},
+			Events: []manifest.HTTPEvent{e},
+		}
+
+		Expect(t, f.Validate()).To(Not(BeNil()))
+
+		e.Queue.MaxWait = 0
+		e.Queue.MaxLength = -1
+		f.Events = []manifest.HTTPEvent{e}
+		Expect(t, f.Validate()).To(Not(BeNil()))
+	})
+
 	o.Spec("it returns an error if there aren't any events", func(t *testing.T) {
 		f := manifest.HTTPFunction{
 			Handler: manifest.Handler{
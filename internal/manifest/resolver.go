@@ -49,11 +49,22 @@ func (r *Resolver) Resolve(m Manifest) ([]HTTPFunction, error) {
 
 			ff := faas.ConvertFunction{
 				Handler: faas.ConvertHandler{
-					Command: f.Handler.Command,
-					AppName: f.Handler.AppName,
+					Command:           f.Handler.Command,
+					AppName:           f.Handler.AppName,
+					Resident:          f.Handler.Resident,
+					MaxConcurrency:    f.Handler.MaxConcurrency,
+					ConcurrencyPolicy: f.Handler.ConcurrencyPolicy,
+					Priority:          f.Handler.Priority,
+					Weight:            f.Handler.Weight,
+					Debug:             f.Handler.Debug,
+					Isolate:           f.Handler.Isolate,
 				},
 				Events: make(map[string][]faas.GenericData),
 			}
+			if f.Handler.Limits != (Limits{}) {
+				limits := faas.ConvertLimits(f.Handler.Limits)
+				ff.Handler.Limits = &limits
+			}
 
 			for _, e := range es {
 				ff.Events[eventName] = append(ff.Events[eventName], faas.GenericData(e))
@@ -108,12 +119,18 @@ func (r *Resolver) parseHTTPEvent(f Function, events []GenericData) (HTTPFunctio
 	}
 
 	var he []struct {
-		Path   string `json:"path"`
-		Method string `json:"method"`
-		Cache  struct {
+		Path    string `json:"path"`
+		Method  string `json:"method"`
+		Stream  bool   `json:"stream"`
+		Timeout string `json:"timeout"`
+		Cache   struct {
 			Duration string   `json:"duration"`
 			Header   []string `json:"header"`
 		} `json:"cache"`
+		Queue struct {
+			MaxLength int    `json:"max_length"`
+			MaxWait   string `json:"max_wait"`
+		} `json:"queue"`
 	}
 
 	if err := json.Unmarshal(data, &he); err != nil {
@@ -126,9 +143,21 @@ func (r *Resolver) parseHTTPEvent(f Function, events []GenericData) (HTTPFunctio
 			log.Fatalf("failed to parse HTTPEvent.Cache duration: %s", err)
 		}
 
-		es = append(es, HTTPEvent{
-			Path:   h.Path,
-			Method: h.Method,
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil && h.Timeout != "" {
+			return HTTPFunction{}, fmt.Errorf("failed to parse HTTPEvent.Timeout: %s", err)
+		}
+
+		maxWait, err := time.ParseDuration(h.Queue.MaxWait)
+		if err != nil && h.Queue.MaxWait != "" {
+			return HTTPFunction{}, fmt.Errorf("failed to parse HTTPEvent.Queue.MaxWait: %s", err)
+		}
+
+		e := HTTPEvent{
+			Path:    h.Path,
+			Method:  h.Method,
+			Stream:  h.Stream,
+			Timeout: timeout,
 			Cache: struct {
 				Duration time.Duration `yaml:"duration"`
 				Header   []string      `yaml:"header"`
@@ -136,7 +165,11 @@ func (r *Resolver) parseHTTPEvent(f Function, events []GenericData) (HTTPFunctio
 				Duration: d,
 				Header:   h.Cache.Header,
 			},
-		})
+		}
+		e.Queue.MaxLength = h.Queue.MaxLength
+		e.Queue.MaxWait = maxWait
+
+		es = append(es, e)
 	}
 
 	return HTTPFunction{
@@ -169,17 +202,33 @@ func (r *Resolver) readFunctions(resp *http.Response) ([]HTTPFunction, error) {
 	for _, f := range h.Functions {
 		hf := HTTPFunction{
 			Handler: Handler{
-				Command: f.Handler.Command,
-				AppName: f.Handler.AppName,
+				Command:           f.Handler.Command,
+				AppName:           f.Handler.AppName,
+				Resident:          f.Handler.Resident,
+				MaxConcurrency:    f.Handler.MaxConcurrency,
+				ConcurrencyPolicy: f.Handler.ConcurrencyPolicy,
+				Priority:          f.Handler.Priority,
+				Weight:            f.Handler.Weight,
+				Debug:             f.Handler.Debug,
+				Isolate:           f.Handler.Isolate,
 			},
 		}
+		if f.Handler.Limits != nil {
+			hf.Handler.Limits = Limits(*f.Handler.Limits)
+		}
 
 		for _, e := range f.Events {
-			hf.Events = append(hf.Events, HTTPEvent{
-				Path:   e.Path,
-				Method: e.Method,
-				Cache:  e.Cache,
-			})
+			he := HTTPEvent{
+				Path:    e.Path,
+				Method:  e.Method,
+				Stream:  e.Stream,
+				Timeout: e.Timeout,
+				Cache:   e.Cache,
+			}
+			he.Queue.MaxLength = e.Queue.MaxLength
+			he.Queue.MaxWait = e.Queue.MaxWait
+
+			hf.Events = append(hf.Events, he)
 		}
 
 		results = append(results, hf)
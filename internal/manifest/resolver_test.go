@@ -65,7 +65,64 @@ func TestResolver(t *testing.T) {
 						},
 						"events": [{
 						  "path":"/v1/b1",
-						  "method":"PUT"
+						  "method":"PUT",
+						  "Timeout":2000000000
+					    }]
+					}
+				]
+			}`)),
+		}
+
+		spyDoer.m["POST:http://url.c"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"functions":[
+					{
+						"handler":{
+							"command":"some-command",
+							"limits":{"memory_mb":64,"cpu_time":"30s"}
+						},
+						"events": [{
+						  "path":"/v1/c1",
+						  "method":"GET",
+						  "timeout":"2m",
+						  "queue":{"max_length":100,"max_wait":"5s"}
+					    }]
+					}
+				]
+			}`)),
+		}
+
+		spyDoer.m["POST:http://invalid.cpu.time"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"functions":[
+					{
+						"handler":{
+							"command":"some-command",
+							"limits":{"cpu_time":"invalid"}
+						},
+						"events": [{
+						  "path":"/v1/c1",
+						  "method":"GET"
+					    }]
+					}
+				]
+			}`)),
+		}
+
+		spyDoer.m["POST:http://invalid.timeout"] = &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{
+				"functions":[
+					{
+						"handler":{
+							"command":"some-command"
+						},
+						"events": [{
+						  "path":"/v1/c1",
+						  "method":"GET",
+						  "timeout":"invalid"
 					    }]
 					}
 				]
@@ -112,12 +169,15 @@ func TestResolver(t *testing.T) {
 			T:       t,
 			spyDoer: spyDoer,
 			r: manifest.NewResolver(map[string]string{
-				"other-a":        "http://url.a",
-				"other-b":        "http://url.b",
-				"invalid-url":    "-:-",
-				"invalid-json":   "http://invalid.json",
-				"invalid-event":  "http://invalid.event",
-				"invalid-status": "http://invalid.status",
+				"other-a":          "http://url.a",
+				"other-b":          "http://url.b",
+				"other-c":          "http://url.c",
+				"invalid-url":      "-:-",
+				"invalid-json":     "http://invalid.json",
+				"invalid-event":    "http://invalid.event",
+				"invalid-status":   "http://invalid.status",
+				"invalid-timeout":  "http://invalid.timeout",
+				"invalid-cpu-time": "http://invalid.cpu.time",
 			}, spyDoer),
 		}
 	})
@@ -139,8 +199,9 @@ func TestResolver(t *testing.T) {
 								},
 							},
 							{
-								"path":   "/v1/other-path",
-								"method": "PUT",
+								"path":    "/v1/other-path",
+								"method":  "PUT",
+								"timeout": "2m",
 							},
 						},
 						"other-a": []manifest.GenericData{
@@ -177,8 +238,9 @@ func TestResolver(t *testing.T) {
 						},
 					},
 					{
-						Path:   "/v1/other-path",
-						Method: "PUT",
+						Path:    "/v1/other-path",
+						Method:  "PUT",
+						Timeout: 2 * time.Minute,
 					},
 				},
 			},
@@ -219,14 +281,159 @@ func TestResolver(t *testing.T) {
 				},
 				Events: []manifest.HTTPEvent{
 					{
-						Path:   "/v1/b1",
-						Method: "PUT",
+						Path:    "/v1/b1",
+						Method:  "PUT",
+						Timeout: 2 * time.Second,
 					},
 				},
 			},
 		))
 	})
 
+	o.Spec("it returns an error for an invalid timeout", func(t TR) {
+		_, err := t.r.Resolve(manifest.Manifest{
+			Functions: []manifest.Function{
+				{
+					Handler: manifest.Handler{
+						Command: "some-command",
+					},
+					Events: map[string][]manifest.GenericData{
+						"http": []manifest.GenericData{
+							{
+								"path":    "/v1/path",
+								"method":  "GET",
+								"timeout": "invalid",
+							},
+						},
+					},
+				},
+			},
+		})
+
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it parses the queue limits", func(t TR) {
+		fs, err := t.r.Resolve(manifest.Manifest{
+			Functions: []manifest.Function{
+				{
+					Handler: manifest.Handler{
+						Command: "some-command",
+					},
+					Events: map[string][]manifest.GenericData{
+						"http": []manifest.GenericData{
+							{
+								"path":   "/v1/path",
+								"method": "GET",
+								"queue": map[string]interface{}{
+									"max_length": 10,
+									"max_wait":   "2s",
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, fs).To(HaveLen(1))
+		Expect(t, fs[0].Events[0].Queue.MaxLength).To(Equal(10))
+		Expect(t, fs[0].Events[0].Queue.MaxWait).To(Equal(2 * time.Second))
+	})
+
+	o.Spec("it returns an error for an invalid max queue wait", func(t TR) {
+		_, err := t.r.Resolve(manifest.Manifest{
+			Functions: []manifest.Function{
+				{
+					Handler: manifest.Handler{
+						Command: "some-command",
+					},
+					Events: map[string][]manifest.GenericData{
+						"http": []manifest.GenericData{
+							{
+								"path":   "/v1/path",
+								"method": "GET",
+								"queue": map[string]interface{}{
+									"max_wait": "invalid",
+								},
+							},
+						},
+					},
+				},
+			},
+		})
+
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it parses the timeout and queue limits of resolved events", func(t TR) {
+		fs, err := t.r.Resolve(manifest.Manifest{
+			Functions: []manifest.Function{
+				{
+					Handler: manifest.Handler{
+						Command: "some-command",
+					},
+					Events: map[string][]manifest.GenericData{
+						"other-c": []manifest.GenericData{
+							{
+								"some-key": "some-data",
+							},
+						},
+					},
+				},
+			},
+		})
+		Expect(t, err).To(BeNil())
+		Expect(t, fs).To(HaveLen(1))
+		Expect(t, fs[0].Events[0].Timeout).To(Equal(2 * time.Minute))
+		Expect(t, fs[0].Events[0].Queue.MaxLength).To(Equal(100))
+		Expect(t, fs[0].Events[0].Queue.MaxWait).To(Equal(5 * time.Second))
+		Expect(t, fs[0].Handler.Limits.MemoryMB).To(Equal(64))
+		Expect(t, fs[0].Handler.Limits.CPUTime).To(Equal(30 * time.Second))
+	})
+
+	o.Spec("it returns an error for an invalid CPU time from a resolver", func(t TR) {
+		_, err := t.r.Resolve(manifest.Manifest{
+			Functions: []manifest.Function{
+				{
+					Handler: manifest.Handler{
+						Command: "some-command",
+					},
+					Events: map[string][]manifest.GenericData{
+						"invalid-cpu-time": []manifest.GenericData{
+							{
+								"some-key": "some-data",
+							},
+						},
+					},
+				},
+			},
+		})
+
+		Expect(t, err).To(Not(BeNil()))
+	})
+
+	o.Spec("it returns an error for an invalid timeout from a resolver", func(t TR) {
+		_, err := t.r.Resolve(manifest.Manifest{
+			Functions: []manifest.Function{
+				{
+					Handler: manifest.Handler{
+						Command: "some-command",
+					},
+					Events: map[string][]manifest.GenericData{
+						"invalid-timeout": []manifest.GenericData{
+							{
+								"some-key": "some-data",
+							},
+						},
+					},
+				},
+			},
+		})
+
+		Expect(t, err).To(Not(BeNil()))
+	})
+
 	o.Spec("it sends the function to the URL", func(t TR) {
 		_, err := t.r.Resolve(manifest.Manifest{
 			Functions: []manifest.Function{
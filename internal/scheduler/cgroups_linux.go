@@ -0,0 +1,200 @@
+package scheduler
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroups creates a cgroup (v2) for each command with memory or process
+// limits. They are children of the worker's cgroup. The worker moves itself
+// into a child (worker) so the controllers can be enabled for the others.
+type cgroups struct {
+	dir string
+	n   int64
+}
+
+func newCgroups() (*cgroups, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return nil, err
+	}
+
+	var path string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			path = strings.TrimPrefix(line, "0::")
+		}
+	}
+	if path == "" {
+		return nil, errors.New("cgroup v2 is not in use")
+	}
+	dir := filepath.Join(cgroupRoot, path)
+
+	controllers, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range []string{"memory", "pids"} {
+		if !hasField(controllers, c) {
+			return nil, fmt.Errorf("the %s controller is unavailable", c)
+		}
+	}
+
+	// A cgroup with processes can't enable controllers for its children.
+	// That also fails if there are other processes in it. The worker is
+	// moved back then, so it isn't left in a cgroup of its own.
+	workerDir := filepath.Join(dir, "worker")
+	if err := os.Mkdir(workerDir, 0755); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	pid := strconv.Itoa(os.Getpid())
+	if err := writeFile(filepath.Join(workerDir, "cgroup.procs"), pid); err != nil {
+		os.Remove(workerDir)
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(dir, "cgroup.subtree_control"), "+memory +pids"); err != nil {
+		if moveErr := writeFile(filepath.Join(dir, "cgroup.procs"), pid); moveErr != nil {
+			return nil, fmt.Errorf("%s (and moving the worker back failed: %s)", err, moveErr)
+		}
+		os.Remove(workerDir)
+		return nil, err
+	}
+
+	return &cgroups{
+		dir: dir,
+	}, nil
+}
+
+func (c *cgroups) create(limits internalapi.Limits) (*cgroup, error) {
+	dir := filepath.Join(c.dir, fmt.Sprintf("faas-%d", atomic.AddInt64(&c.n, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	cg := &cgroup{dir: dir}
+
+	if limits.MemoryMB > 0 {
+		if err := writeFile(filepath.Join(dir, "memory.max"), strconv.Itoa(limits.MemoryMB*1024*1024)); err != nil {
+			os.Remove(dir)
+			return nil, err
+		}
+
+		// Swap would get around the limit. Not every kernel has it.
+		writeFile(filepath.Join(dir, "memory.swap.max"), "0")
+	}
+
+	if limits.Processes > 0 {
+		if err := writeFile(filepath.Join(dir, "pids.max"), strconv.Itoa(limits.Processes)); err != nil {
+			os.Remove(dir)
+			return nil, err
+		}
+	}
+
+	return cg, nil
+}
+
+// cgroup is the cgroup for a single command.
+type cgroup struct {
+	dir string
+}
+
+func (c *cgroup) procsFile() string {
+	return filepath.Join(c.dir, "cgroup.procs")
+}
+
+// exceeded returns the limit the command ran into, if any.
+func (c *cgroup) exceeded() string {
+	if readEvent(filepath.Join(c.dir, "memory.events"), "oom_kill") > 0 {
+		return MemoryLimit
+	}
+
+	if readEvent(filepath.Join(c.dir, "pids.events"), "max") > 0 {
+		return ProcessesLimit
+	}
+
+	return ""
+}
+
+// cpuUsage returns how much CPU time the processes in the cgroup have used
+// between them.
+func (c *cgroup) cpuUsage() time.Duration {
+	return time.Duration(readEvent(filepath.Join(c.dir, "cpu.stat"), "usage_usec")) * time.Microsecond
+}
+
+// kill stops every process in the cgroup.
+func (c *cgroup) kill() {
+	// Not every kernel has cgroup.kill.
+	if writeFile(filepath.Join(c.dir, "cgroup.kill"), "1") == nil {
+		return
+	}
+
+	data, err := ioutil.ReadFile(c.procsFile())
+	if err != nil {
+		return
+	}
+	for _, f := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
+
+// remove kills anything the command left behind and removes the cgroup.
+func (c *cgroup) remove(log *log.Logger) {
+	c.kill()
+
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(c.dir); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Printf("failed to remove cgroup %s: %s", c.dir, err)
+}
+
+// readEvent returns the value for the key in a cgroup events (or stat) file.
+func readEvent(path, key string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+
+	return 0
+}
+
+func hasField(data []byte, field string) bool {
+	for _, f := range strings.Fields(string(data)) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func writeFile(path, data string) error {
+	return ioutil.WriteFile(path, []byte(data), 0644)
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+// +build !linux
+
+package scheduler
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+// cgroups are only on Linux. Limits fall back to rlimits.
+type cgroups struct{}
+
+func newCgroups() (*cgroups, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+func (c *cgroups) create(limits internalapi.Limits) (*cgroup, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
+
+type cgroup struct{}
+
+func (c *cgroup) procsFile() string {
+	return ""
+}
+
+func (c *cgroup) exceeded() string {
+	return ""
+}
+
+func (c *cgroup) cpuUsage() time.Duration {
+	return 0
+}
+
+func (c *cgroup) kill() {}
+
+func (c *cgroup) remove(log *log.Logger) {}
@@ -0,0 +1,342 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+// LimitedExecutor is an Executor that can enforce resource limits. The
+// Runner uses it for work with limits.
+type LimitedExecutor interface {
+	ExecuteWithLimits(ctx context.Context, cwd string, envs map[string]string, command string, limits internalapi.Limits) error
+}
+
+// The limits an ExitError reports as exceeded.
+const (
+	MemoryLimit    = "memory"
+	CPUTimeLimit   = "cpu_time"
+	ProcessesLimit = "processes"
+	OutputLimit    = "output"
+)
+
+// outputTail is how much of each of a command's stdout and stderr is kept
+// to report why it failed.
+const outputTail = 8 * 1024
+
+// waitDelay is how long to wait for the output of a command after it has
+// exited or been stopped. Processes it started in the background (or
+// outside of its process group) could otherwise hold on to the output and
+// keep the command from returning.
+const waitDelay = time.Second
+
+// CommandExecutor runs commands with bash. The output is written to stdout
+// and stderr. If the command fails, it returns an ExitError.
+//
+// Memory, process and CPU time limits are enforced with a cgroup (v2) when
+// the worker can create them. Otherwise, they fall back to rlimits (which
+// are per process, and per user for processes). The CPU time is also an
+// rlimit for each process either way. The open files limit is always an
+// rlimit. The output limit is enforced by stopping the command.
+//
+// Each command runs in a process group of its own. Stopping the command
+// (e.g., because the context is done) kills the whole group, and everything
+// in its cgroup.
+type CommandExecutor struct {
+	stdout  io.Writer
+	stderr  io.Writer
+	cgroups *cgroups
+	log     *log.Logger
+}
+
+// NewCommandExecutor returns a new CommandExecutor.
+func NewCommandExecutor(stdout, stderr io.Writer, log *log.Logger) *CommandExecutor {
+	cg, err := newCgroups()
+	if err != nil {
+		log.Printf("cgroups are unavailable, using rlimits: %s", err)
+	}
+
+	return &CommandExecutor{
+		stdout:  stdout,
+		stderr:  stderr,
+		cgroups: cg,
+		log:     log,
+	}
+}
+
+func (e *CommandExecutor) Execute(ctx context.Context, cwd string, envs map[string]string, command string) error {
+	return e.ExecuteWithLimits(ctx, cwd, envs, command, internalapi.Limits{})
+}
+
+func (e *CommandExecutor) ExecuteWithLimits(ctx context.Context, cwd string, envs map[string]string, command string, limits internalapi.Limits) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var cg *cgroup
+	if e.cgroups != nil && (limits.MemoryMB > 0 || limits.Processes > 0 || limits.CPUTime > 0) {
+		var err error
+		cg, err = e.cgroups.create(limits)
+		if err != nil {
+			e.log.Printf("failed to create cgroup, using rlimits: %s", err)
+		}
+	}
+	if cg != nil {
+		defer cg.remove(e.log)
+	}
+
+	stdout := NewTailBuffer(outputTail)
+	stderr := NewTailBuffer(outputTail)
+	output := newOutputBudget(limits.OutputKB*1024, cancel)
+
+	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", prelude(limits, cg)+command)
+	cmd.Dir = cwd
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		// Processes can leave the process group, but not the cgroup.
+		if cg != nil {
+			cg.kill()
+		}
+		return killGroup(cmd.Process)
+	}
+	cmd.WaitDelay = waitDelay
+	cmd.Stdout = output.writer(io.MultiWriter(e.stdout, stdout))
+	cmd.Stderr = output.writer(io.MultiWriter(e.stderr, stderr))
+	for k, v := range envs {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if err := cmd.Start(); err != nil {
+		return &ExitError{Err: err, ExitCode: -1}
+	}
+
+	var cpu *cpuWatch
+	if cg != nil && limits.CPUTime > 0 {
+		cpu = watchCPU(cg, limits.CPUTime)
+	}
+
+	err := cmd.Wait()
+	cpu.stop()
+
+	// The command succeeded, it only left something behind that held on to
+	// its output.
+	if err == nil || (errors.Is(err, exec.ErrWaitDelay) && ctx.Err() == nil) {
+		return nil
+	}
+
+	exitErr := &ExitError{
+		Err:      err,
+		ExitCode: -1,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}
+	if ee, ok := err.(*exec.ExitError); ok {
+		exitErr.ExitCode = ee.ExitCode()
+	}
+
+	var cgLimit string
+	if cg != nil {
+		cgLimit = cg.exceeded()
+	}
+
+	switch {
+	case output.exceeded():
+		exitErr.Limit = OutputLimit
+	case cgLimit != "":
+		exitErr.Limit = cgLimit
+	case cpu.exceeded():
+		exitErr.Limit = CPUTimeLimit
+	case limits.CPUTime > 0 && ctx.Err() == nil && killedAtCPUTime(cmd.ProcessState):
+		exitErr.Limit = CPUTimeLimit
+	}
+
+	return exitErr
+}
+
+// prelude is run by bash before the command. It moves bash into the cgroup
+// (so every process the command starts is in it) and sets the rlimits.
+func prelude(limits internalapi.Limits, cg *cgroup) string {
+	var b strings.Builder
+	if cg != nil {
+		fmt.Fprintf(&b, "echo $$ > %q || exit 1\n", cg.procsFile())
+	}
+
+	var opts []string
+	if limits.CPUTime > 0 {
+		opts = append(opts, fmt.Sprintf("-t %d", cpuSeconds(limits.CPUTime)))
+	}
+	if limits.OpenFiles > 0 {
+		opts = append(opts, fmt.Sprintf("-n %d", limits.OpenFiles))
+	}
+	if cg == nil && limits.MemoryMB > 0 {
+		opts = append(opts, fmt.Sprintf("-v %d", limits.MemoryMB*1024))
+	}
+	if cg == nil && limits.Processes > 0 {
+		opts = append(opts, fmt.Sprintf("-u %d", limits.Processes))
+	}
+	if len(opts) > 0 {
+		fmt.Fprintf(&b, "ulimit %s || exit 1\n", strings.Join(opts, " "))
+	}
+
+	return b.String()
+}
+
+// killGroup kills the process group the process leads.
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// cpuSeconds rounds the CPU time up to seconds. That is what rlimits use.
+func cpuSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// killedAtCPUTime reports whether bash, or the last process it ran, was
+// stopped by the CPU time rlimit. As the soft and hard limits are the same,
+// that is a SIGKILL (or a SIGXCPU). A process that isn't the last one
+// doesn't fail the command, so it is only caught by a cgroup.
+func killedAtCPUTime(state *os.ProcessState) bool {
+	if state == nil {
+		return false
+	}
+
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
+	}
+
+	if ws.Signaled() {
+		return ws.Signal() == syscall.SIGKILL || ws.Signal() == syscall.SIGXCPU
+	}
+
+	// bash exits with 128 plus the signal of the last process.
+	code := ws.ExitStatus()
+	return code == 128+int(syscall.SIGKILL) || code == 128+int(syscall.SIGXCPU)
+}
+
+// cpuPollInterval is how often a cpuWatch checks the CPU time.
+const cpuPollInterval = 50 * time.Millisecond
+
+// cpuWatch stops a command once the processes in its cgroup have used up
+// the CPU time between them. A nil cpuWatch doesn't watch anything.
+type cpuWatch struct {
+	done chan struct{}
+	over int32
+}
+
+func watchCPU(cg *cgroup, limit time.Duration) *cpuWatch {
+	w := &cpuWatch{
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(cpuPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if cg.cpuUsage() >= limit {
+					atomic.StoreInt32(&w.over, 1)
+					cg.kill()
+					return
+				}
+			case <-w.done:
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+func (w *cpuWatch) stop() {
+	if w != nil {
+		close(w.done)
+	}
+}
+
+func (w *cpuWatch) exceeded() bool {
+	return w != nil && atomic.LoadInt32(&w.over) == 1
+}
+
+// outputBudget limits how much a command writes across its stdout and
+// stderr. Once it is used up, the command is stopped. A size of 0 is no
+// limit.
+type outputBudget struct {
+	stop func()
+
+	mu        sync.Mutex
+	remaining int
+	limited   bool
+	over      bool
+}
+
+func newOutputBudget(size int, stop func()) *outputBudget {
+	return &outputBudget{
+		stop:      stop,
+		remaining: size,
+		limited:   size > 0,
+	}
+}
+
+func (b *outputBudget) writer(w io.Writer) io.Writer {
+	if !b.limited {
+		return w
+	}
+
+	return budgetWriter{w: w, b: b}
+}
+
+// take returns how much of n bytes may be written.
+func (b *outputBudget) take(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n <= b.remaining {
+		b.remaining -= n
+		return n
+	}
+
+	allowed := b.remaining
+	b.remaining = 0
+	if !b.over {
+		b.over = true
+		b.stop()
+	}
+	return allowed
+}
+
+func (b *outputBudget) exceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.over
+}
+
+type budgetWriter struct {
+	w io.Writer
+	b *outputBudget
+}
+
+// Write drops whatever is past the budget. It doesn't return an error so
+// the command isn't stopped by a broken pipe before it is killed.
+func (w budgetWriter) Write(p []byte) (int, error) {
+	n := w.b.take(len(p))
+	if n > 0 {
+		if _, err := w.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
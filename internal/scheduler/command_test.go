@@ -0,0 +1,149 @@
+package scheduler_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/cf-faas/internal/scheduler"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TC struct {
+	*testing.T
+	e *scheduler.CommandExecutor
+}
+
+func TestCommandExecutor(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TC {
+		return TC{
+			T: t,
+			e: scheduler.NewCommandExecutor(ioutil.Discard, ioutil.Discard, log.New(ioutil.Discard, "", 0)),
+		}
+	})
+
+	o.Spec("it runs the command in the directory with the envs", func(t TC) {
+		err := t.e.Execute(context.Background(), "/", map[string]string{"A": "b"}, `[ "$PWD" = / ] && [ "$A" = b ]`)
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it reports the exit code and output of a failed command", func(t TC) {
+		err := t.e.Execute(context.Background(), "/", nil, "echo some-stdout; echo some-stderr >&2; exit 3")
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.ExitCode).To(Equal(3))
+		Expect(t, exitErr.Stdout).To(Equal("some-stdout\n"))
+		Expect(t, exitErr.Stderr).To(Equal("some-stderr\n"))
+		Expect(t, exitErr.Limit).To(Equal(""))
+	})
+
+	o.Spec("it sets the rlimits", func(t TC) {
+		err := t.e.ExecuteWithLimits(context.Background(), "/", nil, "ulimit -n -t; exit 1", internalapi.Limits{
+			OpenFiles: 64,
+			CPUTime:   1500 * time.Millisecond,
+		})
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.Stdout).To(ContainSubstring("64\n"))
+		Expect(t, exitErr.Stdout).To(ContainSubstring("2\n"))
+	})
+
+	// The kernel stops a process at its CPU time rlimit with a SIGKILL (or a
+	// SIGXCPU). The processes send it themselves so the specs don't depend on
+	// how much CPU they get.
+	o.Spec("it reports a command that was stopped at its CPU time", func(t TC) {
+		err := t.e.ExecuteWithLimits(context.Background(), "/", nil, "kill -XCPU $$", internalapi.Limits{
+			CPUTime: time.Second,
+		})
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.Limit).To(Equal(scheduler.CPUTimeLimit))
+	})
+
+	o.Spec("it reports a last process that was stopped at its CPU time", func(t TC) {
+		command := "echo some-output\n/bin/bash -c 'kill -KILL $$'"
+		err := t.e.ExecuteWithLimits(context.Background(), "/", nil, command, internalapi.Limits{
+			CPUTime: time.Second,
+		})
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.Limit).To(Equal(scheduler.CPUTimeLimit))
+		Expect(t, exitErr.Stdout).To(Equal("some-output\n"))
+	})
+
+	o.Spec("it does not report the CPU time for a command that exits", func(t TC) {
+		err := t.e.ExecuteWithLimits(context.Background(), "/", nil, "true", internalapi.Limits{
+			CPUTime: time.Second,
+		})
+		Expect(t, err).To(BeNil())
+
+		err = t.e.ExecuteWithLimits(context.Background(), "/", nil, "exit 1", internalapi.Limits{
+			CPUTime: time.Second,
+		})
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.Limit).To(Equal(""))
+	})
+
+	o.Spec("it does not report the CPU time for a canceled command", func(t TC) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err := t.e.ExecuteWithLimits(ctx, "/", nil, "sleep 10", internalapi.Limits{
+			CPUTime: time.Second,
+		})
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.Limit).To(Equal(""))
+	})
+
+	o.Spec("it stops the processes a command started when the context is done", func(t TC) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := t.e.Execute(ctx, "/", nil, "sleep 10; echo some-output")
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, time.Since(start).Seconds()).To(BeBelow(2.0))
+	})
+
+	o.Spec("it stops the processes a command with limits started when the context is done", func(t TC) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		err := t.e.ExecuteWithLimits(ctx, "/", nil, "sleep 10; echo some-output", internalapi.Limits{
+			MemoryMB:  64,
+			Processes: 16,
+		})
+		Expect(t, err).To(Not(BeNil()))
+		Expect(t, time.Since(start).Seconds()).To(BeBelow(2.0))
+	})
+
+	o.Spec("it doesn't wait for a background process that holds on to the output", func(t TC) {
+		start := time.Now()
+		err := t.e.Execute(context.Background(), "/", nil, "sleep 10 &")
+		Expect(t, err).To(BeNil())
+		Expect(t, time.Since(start).Seconds()).To(BeBelow(5.0))
+	})
+
+	o.Spec("it stops a command that writes too much", func(t TC) {
+		err := t.e.ExecuteWithLimits(context.Background(), "/", nil, "while true; do echo some-output; done", internalapi.Limits{
+			OutputKB: 1,
+		})
+		exitErr, ok := err.(*scheduler.ExitError)
+		Expect(t, ok).To(BeTrue())
+		Expect(t, exitErr.Limit).To(Equal(scheduler.OutputLimit))
+		Expect(t, len(exitErr.Stdout)).To(BeBelow(1025))
+		Expect(t, exitErr.Stdout).To(StartWith("some-output\n"))
+	})
+}
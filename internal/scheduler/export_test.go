@@ -0,0 +1,18 @@
+package scheduler
+
+// NewScratch is exported for tests.
+func NewScratch(parent, packageDir string) (*scratch, error) {
+	return newScratch(parent, packageDir)
+}
+
+func (s *scratch) PackageDir() string {
+	return s.packageDir()
+}
+
+func (s *scratch) Dir() string {
+	return s.dir()
+}
+
+func (s *scratch) Remove() error {
+	return s.remove()
+}
@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+// InFlight is a WorkSubmitter that counts the work that is running.
+type InFlight struct {
+	s WorkSubmitter
+	n int64
+}
+
+// NewInFlight returns a new InFlight that submits the work to s.
+func NewInFlight(s WorkSubmitter) *InFlight {
+	return &InFlight{
+		s: s,
+	}
+}
+
+func (f *InFlight) Submit(work internalapi.Work) {
+	atomic.AddInt64(&f.n, 1)
+	defer atomic.AddInt64(&f.n, -1)
+	f.s.Submit(work)
+}
+
+// Count returns how much work is running.
+func (f *InFlight) Count() int {
+	return int(atomic.LoadInt64(&f.n))
+}
+
+// Heartbeat registers the worker with the WorkerPool and then sends the
+// status every interval until the context is done. It then sends a final
+// heartbeat so the WorkerPool forgets about the worker. The latest token
+// from the TokenSource authenticates the first request and each response
+// includes the token for the next one. Those are shared with the
+// TokenSource (for Run).
+func Heartbeat(
+	ctx context.Context,
+	addr string,
+	appInstance string,
+	tokens *TokenSource,
+	interval time.Duration,
+	status func() internalapi.Heartbeat,
+	d Doer,
+	log *log.Logger,
+) {
+	token := tokens.Token()
+
+	send := func(ctx context.Context, hb internalapi.Heartbeat) bool {
+		data, err := json.Marshal(hb)
+		if err != nil {
+			log.Panicf("failed to marshal heartbeat: %s", err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, addr, bytes.NewReader(data))
+		if err != nil {
+			log.Fatalf("failed to create request for %s: %s", addr, err)
+		}
+		req.Header.Set("X-CF-APP-INSTANCE", appInstance)
+		req.Header.Set(internalapi.TokenHeader, token)
+
+		ctx, cancel := context.WithTimeout(ctx, interval)
+		defer cancel()
+
+		resp, err := d.Do(req.WithContext(ctx))
+		if err != nil {
+			// The WorkerPool takes the token again (for a while) if it
+			// was the response that got lost. Try again next time.
+			log.Printf("failed to send heartbeat: %s", err)
+			return true
+		}
+		defer func() {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+
+		if next := resp.Header.Get(internalapi.NextTokenHeader); next != "" {
+			token = next
+			tokens.Set(next)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent:
+			return true
+		case http.StatusUnauthorized:
+			log.Printf("heartbeat was rejected, giving up on heartbeats")
+			return false
+		default:
+			log.Printf("heartbeat got unexpected status code %d", resp.StatusCode)
+			return true
+		}
+	}
+
+	if !send(ctx, status()) {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !send(ctx, status()) {
+				return
+			}
+		case <-ctx.Done():
+			hb := status()
+			hb.Exiting = true
+			send(context.Background(), hb)
+			return
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package scheduler_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/cf-faas/internal/scheduler"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TH struct {
+	*testing.T
+	spyDoer *spyHeartbeatDoer
+	tokens  *scheduler.TokenSource
+}
+
+func TestHeartbeat(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TH {
+		return TH{
+			T:       t,
+			spyDoer: newSpyHeartbeatDoer(http.StatusNoContent),
+			tokens:  scheduler.NewTokenSource("some-token"),
+		}
+	})
+
+	start := func(t TH, ctx context.Context) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			scheduler.Heartbeat(
+				ctx,
+				"http://some.url",
+				"app-instance",
+				t.tokens,
+				10*time.Millisecond,
+				func() internalapi.Heartbeat {
+					return internalapi.Heartbeat{
+						ID:       "some-id",
+						Apps:     []string{"a"},
+						InFlight: 2,
+						Version:  "some-version",
+					}
+				},
+				t.spyDoer,
+				log.New(ioutil.Discard, "", 0),
+			)
+		}()
+		return done
+	}
+
+	o.Spec("it registers and keeps sending heartbeats", func(t TH) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		start(t, ctx)
+
+		Expect(t, t.spyDoer.Count).To(ViaPolling(BeAbove(2)))
+
+		reqs, hbs := t.spyDoer.Requests()
+		Expect(t, reqs[0].Method).To(Equal(http.MethodPost))
+		Expect(t, reqs[0].URL.String()).To(Equal("http://some.url"))
+		Expect(t, reqs[0].Header.Get("X-CF-APP-INSTANCE")).To(Equal("app-instance"))
+		Expect(t, reqs[0].Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
+		Expect(t, hbs[0].ID).To(Equal("some-id"))
+		Expect(t, hbs[0].InFlight).To(Equal(2))
+		Expect(t, hbs[0].Exiting).To(BeFalse())
+
+		// Each heartbeat uses the token from the last response.
+		Expect(t, reqs[1].Header.Get("X-CF-FAAS-TOKEN")).To(Equal("token-1"))
+	})
+
+	o.Spec("it shares the tokens it gets", func(t TH) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		start(t, ctx)
+
+		Expect(t, t.tokens.Token).To(ViaPolling(StartWith("token-")))
+	})
+
+	o.Spec("it says goodbye once the context is done", func(t TH) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := start(t, ctx)
+		Expect(t, t.spyDoer.Count).To(ViaPolling(BeAbove(0)))
+
+		cancel()
+		Expect(t, func() bool {
+			select {
+			case <-done:
+				return true
+			default:
+				return false
+			}
+		}).To(ViaPolling(BeTrue()))
+
+		_, hbs := t.spyDoer.Requests()
+		Expect(t, hbs[len(hbs)-1].Exiting).To(BeTrue())
+	})
+
+	o.Spec("it gives up once a heartbeat is rejected", func(t TH) {
+		t.spyDoer.status = http.StatusUnauthorized
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done := start(t, ctx)
+
+		Expect(t, func() bool {
+			select {
+			case <-done:
+				return true
+			default:
+				return false
+			}
+		}).To(ViaPolling(BeTrue()))
+		Expect(t, t.spyDoer.Count()).To(Equal(1))
+	})
+
+	o.Spec("it counts the work in flight", func(t TH) {
+		spyWorkSubmitter := newSpyWorkSubmitter()
+		spyWorkSubmitter.block = make(chan struct{})
+		f := scheduler.NewInFlight(spyWorkSubmitter)
+
+		go f.Submit(internalapi.Work{Href: "http://some.work"})
+		Expect(t, f.Count).To(ViaPolling(Equal(1)))
+
+		close(spyWorkSubmitter.block)
+		Expect(t, f.Count).To(ViaPolling(Equal(0)))
+	})
+}
+
+type spyHeartbeatDoer struct {
+	status int
+
+	mu   sync.Mutex
+	reqs []*http.Request
+	hbs  []internalapi.Heartbeat
+}
+
+func newSpyHeartbeatDoer(status int) *spyHeartbeatDoer {
+	return &spyHeartbeatDoer{
+		status: status,
+	}
+}
+
+func (s *spyHeartbeatDoer) Do(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hb internalapi.Heartbeat
+	if err := json.NewDecoder(req.Body).Decode(&hb); err != nil {
+		panic(err)
+	}
+	s.reqs = append(s.reqs, req)
+	s.hbs = append(s.hbs, hb)
+
+	return &http.Response{
+		StatusCode: s.status,
+		Header:     http.Header{"X-Cf-Faas-Next-Token": []string{fmt.Sprintf("token-%d", len(s.reqs))}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+func (s *spyHeartbeatDoer) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.reqs)
+}
+
+func (s *spyHeartbeatDoer) Requests() ([]*http.Request, []internalapi.Heartbeat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reqs, s.hbs
+}
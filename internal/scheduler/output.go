@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ExitError is returned by an Executor when the command fails. It has the
+// end of what the command wrote so the Runner can report why.
+type ExitError struct {
+	Err error
+
+	// ExitCode is -1 if the command didn't exit on its own (e.g., it was
+	// killed).
+	ExitCode int
+
+	Stdout string
+	Stderr string
+
+	// Limit is the resource limit the command ran into (e.g.,
+	// MemoryLimit), if any.
+	Limit string
+}
+
+func (e *ExitError) Error() string {
+	if e.Limit != "" {
+		return fmt.Sprintf("exceeded the %s limit: %s (exit code %d)", e.Limit, e.Err, e.ExitCode)
+	}
+	return fmt.Sprintf("%s (exit code %d)", e.Err, e.ExitCode)
+}
+
+// TailBuffer is an io.Writer that keeps the last bytes written to it. It is
+// used to capture a command's output without holding onto all of it.
+type TailBuffer struct {
+	size int
+
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+// NewTailBuffer returns a TailBuffer that keeps the last size bytes.
+func NewTailBuffer(size int) *TailBuffer {
+	return &TailBuffer{
+		size: size,
+	}
+}
+
+func (b *TailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.size; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+		b.truncated = true
+	}
+
+	return len(p), nil
+}
+
+// String returns the bytes that were kept. It starts with "..." if earlier
+// ones were dropped.
+func (b *TailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.truncated {
+		return "..." + string(b.buf)
+	}
+	return string(b.buf)
+}
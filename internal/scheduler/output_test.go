@@ -0,0 +1,31 @@
+package scheduler_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/poy/cf-faas/internal/scheduler"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+func TestTailBuffer(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.Spec("it keeps everything that fits", func(t *testing.T) {
+		b := scheduler.NewTailBuffer(10)
+		fmt.Fprint(b, "abc")
+		fmt.Fprint(b, "def")
+		Expect(t, b.String()).To(Equal("abcdef"))
+	})
+
+	o.Spec("it keeps the end of what was written", func(t *testing.T) {
+		b := scheduler.NewTailBuffer(5)
+		fmt.Fprint(b, "abcdef")
+		fmt.Fprint(b, "gh")
+		Expect(t, b.String()).To(Equal("...defgh"))
+	})
+}
@@ -0,0 +1,216 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ResidentExecutor keeps a single process running for each command and hands
+// it relay addresses instead of starting a new process for every request.
+// The process (via faas.Serve) long-polls the ResidentExecutor for its next
+// relay address and token.
+type ResidentExecutor struct {
+	addr    string
+	e       Executor
+	waitFor time.Duration
+	log     *log.Logger
+
+	mu    sync.Mutex
+	count int
+	procs map[string]*residentProcess
+	paths map[string]*residentProcess
+	done  chan struct{}
+	once  sync.Once
+}
+
+type residentProcess struct {
+	path   string
+	work   chan residentWork
+	exited chan struct{}
+
+	// answered is closed once the process has answered the relay it was
+	// last given. It is guarded by the ResidentExecutor's mutex.
+	answered chan struct{}
+}
+
+type residentWork struct {
+	Href  string `json:"href"`
+	Token string `json:"token,omitempty"`
+
+	answered chan struct{}
+}
+
+// NewResidentExecutor returns a new ResidentExecutor. The addr is the address
+// the ResidentExecutor is being served from and is given to each process via
+// CF_FAAS_WORK_ADDR. The Executor is used to start each process. waitFor is
+// both how long a request waits for the process to be ready and how long a
+// process' long-poll waits for a request.
+func NewResidentExecutor(
+	addr string,
+	e Executor,
+	waitFor time.Duration,
+	log *log.Logger,
+) *ResidentExecutor {
+	return &ResidentExecutor{
+		addr:    addr,
+		e:       e,
+		waitFor: waitFor,
+		log:     log,
+		procs:   make(map[string]*residentProcess),
+		paths:   make(map[string]*residentProcess),
+		done:    make(chan struct{}),
+	}
+}
+
+// Execute hands the relay address (CF_FAAS_RELAY_ADDR) and token
+// (CF_FAAS_RELAY_TOKEN) to the resident process for the given command. If
+// the process is not running, it is started. It returns once the process has
+// answered the relay (which it does before it long-polls again) or exits.
+// The process outlives the context, it is only used to give up on the work.
+func (r *ResidentExecutor) Execute(ctx context.Context, cwd string, envs map[string]string, command string) error {
+	p, err := r.process(cwd, envs, command)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(r.waitFor)
+	defer timer.Stop()
+
+	work := residentWork{
+		Href:     envs["CF_FAAS_RELAY_ADDR"],
+		Token:    envs["CF_FAAS_RELAY_TOKEN"],
+		answered: make(chan struct{}),
+	}
+
+	select {
+	case p.work <- work:
+	case <-p.exited:
+		return errors.New("resident process exited")
+	case <-r.done:
+		return errors.New("resident executor is stopped")
+	case <-timer.C:
+		return errors.New("timed out waiting for resident process")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-work.answered:
+		return nil
+	case <-p.exited:
+		return errors.New("resident process exited before answering the request")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop tells every resident process to exit. Any further work is rejected.
+func (r *ResidentExecutor) Stop() {
+	r.once.Do(func() {
+		close(r.done)
+	})
+}
+
+// ServeHTTP is long-polled by resident processes. It responds with a 200 and
+// the relay address and token, a 204 if there wasn't any work or a 410 if the
+// process should exit.
+func (r *ResidentExecutor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.mu.Lock()
+	p, ok := r.paths[req.URL.Path]
+	if ok && p.answered != nil {
+		// The process only polls once it is done with its last request.
+		close(p.answered)
+		p.answered = nil
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), r.waitFor)
+	defer cancel()
+
+	select {
+	case work := <-p.work:
+		r.mu.Lock()
+		p.answered = work.answered
+		r.mu.Unlock()
+
+		data, err := json.Marshal(work)
+		if err != nil {
+			r.log.Panicf("failed to marshal data: %s", err)
+		}
+
+		w.Write(data)
+	case <-r.done:
+		w.WriteHeader(http.StatusGone)
+	case <-ctx.Done():
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (r *ResidentExecutor) process(cwd string, envs map[string]string, command string) (*residentProcess, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil, errors.New("resident executor is stopped")
+	default:
+	}
+
+	key := fmt.Sprintf("%s:%s", cwd, command)
+	if p, ok := r.procs[key]; ok {
+		return p, nil
+	}
+
+	r.count++
+	p := &residentProcess{
+		path:   fmt.Sprintf("/%d", r.count),
+		work:   make(chan residentWork),
+		exited: make(chan struct{}),
+	}
+	r.procs[key] = p
+	r.paths[p.path] = p
+
+	// The relay address changes for each request, so the process is instead
+	// given where to fetch it from.
+	penvs := map[string]string{
+		"CF_FAAS_WORK_ADDR": r.addr + p.path,
+	}
+	for k, v := range envs {
+		if k == "CF_FAAS_RELAY_ADDR" || k == "CF_FAAS_RELAY_TOKEN" {
+			continue
+		}
+		penvs[k] = v
+	}
+
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			delete(r.procs, key)
+			delete(r.paths, p.path)
+			close(p.exited)
+		}()
+
+		if err := r.e.Execute(context.Background(), cwd, penvs, command); err != nil {
+			r.log.Printf("resident process (%s) exited: %s", command, err)
+		}
+	}()
+
+	return p, nil
+}
@@ -0,0 +1,232 @@
+package scheduler_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/poy/cf-faas/internal/scheduler"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TRE struct {
+	*testing.T
+	spyProcessExecutor *spyProcessExecutor
+	r                  *scheduler.ResidentExecutor
+}
+
+func TestResidentExecutor(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TRE {
+		spyProcessExecutor := newSpyProcessExecutor()
+		return TRE{
+			T:                  t,
+			spyProcessExecutor: spyProcessExecutor,
+			r: scheduler.NewResidentExecutor(
+				"http://some.url",
+				spyProcessExecutor,
+				100*time.Millisecond,
+				log.New(ioutil.Discard, "", 0),
+			),
+		}
+	})
+
+	o.AfterEach(func(t TRE) {
+		t.spyProcessExecutor.exit()
+	})
+
+	o.Spec("it starts the process with the work address", func(t TRE) {
+		go t.r.Execute(context.Background(), "some-path", map[string]string{
+			"CF_FAAS_RELAY_ADDR":  "http://some.relay",
+			"CF_FAAS_RELAY_TOKEN": "some-token",
+			"a":                   "b",
+		}, "some-command")
+
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+
+		envs := t.spyProcessExecutor.Envs()
+		Expect(t, envs["CF_FAAS_WORK_ADDR"]).To(StartWith("http://some.url/"))
+		Expect(t, envs["a"]).To(Equal("b"))
+		_, ok := envs["CF_FAAS_RELAY_ADDR"]
+		Expect(t, ok).To(BeFalse())
+		_, ok = envs["CF_FAAS_RELAY_TOKEN"]
+		Expect(t, ok).To(BeFalse())
+	})
+
+	o.Spec("it hands the relay address and token to the process", func(t TRE) {
+		go t.r.Execute(context.Background(), "some-path", map[string]string{
+			"CF_FAAS_RELAY_ADDR":  "http://some.relay",
+			"CF_FAAS_RELAY_TOKEN": "some-token",
+		}, "some-command")
+
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+
+		recorder := httptest.NewRecorder()
+		t.r.ServeHTTP(recorder, workRequest(t))
+
+		Expect(t, recorder.Code).To(Equal(http.StatusOK))
+		Expect(t, recorder.Body.String()).To(MatchJSON(`{"href":"http://some.relay","token":"some-token"}`))
+	})
+
+	o.Spec("it returns once the process polls for more work", func(t TRE) {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- t.r.Execute(context.Background(), "some-path", nil, "some-command")
+		}()
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+
+		t.r.ServeHTTP(httptest.NewRecorder(), workRequest(t))
+		Expect(t, errs).To(Always(Not(Receive())))
+
+		go t.r.ServeHTTP(httptest.NewRecorder(), workRequest(t))
+		Expect(t, errs).To(ViaPolling(Chain(Receive(), BeNil())))
+	})
+
+	o.Spec("it returns an error if the process exits before answering", func(t TRE) {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- t.r.Execute(context.Background(), "some-path", nil, "some-command")
+		}()
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+
+		t.r.ServeHTTP(httptest.NewRecorder(), workRequest(t))
+		t.spyProcessExecutor.exit()
+
+		Expect(t, errs).To(ViaPolling(Chain(Receive(), Not(BeNil()))))
+	})
+
+	o.Spec("it only starts one process per command", func(t TRE) {
+		go t.r.Execute(context.Background(), "some-path", nil, "some-command")
+		go t.r.Execute(context.Background(), "some-path", nil, "some-command")
+
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+		Expect(t, t.spyProcessExecutor.Called).To(Always(Equal(1)))
+	})
+
+	o.Spec("it returns a 204 if there isn't any work", func(t TRE) {
+		go t.r.Execute(context.Background(), "some-path", nil, "some-command")
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+
+		// Drain the pending work
+		t.r.ServeHTTP(httptest.NewRecorder(), workRequest(t))
+
+		recorder := httptest.NewRecorder()
+		t.r.ServeHTTP(recorder, workRequest(t))
+		Expect(t, recorder.Code).To(Equal(http.StatusNoContent))
+	})
+
+	o.Spec("it returns a 410 once stopped", func(t TRE) {
+		go t.r.Execute(context.Background(), "some-path", nil, "some-command")
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+		req := workRequest(t)
+
+		t.r.Stop()
+
+		recorder := httptest.NewRecorder()
+		t.r.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusGone))
+
+		Expect(t, t.r.Execute(context.Background(), "some-path", nil, "some-command")).To(Not(BeNil()))
+	})
+
+	o.Spec("it restarts the process if it exits", func(t TRE) {
+		go t.r.Execute(context.Background(), "some-path", nil, "some-command")
+		Expect(t, t.spyProcessExecutor.Called).To(ViaPolling(Equal(1)))
+		t.spyProcessExecutor.exit()
+
+		Expect(t, func() int {
+			go t.r.Execute(context.Background(), "some-path", nil, "some-command")
+			return t.spyProcessExecutor.Called()
+		}).To(ViaPolling(Equal(2)))
+	})
+
+	o.Spec("it returns an error if the process does not take the work", func(t TRE) {
+		Expect(t, t.r.Execute(context.Background(), "some-path", nil, "some-command")).To(Not(BeNil()))
+	})
+
+	o.Spec("it gives up on the work once the context is done", func(t TRE) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(t, t.r.Execute(ctx, "some-path", nil, "some-command")).To(Equal(context.Canceled))
+	})
+
+	o.Spec("it returns a 404 for an unknown process", func(t TRE) {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "http://some.url/invalid", nil)
+		Expect(t, err).To(BeNil())
+
+		t.r.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusNotFound))
+	})
+
+	o.Spec("it returns a 405 for anything other than a GET", func(t TRE) {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "http://some.url/1", nil)
+		Expect(t, err).To(BeNil())
+
+		t.r.ServeHTTP(recorder, req)
+		Expect(t, recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+}
+
+func workRequest(t TRE) *http.Request {
+	addr := t.spyProcessExecutor.Envs()["CF_FAAS_WORK_ADDR"]
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+type spyProcessExecutor struct {
+	mu     sync.Mutex
+	called int
+	envs   map[string]string
+	done   chan struct{}
+}
+
+func newSpyProcessExecutor() *spyProcessExecutor {
+	return &spyProcessExecutor{
+		done: make(chan struct{}),
+	}
+}
+
+func (s *spyProcessExecutor) Execute(ctx context.Context, cwd string, envs map[string]string, command string) error {
+	s.mu.Lock()
+	s.called++
+	s.envs = envs
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+func (s *spyProcessExecutor) exit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.done)
+	s.done = make(chan struct{})
+}
+
+func (s *spyProcessExecutor) Called() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.called
+}
+
+func (s *spyProcessExecutor) Envs() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.envs
+}
@@ -1,12 +1,15 @@
 package scheduler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 
+	faas "github.com/poy/cf-faas"
 	"github.com/poy/cf-faas/internal/internalapi"
 )
 
@@ -14,40 +17,76 @@ type PackageManager interface {
 	PackageForApp(appName string) (string, error)
 }
 
+// Executor runs a command. It must stop the command once the context is
+// done.
 type Executor interface {
-	Execute(cwd string, envs map[string]string, command string) error
+	Execute(ctx context.Context, cwd string, envs map[string]string, command string) error
 }
 
-type ExecutorFunc func(cwd string, envs map[string]string, command string) error
+type ExecutorFunc func(ctx context.Context, cwd string, envs map[string]string, command string) error
 
-func (f ExecutorFunc) Execute(cwd string, envs map[string]string, command string) error {
-	return f(cwd, envs, command)
+func (f ExecutorFunc) Execute(ctx context.Context, cwd string, envs map[string]string, command string) error {
+	return f(ctx, cwd, envs, command)
 }
 
+// defaultTimeout is used for work that does not have a timeout (e.g., from
+// an older cf-faas).
+const defaultTimeout = 30 * time.Second
+
 type Runner struct {
-	m    PackageManager
-	e    Executor
-	d    Doer
-	envs map[string]string
-	log  *log.Logger
+	m        PackageManager
+	e        Executor
+	resident Executor
+	d        Doer
+	envs     map[string]string
+	log      *log.Logger
+
+	// scratchDir is where scratch directories are created for isolated
+	// work.
+	scratchDir string
+
+	// streamTimeout is how long streamed work may run.
+	streamTimeout time.Duration
+
+	// ctx is cancelled to abort every running command.
+	ctx    context.Context
+	cancel func()
 }
 
+// NewRunner returns a new Runner. Commands are stopped once the work's
+// timeout passes. Streamed work may keep writing its response after that,
+// it is stopped after the streamTimeout instead.
 func NewRunner(
 	m PackageManager,
 	e Executor,
+	resident Executor,
 	d Doer,
 	envs map[string]string,
+	scratchDir string,
+	streamTimeout time.Duration,
 	log *log.Logger,
 ) *Runner {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Runner{
-		m:    m,
-		e:    e,
-		d:    d,
-		envs: envs,
-		log:  log,
+		m:             m,
+		e:             e,
+		resident:      resident,
+		d:             d,
+		envs:          envs,
+		log:           log,
+		scratchDir:    scratchDir,
+		streamTimeout: streamTimeout,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 }
 
+// Abort stops every running command. Each one reports a 503 to its relay
+// instead of a 500. Work submitted afterwards is aborted right away.
+func (r *Runner) Abort() {
+	r.cancel()
+}
+
 func (r *Runner) Submit(work internalapi.Work) {
 	path, err := r.m.PackageForApp(work.AppName)
 	if err != nil {
@@ -56,23 +95,129 @@ func (r *Runner) Submit(work internalapi.Work) {
 	}
 
 	envs := map[string]string{
-		"CF_FAAS_RELAY_ADDR": work.Href,
+		"CF_FAAS_RELAY_ADDR":  work.Href,
+		"CF_FAAS_RELAY_TOKEN": work.Token,
 	}
 	for k, v := range r.envs {
 		envs[k] = v
 	}
 
-	if err := r.e.Execute(path, envs, work.Command); err != nil {
-		req, err := http.NewRequest(http.MethodPost, work.Href, strings.NewReader(`{"status_code":500}`))
+	e := r.e
+	if work.Resident {
+		e = r.resident
+	}
+
+	// Isolated work gets a copy of the package and a directory of its own.
+	// Resident processes outlive the work, so they aren't isolated.
+	if work.Isolate && !work.Resident {
+		s, err := newScratch(r.scratchDir, path)
 		if err != nil {
-			r.log.Printf("failed to build request: %s", err)
+			r.log.Printf("failed to create scratch directory for app %s: %s", work.AppName, err)
+			r.respond(work, errorResponse(work, &ExitError{
+				Err:      fmt.Errorf("failed to create scratch directory: %s", err),
+				ExitCode: -1,
+			}))
+			return
 		}
+		defer func() {
+			if err := s.remove(); err != nil {
+				r.log.Printf("failed to remove scratch directory: %s", err)
+			}
+		}()
+
+		path = s.packageDir()
+		envs["CF_FAAS_SCRATCH_DIR"] = s.dir()
+		envs["TMPDIR"] = s.dir()
+	}
 
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
-		req = req.WithContext(ctx)
+	timeout := work.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	// The worker can't tell when a streamed response is started.
+	if work.Stream && r.streamTimeout > timeout {
+		timeout = r.streamTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.ctx, timeout)
+	defer cancel()
+
+	if le, ok := e.(LimitedExecutor); ok {
+		err = le.ExecuteWithLimits(ctx, path, envs, work.Command, work.Limits)
+	} else {
+		err = e.Execute(ctx, path, envs, work.Command)
+	}
+	if err == nil {
+		return
+	}
 
-		if _, err := r.d.Do(req); err != nil {
-			r.log.Printf("failed to submit request: %s", err)
+	body := []byte(`{"status_code":500}`)
+	if r.ctx.Err() != nil {
+		r.log.Printf("aborted %s for request %s", work.Command, work.RequestID)
+		body = []byte(`{"status_code":503}`)
+	} else {
+		exitErr, ok := err.(*ExitError)
+		if !ok {
+			exitErr = &ExitError{Err: err, ExitCode: -1}
 		}
+		r.log.Printf("%s failed for request %s: %s\nstdout: %s\nstderr: %s", work.Command, work.RequestID, exitErr, exitErr.Stdout, exitErr.Stderr)
+
+		if work.Debug || exitErr.Limit != "" {
+			body = errorResponse(work, exitErr)
+		}
+	}
+
+	r.respond(work, body)
+}
+
+// respond POSTs the response for failed work to its relay.
+func (r *Runner) respond(work internalapi.Work, body []byte) {
+	req, err := http.NewRequest(http.MethodPost, work.Href, bytes.NewReader(body))
+	if err != nil {
+		r.log.Printf("failed to build request: %s", err)
+		return
+	}
+	req.Header.Set(internalapi.TokenHeader, work.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	if _, err := r.d.Do(req); err != nil {
+		r.log.Printf("failed to submit request: %s", err)
+	}
+}
+
+// errorResponse is a 500 with why the command failed. The exit code and
+// output are only included when debugging.
+func errorResponse(work internalapi.Work, exitErr *ExitError) []byte {
+	body := faas.ErrorBody{
+		Error:     exitErr.Err.Error(),
+		RequestID: work.RequestID,
+		Limit:     exitErr.Limit,
+	}
+	if exitErr.Limit != "" {
+		body.Error = fmt.Sprintf("exceeded the %s limit", exitErr.Limit)
+	}
+	if work.Debug {
+		body.ExitCode = exitErr.ExitCode
+		body.Stdout = exitErr.Stdout
+		body.Stderr = exitErr.Stderr
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Panicf("failed to marshal error body: %s", err)
 	}
+
+	data, err = json.Marshal(faas.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       data,
+	})
+	if err != nil {
+		log.Panicf("failed to marshal response: %s", err)
+	}
+
+	return data
 }
@@ -1,12 +1,18 @@
 package scheduler_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	faas "github.com/poy/cf-faas"
 	"github.com/poy/cf-faas/internal/internalapi"
 	"github.com/poy/cf-faas/internal/scheduler"
 	"github.com/poy/onpar"
@@ -18,6 +24,7 @@ type TR struct {
 	*testing.T
 	spyPackageManager *spyPackageManager
 	spyExecutor       *spyExecutor
+	spyResident       *spyExecutor
 	spyDoer           *spyDoer
 	r                 *scheduler.Runner
 }
@@ -30,13 +37,15 @@ func TestRunenr(t *testing.T) {
 	o.BeforeEach(func(t *testing.T) TR {
 		spyPackageManager := newSpyPackageManager()
 		spyExecutor := newSpyExecutor()
+		spyResident := newSpyExecutor()
 		spyDoer := newSpyDoer()
 		return TR{
 			T:                 t,
 			spyPackageManager: spyPackageManager,
 			spyExecutor:       spyExecutor,
+			spyResident:       spyResident,
 			spyDoer:           spyDoer,
-			r:                 scheduler.NewRunner(spyPackageManager, spyExecutor, spyDoer, map[string]string{"a": "b", "c": "d"}, log.New(ioutil.Discard, "", 0)),
+			r:                 scheduler.NewRunner(spyPackageManager, spyExecutor, spyResident, spyDoer, map[string]string{"a": "b", "c": "d"}, "", time.Hour, log.New(ioutil.Discard, "", 0)),
 		}
 	})
 
@@ -44,6 +53,7 @@ func TestRunenr(t *testing.T) {
 		t.spyPackageManager.result = "some-path"
 		t.r.Submit(internalapi.Work{
 			Href:    "http://some.work",
+			Token:   "some-token",
 			Command: "some command",
 			AppName: "some-app-name",
 		})
@@ -53,9 +63,158 @@ func TestRunenr(t *testing.T) {
 		Expect(t, t.spyExecutor.envs["a"]).To(Equal("b"))
 		Expect(t, t.spyExecutor.envs["c"]).To(Equal("d"))
 		Expect(t, t.spyExecutor.envs["CF_FAAS_RELAY_ADDR"]).To(Equal("http://some.work"))
+		Expect(t, t.spyExecutor.envs["CF_FAAS_RELAY_TOKEN"]).To(Equal("some-token"))
 		Expect(t, t.spyExecutor.command).To(Equal("some command"))
 	})
 
+	o.Spec("it stops the command after the work's timeout", func(t TR) {
+		t.r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some command",
+			Timeout: 2 * time.Minute,
+		})
+		Expect(t, time.Until(t.spyExecutor.deadline).Seconds()).To(BeAbove(110))
+		Expect(t, time.Until(t.spyExecutor.deadline).Seconds()).To(BeBelow(121))
+
+		t.r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some command",
+		})
+		Expect(t, time.Until(t.spyExecutor.deadline).Seconds()).To(BeAbove(20))
+		Expect(t, time.Until(t.spyExecutor.deadline).Seconds()).To(BeBelow(31))
+	})
+
+	o.Spec("it doesn't stop streamed work at the work's timeout", func(t TR) {
+		var ctxErr error
+		e := scheduler.ExecutorFunc(func(ctx context.Context, cwd string, envs map[string]string, command string) error {
+			time.Sleep(200 * time.Millisecond)
+			ctxErr = ctx.Err()
+			return nil
+		})
+		r := scheduler.NewRunner(t.spyPackageManager, e, t.spyResident, t.spyDoer, nil, "", time.Minute, log.New(ioutil.Discard, "", 0))
+
+		r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some command",
+			Timeout: 50 * time.Millisecond,
+			Stream:  true,
+		})
+		Expect(t, ctxErr).To(BeNil())
+		Expect(t, t.spyDoer.Called()).To(Equal(0))
+
+		r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some command",
+			Timeout: 50 * time.Millisecond,
+		})
+		Expect(t, ctxErr).To(Not(BeNil()))
+	})
+
+	o.Spec("it stops streamed work after the stream timeout", func(t TR) {
+		t.r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some command",
+			Timeout: time.Second,
+			Stream:  true,
+		})
+		Expect(t, time.Until(t.spyExecutor.deadline).Minutes()).To(BeAbove(59))
+		Expect(t, time.Until(t.spyExecutor.deadline).Minutes()).To(BeBelow(61))
+	})
+
+	o.Spec("it uses the resident executor for resident work", func(t TR) {
+		t.spyPackageManager.result = "some-path"
+		t.r.Submit(internalapi.Work{
+			Href:     "http://some.work",
+			Command:  "some command",
+			AppName:  "some-app-name",
+			Resident: true,
+		})
+
+		Expect(t, t.spyExecutor.command).To(Equal(""))
+		Expect(t, t.spyResident.cwd).To(Equal("some-path"))
+		Expect(t, t.spyResident.envs["CF_FAAS_RELAY_ADDR"]).To(Equal("http://some.work"))
+		Expect(t, t.spyResident.command).To(Equal("some command"))
+	})
+
+	o.Spec("it runs isolated work in a scratch directory", func(t TR) {
+		dir, err := ioutil.TempDir("", "package")
+		Expect(t, err).To(BeNil())
+		defer os.RemoveAll(dir)
+		Expect(t, os.Mkdir(filepath.Join(dir, "some-dir"), 0755)).To(BeNil())
+		Expect(t, ioutil.WriteFile(filepath.Join(dir, "some-dir", "some-file"), []byte("some-data"), 0755)).To(BeNil())
+		t.spyPackageManager.result = dir
+
+		t.spyExecutor.onExecute = func(cwd string, envs map[string]string) {
+			data, err := ioutil.ReadFile(filepath.Join(cwd, "some-dir", "some-file"))
+			Expect(t, err).To(BeNil())
+			Expect(t, string(data)).To(Equal("some-data"))
+
+			// The package is read-only.
+			info, err := os.Stat(filepath.Join(cwd, "some-dir", "some-file"))
+			Expect(t, err).To(BeNil())
+			Expect(t, info.Mode().Perm()).To(Equal(os.FileMode(0555)))
+			info, err = os.Stat(filepath.Join(cwd, "some-dir"))
+			Expect(t, err).To(BeNil())
+			Expect(t, info.Mode().Perm()).To(Equal(os.FileMode(0555)))
+
+			scratchDir := envs["CF_FAAS_SCRATCH_DIR"]
+			Expect(t, envs["TMPDIR"]).To(Equal(scratchDir))
+			Expect(t, ioutil.WriteFile(filepath.Join(scratchDir, "some-file"), nil, 0644)).To(BeNil())
+		}
+
+		t.r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some-command",
+			Isolate: true,
+		})
+
+		Expect(t, t.spyExecutor.cwd).To(Not(Equal(dir)))
+		_, err = os.Stat(t.spyExecutor.cwd)
+		Expect(t, os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(t.spyExecutor.envs["CF_FAAS_SCRATCH_DIR"])
+		Expect(t, os.IsNotExist(err)).To(BeTrue())
+
+		// The package is left alone.
+		_, err = os.Stat(filepath.Join(dir, "some-dir", "some-file"))
+		Expect(t, err).To(BeNil())
+	})
+
+	o.Spec("it sends a 500 to the client if the scratch directory can't be created", func(t TR) {
+		t.spyPackageManager.result = "/some/missing/package"
+		t.r.Submit(internalapi.Work{
+			Href:      "http://some.work",
+			Token:     "some-token",
+			Command:   "some-command",
+			RequestID: "some-request-id",
+			Isolate:   true,
+		})
+		Expect(t, t.spyExecutor.command).To(Equal(""))
+		Expect(t, t.spyDoer.req).To(Not(BeNil()))
+		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some.work"))
+		Expect(t, t.spyDoer.req.Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.spyDoer.body, &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+
+		var body faas.ErrorBody
+		Expect(t, json.Unmarshal(resp.Body, &body)).To(BeNil())
+		Expect(t, body.Error).To(StartWith("failed to create scratch directory"))
+		Expect(t, body.RequestID).To(Equal("some-request-id"))
+	})
+
+	o.Spec("it does not isolate resident work", func(t TR) {
+		t.spyPackageManager.result = "some-path"
+		t.r.Submit(internalapi.Work{
+			Href:     "http://some.work",
+			Command:  "some-command",
+			Resident: true,
+			Isolate:  true,
+		})
+		Expect(t, t.spyResident.cwd).To(Equal("some-path"))
+		Expect(t, t.spyResident.envs).To(Not(HaveKey("CF_FAAS_SCRATCH_DIR")))
+	})
+
 	o.Spec("it does not submit work if PackageManager returns an error", func(t TR) {
 		t.spyPackageManager.result = "some-path"
 		t.spyPackageManager.err = errors.New("some-error")
@@ -71,6 +230,7 @@ func TestRunenr(t *testing.T) {
 		t.spyExecutor.err = errors.New("some-error")
 		t.r.Submit(internalapi.Work{
 			Href:    "http://some.work",
+			Token:   "some-token",
 			Command: "some-command",
 			AppName: "some-app-name",
 		})
@@ -79,10 +239,97 @@ func TestRunenr(t *testing.T) {
 		Expect(t, t.spyDoer.req.URL.String()).To(Equal("http://some.work"))
 		Expect(t, t.spyDoer.req.Method).To(Equal(http.MethodPost))
 		Expect(t, t.spyDoer.body).To(MatchJSON(`{"status_code":500}`))
+		Expect(t, t.spyDoer.req.Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
 
 		_, ok := t.spyDoer.req.Context().Deadline()
 		Expect(t, ok).To(BeTrue())
 	})
+
+	o.Spec("it stops the command and sends a 503 once it is aborted", func(t TR) {
+		t.spyExecutor.err = errors.New("some-error")
+		t.r.Abort()
+		t.r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Token:   "some-token",
+			Command: "some-command",
+			AppName: "some-app-name",
+		})
+
+		Expect(t, t.spyExecutor.ctxErr).To(Not(BeNil()))
+		Expect(t, t.spyDoer.req).To(Not(BeNil()))
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"status_code":503}`))
+		Expect(t, t.spyDoer.req.Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
+	})
+
+	o.Spec("it gives the executor the work's limits", func(t TR) {
+		t.r.Submit(internalapi.Work{
+			Href:    "http://some.work",
+			Command: "some-command",
+			Limits:  internalapi.Limits{MemoryMB: 128},
+		})
+		Expect(t, t.spyExecutor.limits.MemoryMB).To(Equal(128))
+	})
+
+	o.Spec("it reports which limit the command exceeded", func(t TR) {
+		t.spyExecutor.err = &scheduler.ExitError{
+			Err:      errors.New("signal: killed"),
+			ExitCode: -1,
+			Stdout:   "some-stdout",
+			Limit:    scheduler.MemoryLimit,
+		}
+		t.r.Submit(internalapi.Work{
+			Href:      "http://some.work",
+			Command:   "some-command",
+			RequestID: "some-request-id",
+		})
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.spyDoer.body, &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+
+		var body faas.ErrorBody
+		Expect(t, json.Unmarshal(resp.Body, &body)).To(BeNil())
+		Expect(t, body).To(Equal(faas.ErrorBody{
+			Error:     "exceeded the memory limit",
+			RequestID: "some-request-id",
+			Limit:     "memory",
+		}))
+	})
+
+	o.Spec("it includes why the command failed when debugging", func(t TR) {
+		t.spyExecutor.err = &scheduler.ExitError{
+			Err:      errors.New("exit status 2"),
+			ExitCode: 2,
+			Stdout:   "some-stdout",
+			Stderr:   "some-stderr",
+		}
+		work := internalapi.Work{
+			Href:      "http://some.work",
+			Command:   "some-command",
+			RequestID: "some-request-id",
+		}
+
+		t.r.Submit(work)
+		Expect(t, t.spyDoer.body).To(MatchJSON(`{"status_code":500}`))
+
+		work.Debug = true
+		t.r.Submit(work)
+
+		var resp faas.Response
+		Expect(t, json.Unmarshal(t.spyDoer.body, &resp)).To(BeNil())
+		Expect(t, resp.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(t, resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		var body faas.ErrorBody
+		Expect(t, json.Unmarshal(resp.Body, &body)).To(BeNil())
+		Expect(t, body).To(Equal(faas.ErrorBody{
+			Error:     "exit status 2",
+			RequestID: "some-request-id",
+			ExitCode:  2,
+			Stdout:    "some-stdout",
+			Stderr:    "some-stderr",
+		}))
+	})
 }
 
 type spyPackageManager struct {
@@ -102,19 +349,35 @@ func (s *spyPackageManager) PackageForApp(appName string) (string, error) {
 }
 
 type spyExecutor struct {
-	cwd     string
-	envs    map[string]string
-	command string
-	err     error
+	cwd      string
+	envs     map[string]string
+	command  string
+	deadline time.Time
+	ctxErr   error
+	limits   internalapi.Limits
+	err      error
+
+	// onExecute is called while the command would be running.
+	onExecute func(cwd string, envs map[string]string)
 }
 
 func newSpyExecutor() *spyExecutor {
 	return &spyExecutor{}
 }
 
-func (s *spyExecutor) Execute(cwd string, envs map[string]string, command string) error {
+func (s *spyExecutor) Execute(ctx context.Context, cwd string, envs map[string]string, command string) error {
+	s.deadline, _ = ctx.Deadline()
+	s.ctxErr = ctx.Err()
+	if s.onExecute != nil {
+		s.onExecute(cwd, envs)
+	}
 	s.cwd = cwd
 	s.envs = envs
 	s.command = command
 	return s.err
 }
+
+func (s *spyExecutor) ExecuteWithLimits(ctx context.Context, cwd string, envs map[string]string, command string, limits internalapi.Limits) error {
+	s.limits = limits
+	return s.Execute(ctx, cwd, envs, command)
+}
@@ -8,6 +8,8 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/poy/cf-faas/internal/internalapi"
@@ -17,52 +19,328 @@ type WorkSubmitter interface {
 	Submit(work internalapi.Work)
 }
 
+// AppLister reports which apps the worker has packages for.
+type AppLister interface {
+	ReadyApps() []string
+}
+
 type Doer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// Metrics creates the metrics Run reports.
+type Metrics interface {
+	NewCounter(name string) func(delta uint64)
+	NewGauge(name string) func(value float64)
+}
+
+// Backoff configures how Run retries when it can't get work from the
+// WorkerPool (e.g., its requests aren't getting through).
+type Backoff struct {
+	// Base is how long Run waits after the first failure. It doubles with
+	// each failure in a row.
+	Base time.Duration
+
+	// Max is the longest Run waits between attempts.
+	Max time.Duration
+
+	// MaxFailures is how many failures in a row it takes for Run to give up
+	// and return. 0 means it never gives up.
+	MaxFailures int
+}
+
+// delay returns how long to wait after the given number of failures in a
+// row. It is jittered so workers don't retry in lockstep.
+func (b Backoff) delay(failures int) time.Duration {
+	d := b.Base
+	for i := 1; i < failures && d < b.Max; i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Run long-polls the WorkerPool for work and submits it. Each request is
+// authenticated with the latest token from the TokenSource. Each response
+// includes the token for the next one. Each request includes the apps the
+// worker has packages for so it is only given work for those.
+//
+// The WorkerPool responds with a 204 when it doesn't have any work. A
+// request that times out is treated the same way. Once there hasn't been
+// any work for the idleTTL (and none is still running), Run returns. That is
+// unless the WorkerPool asks it to keep warm. An idleTTL of 0 means it never
+// runs out.
+//
+// Any other failure (e.g., the WorkerPool is unreachable or responds with
+// an unexpected status code) is retried with the Backoff until there are
+// too many in a row. That includes a 401 as the TokenSource might have a
+// new token by then. A restarted WorkerPool doesn't know the worker (its
+// tokens and address are new), so retries only help with failures along the
+// way (e.g., a dropped connection).
+//
+// At most slots pieces of work run at once. Run doesn't ask for more while
+// they are all taken. A slots of 0 means there isn't a limit. Once the
+// context is done, Run stops asking for work and returns once the running
+// work is done.
 func Run(
+	ctx context.Context,
 	addr string,
 	appInstance string,
+	tokens *TokenSource,
 	waitFor time.Duration,
+	idleTTL time.Duration,
+	slots int,
+	b Backoff,
+	apps AppLister,
 	s WorkSubmitter,
 	d Doer,
+	m Metrics,
 	log *log.Logger,
 ) {
+	a := newActivity()
+	defer a.wait()
+
+	sem := newExecSlots(slots)
+
+	retries := m.NewCounter("poll_retries")
+	setFailures := m.NewGauge("poll_failures")
+	var failures int
+
+	// succeeded records that the WorkerPool answered.
+	succeeded := func() {
+		if failures > 0 {
+			log.Printf("reached the pool again after %d failures", failures)
+		}
+		failures = 0
+		setFailures(0)
+	}
+
+	// failed records the failure and waits to try again. It returns false if
+	// Run should give up instead.
+	failed := func(reason string) bool {
+		failures++
+		setFailures(float64(failures))
+
+		if b.MaxFailures > 0 && failures >= b.MaxFailures {
+			log.Printf("%s, giving up after %d failures", reason, failures)
+			return false
+		}
+
+		if idleTTL > 0 && a.idleFor() >= idleTTL {
+			log.Printf("%s, no work for %s, exiting", reason, idleTTL)
+			return false
+		}
+
+		delay := b.delay(failures)
+		log.Printf("%s, retrying in %s (failure %d)", reason, delay, failures)
+		retries(1)
+
+		select {
+		case <-time.After(delay):
+			return true
+		case <-ctx.Done():
+			log.Printf("stopped asking for work")
+			return false
+		}
+	}
+
+	// idle handles a poll without work. It returns false if Run has been
+	// idle for too long.
+	idle := func(keepWarm bool) bool {
+		if keepWarm {
+			a.touch()
+			return true
+		}
+
+		if idleTTL > 0 && a.idleFor() >= idleTTL {
+			log.Printf("no work for %s, exiting", idleTTL)
+			return false
+		}
+		return true
+	}
+
 	for {
+		if !sem.acquire(ctx) {
+			log.Printf("stopped asking for work")
+			return
+		}
+
 		req, err := http.NewRequest(http.MethodGet, addr, nil)
 		if err != nil {
 			log.Fatalf("failed to create request for %s: %s", addr, err)
 		}
 		req.Header.Set("X-CF-APP-INSTANCE", appInstance)
+		req.Header.Set(internalapi.TokenHeader, tokens.Token())
+		req.Header.Set(internalapi.AppsHeader, strings.Join(apps.ReadyApps(), ","))
 		req.Header.Set("CACHE_BUSTER", fmt.Sprint(time.Now().UnixNano(), rand.Int63()))
 
-		ctx, _ := context.WithTimeout(context.Background(), waitFor)
-		req = req.WithContext(ctx)
+		reqCtx, cancel := context.WithTimeout(ctx, waitFor)
+		req = req.WithContext(reqCtx)
 
 		resp, err := d.Do(req)
 		if err != nil {
-			log.Printf("failed to make request: %s", err)
-			return
+			timedOut := reqCtx.Err() == context.DeadlineExceeded
+			cancel()
+			sem.release()
+			if ctx.Err() != nil {
+				log.Printf("stopped asking for work")
+				return
+			}
+
+			// The WorkerPool holds onto requests for less than waitFor. This
+			// one got lost along the way, there just wasn't any work.
+			if timedOut {
+				succeeded()
+				if !idle(false) {
+					return
+				}
+				continue
+			}
+
+			if !failed(fmt.Sprintf("failed to make request: %s", err)) {
+				return
+			}
+			continue
+		}
+
+		tokens.Set(resp.Header.Get(internalapi.NextTokenHeader))
+
+		if resp.StatusCode == http.StatusNoContent {
+			resp.Body.Close()
+			cancel()
+			sem.release()
+			succeeded()
+
+			if !idle(resp.Header.Get(internalapi.KeepWarmHeader) != "") {
+				return
+			}
+			continue
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("failed to read body: %s", err)
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			cancel()
+			sem.release()
+
+			if !failed(fmt.Sprintf("got unexpected status code %d: %s", resp.StatusCode, data)) {
 				return
 			}
-			log.Printf("got unexpected status code %d: %s", resp.StatusCode, data)
-			return
+			continue
 		}
 
 		var work internalapi.Work
 		err = json.NewDecoder(resp.Body).Decode(&work)
+		resp.Body.Close()
+		cancel()
 		if err != nil {
-			log.Printf("failed to unmarshal work: %s", err)
-			return
+			sem.release()
+			if !failed(fmt.Sprintf("failed to unmarshal work: %s", err)) {
+				return
+			}
+			continue
 		}
+		succeeded()
+
+		a.start()
+		go func() {
+			defer sem.release()
+			defer a.done()
+			s.Submit(work)
+		}()
+	}
+}
+
+// execSlots limits how much work runs at once. A nil execSlots is no limit.
+type execSlots chan struct{}
 
-		go s.Submit(work)
+func newExecSlots(n int) execSlots {
+	if n <= 0 {
+		return nil
 	}
+	return make(execSlots, n)
+}
+
+// acquire waits for a free slot. It returns false if the context is done
+// first.
+func (s execSlots) acquire(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s execSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// activity keeps track of when the worker last did something.
+type activity struct {
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	running int
+	last    time.Time
+}
+
+func newActivity() *activity {
+	return &activity{
+		last: time.Now(),
+	}
+}
+
+func (a *activity) start() {
+	a.wg.Add(1)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.running++
+	a.last = time.Now()
+}
+
+func (a *activity) done() {
+	defer a.wg.Done()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.running--
+	a.last = time.Now()
+}
+
+func (a *activity) touch() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last = time.Now()
+}
+
+// idleFor returns how long it has been since the worker did something. It
+// is 0 while work is running.
+func (a *activity) idleFor() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.running > 0 {
+		return 0
+	}
+	return time.Since(a.last)
+}
+
+// wait waits for the running work to finish.
+func (a *activity) wait() {
+	a.wg.Wait()
 }
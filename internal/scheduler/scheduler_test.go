@@ -1,6 +1,8 @@
 package scheduler_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -21,6 +23,13 @@ type TS struct {
 	*testing.T
 	spyDoer          *spyDoer
 	spyWorkSubmitter *spyWorkSubmitter
+	spyAppLister     *spyAppLister
+	idleTTL          time.Duration
+	slots            int
+	backoff          scheduler.Backoff
+	spyMetrics       *spyMetrics
+	tokens           *scheduler.TokenSource
+	ctx              context.Context
 }
 
 func TestScheduler(t *testing.T) {
@@ -33,6 +42,15 @@ func TestScheduler(t *testing.T) {
 			T:                t,
 			spyDoer:          newSpyDoer(),
 			spyWorkSubmitter: newSpyWorkSubmitter(),
+			spyAppLister:     newSpyAppLister(),
+			backoff: scheduler.Backoff{
+				Base:        time.Millisecond,
+				Max:         10 * time.Millisecond,
+				MaxFailures: 3,
+			},
+			spyMetrics: newSpyMetrics(),
+			tokens:     scheduler.NewTokenSource("some-token"),
+			ctx:        context.Background(),
 		}
 
 		return ts
@@ -48,10 +66,33 @@ func TestScheduler(t *testing.T) {
 		Expect(t, t.spyDoer.Req().Method).To(Equal(http.MethodGet))
 		Expect(t, t.spyDoer.Req().URL.String()).To(Equal("http://some.url"))
 		Expect(t, t.spyDoer.Req().Header.Get("X-CF-APP-INSTANCE")).To(Equal("app-instance"))
+		Expect(t, t.spyDoer.Req().Header.Get("X-CF-FAAS-TOKEN")).To(Equal("some-token"))
 
 		Expect(t, t.spyWorkSubmitter.Work().Href).To(Equal("http://some.work"))
 	})
 
+	o.Spec("it tells the pool which apps it has packages for", func(t TS) {
+		t.spyAppLister.SetApps([]string{"a", "b"})
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
+			StatusCode: 200,
+		}
+		start(t)
+		Expect(t, t.spyDoer.Req).To(ViaPolling(Not(BeNil())))
+		Expect(t, t.spyDoer.Req().Header.Get("X-CF-FAAS-APPS")).To(Equal("a,b"))
+	})
+
+	o.Spec("it uses the next token it is given", func(t TS) {
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Header:     http.Header{"X-Cf-Faas-Next-Token": []string{"next-token"}},
+			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
+			StatusCode: 200,
+		}
+		start(t)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(1)))
+		Expect(t, t.spyDoer.Req().Header.Get("X-CF-FAAS-TOKEN")).To(Equal("next-token"))
+	})
+
 	o.Spec("it keeps asking for work", func(t TS) {
 		t.spyDoer.m["GET:http://some.url"] = &http.Response{
 			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
@@ -61,25 +102,193 @@ func TestScheduler(t *testing.T) {
 		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(1)))
 	})
 
-	o.Spec("it exits if it gets a non-200", func(t TS) {
+	o.Spec("it exits after too many non-200s in a row", func(t TS) {
 		t.spyDoer.m["GET:http://some.url"] = &http.Response{
 			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
 			StatusCode: 500,
 		}
 		Expect(t, start(t)).To(ViaPolling(BeClosed()))
+		Expect(t, t.spyDoer.Called()).To(Equal(3))
+		Expect(t, t.spyMetrics.Counter("poll_retries")).To(Equal(uint64(2)))
+		Expect(t, t.spyMetrics.Gauge("poll_failures")).To(Equal(3.0))
+	})
+
+	o.Spec("it retries until it reaches the pool again", func(t TS) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		t.ctx = ctx
+		t.backoff.MaxFailures = 0
+		t.spyDoer.err = errors.New("some-error")
+		done := start(t)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(5)))
+		Expect(t, done).To(Not(BeClosed()))
+		Expect(t, t.spyMetrics.Gauge("poll_failures")).To(BeAbove(0))
+
+		t.spyDoer.mu.Lock()
+		t.spyDoer.err = nil
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
+		t.spyDoer.mu.Unlock()
+
+		Expect(t, func() float64 {
+			return t.spyMetrics.Gauge("poll_failures")
+		}).To(ViaPolling(Equal(0.0)))
+		Expect(t, int(t.spyMetrics.Counter("poll_retries"))).To(BeAbove(4))
+	})
+
+	o.Spec("it retries with the latest token once its token is rejected", func(t TS) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		t.ctx = ctx
+		t.backoff.MaxFailures = 0
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(`{"error":"invalid token"}`)),
+			StatusCode: http.StatusUnauthorized,
+		}
+		done := start(t)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(1)))
+		Expect(t, done).To(Not(BeClosed()))
+
+		t.tokens.Set("fresh-token")
+		Expect(t, func() string {
+			return t.spyDoer.Req().Header.Get("X-CF-FAAS-TOKEN")
+		}).To(ViaPolling(Equal("fresh-token")))
 	})
 
-	o.Spec("it exits if it doesn't get work", func(t TS) {
+	o.Spec("it treats a request that times out as one without work", func(t TS) {
+		t.idleTTL = 250 * time.Millisecond
 		t.spyDoer.block = true
+		done := start(t)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(1)))
+		Expect(t, done).To(ViaPolling(BeClosed()))
+		Expect(t, t.spyMetrics.Counter("poll_retries")).To(Equal(uint64(0)))
+	})
+
+	o.Spec("it keeps asking for work while there isn't any", func(t TS) {
+		t.idleTTL = 200 * time.Millisecond
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
+		done := start(t)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(5)))
+		Expect(t, done).To(Not(BeClosed()))
+		Expect(t, done).To(ViaPolling(BeClosed()))
+	})
+
+	o.Spec("it exits once it has been idle for the idle TTL", func(t TS) {
+		t.idleTTL = 50 * time.Millisecond
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
 		Expect(t, start(t)).To(ViaPolling(BeClosed()))
 	})
+
+	o.Spec("it does not exit while the pool wants it warm", func(t TS) {
+		t.idleTTL = 50 * time.Millisecond
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Header:     http.Header{"X-Cf-Faas-Keep-Warm": []string{"true"}},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
+		done := start(t)
+		Expect(t, done).To(Always(Not(BeClosed())))
+
+		t.spyDoer.mu.Lock()
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
+		t.spyDoer.mu.Unlock()
+		Expect(t, done).To(ViaPolling(BeClosed()))
+	})
+
+	o.Spec("it does not exit while work is running", func(t TS) {
+		t.idleTTL = 50 * time.Millisecond
+		t.spyWorkSubmitter.block = make(chan struct{})
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
+			StatusCode: 200,
+		}
+		done := start(t)
+		Expect(t, t.spyWorkSubmitter.Work).To(ViaPolling(Not(Equal(internalapi.Work{}))))
+
+		t.spyDoer.mu.Lock()
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
+		t.spyDoer.mu.Unlock()
+
+		Expect(t, done).To(Always(Not(BeClosed())))
+
+		close(t.spyWorkSubmitter.block)
+		Expect(t, done).To(ViaPolling(BeClosed()))
+	})
+
+	o.Spec("it does not ask for work while every slot is taken", func(t TS) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		t.ctx = ctx
+		t.slots = 1
+		t.backoff.Base = time.Minute
+		t.backoff.Max = time.Minute
+		t.spyWorkSubmitter.block = make(chan struct{})
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
+			StatusCode: 200,
+		}
+		start(t)
+		Expect(t, t.spyWorkSubmitter.Work).To(ViaPolling(Not(Equal(internalapi.Work{}))))
+		Expect(t, t.spyDoer.Called).To(Always(Equal(1)))
+
+		close(t.spyWorkSubmitter.block)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(Equal(2)))
+	})
+
+	o.Spec("it stops asking for work once the context is done", func(t TS) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.ctx = ctx
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			StatusCode: http.StatusNoContent,
+		}
+		done := start(t)
+		Expect(t, t.spyDoer.Called).To(ViaPolling(BeAbove(0)))
+
+		cancel()
+		Expect(t, done).To(ViaPolling(BeClosed()))
+	})
+
+	o.Spec("it waits for running work once the context is done", func(t TS) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.ctx = ctx
+		t.slots = 1
+		t.spyWorkSubmitter.block = make(chan struct{})
+		t.spyDoer.m["GET:http://some.url"] = &http.Response{
+			Body:       ioutil.NopCloser(strings.NewReader(`{"href":"http://some.work"}`)),
+			StatusCode: 200,
+		}
+		done := start(t)
+		Expect(t, t.spyWorkSubmitter.Work).To(ViaPolling(Not(Equal(internalapi.Work{}))))
+
+		cancel()
+		Expect(t, done).To(Always(Not(BeClosed())))
+
+		close(t.spyWorkSubmitter.block)
+		Expect(t, done).To(ViaPolling(BeClosed()))
+		Expect(t, t.spyDoer.Called()).To(Equal(1))
+	})
 }
 
 func start(t TS) chan struct{} {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		scheduler.Run("http://some.url", "app-instance", 100*time.Millisecond, t.spyWorkSubmitter, t.spyDoer, log.New(ioutil.Discard, "", 0))
+		scheduler.Run(t.ctx, "http://some.url", "app-instance", t.tokens, 100*time.Millisecond, t.idleTTL, t.slots, t.backoff, t.spyAppLister, t.spyWorkSubmitter, t.spyDoer, t.spyMetrics, log.New(ioutil.Discard, "", 0))
 	}()
 	return done
 }
@@ -149,9 +358,31 @@ func (s *spyDoer) Req() *http.Request {
 	return s.req
 }
 
-type spyWorkSubmitter struct {
+type spyAppLister struct {
 	mu   sync.Mutex
-	work internalapi.Work
+	apps []string
+}
+
+func newSpyAppLister() *spyAppLister {
+	return &spyAppLister{}
+}
+
+func (s *spyAppLister) ReadyApps() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apps
+}
+
+func (s *spyAppLister) SetApps(apps []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apps = apps
+}
+
+type spyWorkSubmitter struct {
+	mu    sync.Mutex
+	work  internalapi.Work
+	block chan struct{}
 }
 
 func newSpyWorkSubmitter() *spyWorkSubmitter {
@@ -160,8 +391,12 @@ func newSpyWorkSubmitter() *spyWorkSubmitter {
 
 func (s *spyWorkSubmitter) Submit(work internalapi.Work) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.work = work
+	s.mu.Unlock()
+
+	if s.block != nil {
+		<-s.block
+	}
 }
 
 func (s *spyWorkSubmitter) Work() internalapi.Work {
@@ -170,3 +405,44 @@ func (s *spyWorkSubmitter) Work() internalapi.Work {
 
 	return s.work
 }
+
+type spyMetrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	gauges   map[string]float64
+}
+
+func newSpyMetrics() *spyMetrics {
+	return &spyMetrics{
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+func (s *spyMetrics) NewCounter(name string) func(delta uint64) {
+	return func(delta uint64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.counters[name] += delta
+	}
+}
+
+func (s *spyMetrics) NewGauge(name string) func(value float64) {
+	return func(value float64) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.gauges[name] = value
+	}
+}
+
+func (s *spyMetrics) Counter(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counters[name]
+}
+
+func (s *spyMetrics) Gauge(name string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gauges[name]
+}
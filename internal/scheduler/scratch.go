@@ -0,0 +1,127 @@
+package scheduler
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// scratch is a fresh directory for a single run of a command. It has a
+// read-only copy of the package (the command's working directory) and a
+// writable directory. It is removed once the command is done.
+type scratch struct {
+	root string
+}
+
+// newScratch creates a scratch directory in the parent. If the parent is
+// empty, the default directory for temporary files is used.
+func newScratch(parent, packageDir string) (*scratch, error) {
+	root, err := ioutil.TempDir(parent, "faas-")
+	if err != nil {
+		return nil, err
+	}
+	s := &scratch{root: root}
+
+	if err := os.Mkdir(s.dir(), 0700); err != nil {
+		s.remove()
+		return nil, err
+	}
+
+	if err := copyReadOnly(packageDir, s.packageDir()); err != nil {
+		s.remove()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// packageDir is the read-only copy of the package.
+func (s *scratch) packageDir() string {
+	return filepath.Join(s.root, "package")
+}
+
+// dir is the writable directory.
+func (s *scratch) dir() string {
+	return filepath.Join(s.root, "scratch")
+}
+
+// remove deletes everything. The copy of the package has to be writable
+// again first.
+func (s *scratch) remove() error {
+	filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+
+	return os.RemoveAll(s.root)
+}
+
+// copyReadOnly copies the src directory to dst without any write
+// permissions. Symlinks are copied as they are.
+func copyReadOnly(src, dst string) error {
+	var dirs []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		mode := info.Mode().Perm() &^ 0222
+
+		switch {
+		case info.IsDir():
+			// Directories are made read-only once they are filled.
+			dirs = append(dirs, target)
+			return os.Mkdir(target, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, mode)
+		default:
+			// Sockets, devices and such aren't part of a package.
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], 0555); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,135 @@
+package scheduler_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/poy/cf-faas/internal/scheduler"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TSC struct {
+	*testing.T
+	parent     string
+	packageDir string
+}
+
+func TestScratch(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TSC {
+		parent, err := ioutil.TempDir("", "scratch")
+		if err != nil {
+			panic(err)
+		}
+
+		packageDir, err := ioutil.TempDir("", "package")
+		if err != nil {
+			panic(err)
+		}
+
+		files := map[string]string{
+			"some-file":              "some-data",
+			"some-dir/some-file":     "other-data",
+			"some-dir/nested/a-file": "nested-data",
+		}
+		for name, data := range files {
+			path := filepath.Join(packageDir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				panic(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(data), 0755); err != nil {
+				panic(err)
+			}
+		}
+		if err := os.Symlink("some-file", filepath.Join(packageDir, "some-link")); err != nil {
+			panic(err)
+		}
+
+		return TSC{
+			T:          t,
+			parent:     parent,
+			packageDir: packageDir,
+		}
+	})
+
+	o.AfterEach(func(t TSC) {
+		os.RemoveAll(t.parent)
+		os.RemoveAll(t.packageDir)
+	})
+
+	o.Spec("it copies the package without write permissions", func(t TSC) {
+		s, err := scheduler.NewScratch(t.parent, t.packageDir)
+		Expect(t, err).To(BeNil())
+		defer s.Remove()
+
+		data, err := ioutil.ReadFile(filepath.Join(s.PackageDir(), "some-dir", "nested", "a-file"))
+		Expect(t, err).To(BeNil())
+		Expect(t, string(data)).To(Equal("nested-data"))
+
+		for _, name := range []string{"", "some-file", "some-dir", "some-dir/some-file", "some-dir/nested", "some-dir/nested/a-file"} {
+			info, err := os.Stat(filepath.Join(s.PackageDir(), name))
+			Expect(t, err).To(BeNil())
+			Expect(t, info.Mode().Perm()).To(Equal(os.FileMode(0555)))
+		}
+
+		link, err := os.Readlink(filepath.Join(s.PackageDir(), "some-link"))
+		Expect(t, err).To(BeNil())
+		Expect(t, link).To(Equal("some-file"))
+
+		// Permissions don't stop root.
+		if os.Geteuid() != 0 {
+			err := ioutil.WriteFile(filepath.Join(s.PackageDir(), "some-file"), nil, 0644)
+			Expect(t, err).To(Not(BeNil()))
+			err = ioutil.WriteFile(filepath.Join(s.PackageDir(), "new-file"), nil, 0644)
+			Expect(t, err).To(Not(BeNil()))
+		}
+
+		// The package itself is left alone.
+		info, err := os.Stat(filepath.Join(t.packageDir, "some-file"))
+		Expect(t, err).To(BeNil())
+		Expect(t, info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+	})
+
+	o.Spec("it has a writable directory", func(t TSC) {
+		s, err := scheduler.NewScratch(t.parent, t.packageDir)
+		Expect(t, err).To(BeNil())
+		defer s.Remove()
+
+		info, err := os.Stat(s.Dir())
+		Expect(t, err).To(BeNil())
+		Expect(t, info.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		Expect(t, ioutil.WriteFile(filepath.Join(s.Dir(), "some-file"), []byte("some-data"), 0644)).To(BeNil())
+	})
+
+	o.Spec("it removes everything even though the copy is read-only", func(t TSC) {
+		s, err := scheduler.NewScratch(t.parent, t.packageDir)
+		Expect(t, err).To(BeNil())
+
+		// The command can leave read-only things behind too.
+		Expect(t, os.Mkdir(filepath.Join(s.Dir(), "some-dir"), 0700)).To(BeNil())
+		Expect(t, ioutil.WriteFile(filepath.Join(s.Dir(), "some-dir", "some-file"), nil, 0444)).To(BeNil())
+		Expect(t, os.Chmod(filepath.Join(s.Dir(), "some-dir"), 0500)).To(BeNil())
+
+		Expect(t, s.Remove()).To(BeNil())
+
+		entries, err := ioutil.ReadDir(t.parent)
+		Expect(t, err).To(BeNil())
+		Expect(t, entries).To(HaveLen(0))
+	})
+
+	o.Spec("it removes the scratch directory if the package can't be copied", func(t TSC) {
+		_, err := scheduler.NewScratch(t.parent, filepath.Join(t.packageDir, "missing"))
+		Expect(t, err).To(Not(BeNil()))
+
+		entries, err := ioutil.ReadDir(t.parent)
+		Expect(t, err).To(BeNil())
+		Expect(t, entries).To(HaveLen(0))
+	})
+}
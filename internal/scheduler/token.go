@@ -0,0 +1,37 @@
+package scheduler
+
+import "sync"
+
+// TokenSource holds the latest token for the WorkerPool. A token can be used
+// once for asking for work and once for a heartbeat. Heartbeat shares the
+// tokens it gets so Run has a fresh one even after every slot was taken for
+// longer than a token lasts.
+type TokenSource struct {
+	mu    sync.Mutex
+	token string
+}
+
+// NewTokenSource returns a TokenSource that starts with the given token.
+func NewTokenSource(token string) *TokenSource {
+	return &TokenSource{
+		token: token,
+	}
+}
+
+// Token returns the latest token.
+func (s *TokenSource) Token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// Set replaces the token. An empty token is ignored.
+func (s *TokenSource) Set(token string) {
+	if token == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
@@ -1,6 +1,10 @@
 package faas
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 type ConvertRequest struct {
 	Functions []ConvertFunction `json:"functions"`
@@ -14,8 +18,41 @@ type ConvertFunction struct {
 }
 
 type ConvertHandler struct {
-	Command string `json:"command"`
-	AppName string `json:"app_name,omitempty"`
+	Command  string `json:"command"`
+	AppName  string `json:"app_name,omitempty"`
+	Resident bool   `json:"resident,omitempty"`
+
+	// MaxConcurrency limits how many copies of the handler run at once.
+	// Zero is no limit.
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// ConcurrencyPolicy is either "queue" (the default) or "reject".
+	ConcurrencyPolicy string `json:"concurrency_policy,omitempty"`
+
+	// Priority and Weight decide whose requests get a worker first. The
+	// Weight defaults to 1.
+	Priority int `json:"priority,omitempty"`
+	Weight   int `json:"weight,omitempty"`
+
+	// Debug includes the exit code and output of a failed command in the
+	// body of its 500.
+	Debug bool `json:"debug,omitempty"`
+
+	// Limits are the resources each run of the command gets.
+	Limits *ConvertLimits `json:"limits,omitempty"`
+
+	// Isolate runs each run of the command in a read-only copy of the
+	// package with a scratch directory of its own.
+	Isolate bool `json:"isolate,omitempty"`
+}
+
+// ConvertLimits are the resources a command gets. Zero is no limit.
+type ConvertLimits struct {
+	MemoryMB  int           `json:"memory_mb,omitempty"`
+	CPUTime   time.Duration `json:"cpu_time,omitempty"`
+	OpenFiles int           `json:"open_files,omitempty"`
+	Processes int           `json:"processes,omitempty"`
+	OutputKB  int           `json:"output_kb,omitempty"`
 }
 
 type ConvertResponse struct {
@@ -30,8 +67,92 @@ type ConvertHTTPFunction struct {
 type ConvertHTTPEvent struct {
 	Path   string `yaml:"path"`
 	Method string `yaml:"method"`
-	Cache  struct {
+	Stream bool   `yaml:"stream"`
+
+	// Timeout is how long to wait for the function. It defaults to 10s.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	Cache struct {
 		Duration time.Duration `yaml:"duration"`
 		Header   []string      `yaml:"header"`
 	} `yaml:"cache"`
+
+	// Queue limits how many requests wait for a worker and for how long.
+	// Past either, requests are answered with a 503. Zero is no limit.
+	Queue struct {
+		MaxLength int           `json:"max_length,omitempty"`
+		MaxWait   time.Duration `json:"max_wait,omitempty"`
+	} `json:"queue"`
+}
+
+// UnmarshalJSON reads the timeout and the queue's max_wait either as
+// nanoseconds or, like the manifest, as duration strings (e.g., "2m").
+func (e *ConvertHTTPEvent) UnmarshalJSON(data []byte) error {
+	type event ConvertHTTPEvent
+	var v struct {
+		*event
+		Timeout convertDuration `json:"timeout"`
+		Queue   struct {
+			MaxLength int             `json:"max_length"`
+			MaxWait   convertDuration `json:"max_wait"`
+		} `json:"queue"`
+	}
+	v.event = (*event)(e)
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	e.Timeout = time.Duration(v.Timeout)
+	e.Queue.MaxLength = v.Queue.MaxLength
+	e.Queue.MaxWait = time.Duration(v.Queue.MaxWait)
+
+	return nil
+}
+
+// UnmarshalJSON reads the cpu_time either as nanoseconds or, like the
+// manifest, as a duration string (e.g., "30s").
+func (l *ConvertLimits) UnmarshalJSON(data []byte) error {
+	type limits ConvertLimits
+	var v struct {
+		*limits
+		CPUTime convertDuration `json:"cpu_time"`
+	}
+	v.limits = (*limits)(l)
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	l.CPUTime = time.Duration(v.CPUTime)
+
+	return nil
+}
+
+// convertDuration is a time.Duration that can be read from a JSON number
+// of nanoseconds or a duration string.
+type convertDuration time.Duration
+
+func (d *convertDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid duration %s", data)
+		}
+		*d = convertDuration(n)
+		return nil
+	}
+
+	if s == "" {
+		return nil
+	}
+
+	dd, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = convertDuration(dd)
+
+	return nil
 }
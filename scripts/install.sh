@@ -69,7 +69,7 @@ MANIFEST=$(cat $manifest_path) RESOLVER_URLS=$resolvers VALIDATE_RESOLVERS=true
 echo "building CF-FaaS binaries..."
 GOOS=linux go build -o $TEMP_DIR/cf-faas ./cmd/cf-faas &> /dev/null || fail "failed to build cf-faas"
 GOOS=linux go build -o $TEMP_DIR/task-runner ./cmd/task-runner &> /dev/null || fail "failed to build cf-faas' task-runner"
-GOOS=linux go build -o $TEMP_DIR/worker ./cmd/worker &> /dev/null || fail "failed to build cf-faas' worker"
+GOOS=linux go build -ldflags "-X main.version=$(git rev-parse --short HEAD 2> /dev/null || echo dev)" -o $TEMP_DIR/worker ./cmd/worker &> /dev/null || fail "failed to build cf-faas' worker"
 GOOS=linux go build -o $TEMP_DIR/manifest-parser ./cmd/manifest-parser &> /dev/null || fail "failed to build cf-faas' manifest-parser"
 cp cmd/cf-faas/run.sh $TEMP_DIR
 echo "done building CF-FaaS binaries."
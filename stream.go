@@ -0,0 +1,246 @@
+package faas
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/poy/cf-faas/internal/internalapi"
+)
+
+// ResponseWriter is used by a StreamHandler to write the response. Like an
+// http.ResponseWriter, the status code and header are sent with the first
+// call to WriteHeader or Write.
+type ResponseWriter interface {
+	Header() http.Header
+	WriteHeader(statusCode int)
+	Write([]byte) (int, error)
+}
+
+// StreamHandler is a Handler that reads the request body and writes the
+// response as streams. Start, Serve and Client use HandleStream for any
+// Handler that implements it. The Request's Body is nil, the body is read
+// from the given reader instead.
+//
+// Data is only relayed to the caller as it is written for events that have
+// stream enabled in the manifest. Otherwise cf-faas buffers both bodies.
+type StreamHandler interface {
+	Handler
+	HandleStream(ctx context.Context, w ResponseWriter, r Request, body io.Reader) error
+}
+
+type StreamHandlerFunc func(ctx context.Context, w ResponseWriter, r Request, body io.Reader) error
+
+// Handle invokes the StreamHandlerFunc and buffers the response.
+func (f StreamHandlerFunc) Handle(r Request) (Response, error) {
+	body := r.Body
+	r.Body = nil
+
+	w := &streamWriter{header: http.Header{}}
+	if err := f(context.Background(), w, r, bytes.NewReader(body)); err != nil {
+		return Response{}, err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return Response{
+		StatusCode: w.status,
+		Header:     w.header,
+		Body:       w.buf.Bytes(),
+	}, nil
+}
+
+func (f StreamHandlerFunc) HandleStream(ctx context.Context, w ResponseWriter, r Request, body io.Reader) error {
+	return f(ctx, w, r, body)
+}
+
+func (c *Client) handleStream(h StreamHandler, r relay) error {
+	request, body, resp, err := c.fetchRequest(r)
+	if err != nil {
+		return err
+	}
+	defer c.drain(resp)
+
+	// The relay only streams when it uses the multipart encoding.
+	multipart := body != nil
+	if !multipart {
+		body = bytes.NewReader(request.Body)
+		request.Body = nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &streamWriter{
+		c:         c,
+		relay:     r,
+		multipart: multipart,
+		cancel:    cancel,
+		header:    http.Header{},
+	}
+
+	// The deadline only applies until the response is started.
+	if request.Timeout > 0 {
+		t := time.AfterFunc(request.Timeout, func() {
+			if !w.committed() {
+				cancel()
+			}
+		})
+		defer t.Stop()
+	}
+
+	_, err = invoke(func() (Response, error) {
+		return Response{}, h.HandleStream(ctx, w, request, body)
+	})
+
+	if ctx.Err() != nil && !w.committed() {
+		c.log.Printf("deadline exceeded, dropping response")
+		return nil
+	}
+
+	if err != nil {
+		c.logHandlerError(err)
+
+		if w.committed() {
+			// It is too late to change the status code. Abort the response
+			// so the caller can tell it was cut short.
+			w.abort(err)
+			return nil
+		}
+
+		w.reset(c.errorResponse(request, err))
+	}
+
+	return w.close()
+}
+
+// streamWriter is the ResponseWriter for a StreamHandler. When the relay
+// uses the multipart encoding, the response is POSTed as it is written.
+// Otherwise it is buffered and POSTed once the handler returns.
+type streamWriter struct {
+	c         *Client
+	relay     relay
+	multipart bool
+	cancel    func()
+	header    http.Header
+
+	mu     sync.Mutex
+	status int
+
+	buf bytes.Buffer
+
+	pw     *io.PipeWriter
+	mw     *internalapi.MultipartWriter
+	body   io.Writer
+	result chan error
+	err    error
+}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.status != 0 {
+		return
+	}
+	w.status = statusCode
+
+	if w.multipart {
+		w.start()
+	}
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+
+	if !w.multipart {
+		return w.buf.Write(p)
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.body.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// committed reports whether the status code and header have been sent to
+// the relay.
+func (w *streamWriter) committed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.multipart && w.status != 0
+}
+
+// start begins the POST. It must be called with the lock held.
+func (w *streamWriter) start() {
+	pr, pw := io.Pipe()
+	w.pw = pw
+	w.mw = internalapi.NewMultipartWriter(pw)
+	w.result = make(chan error, 1)
+
+	go func() {
+		err := w.c.postStream(w.relay, w.mw.ContentType(), pr)
+		if err != nil {
+			w.cancel()
+		}
+		pr.CloseWithError(err)
+		w.result <- err
+	}()
+
+	w.body, w.err = w.mw.WriteEnvelope(Response{
+		StatusCode: w.status,
+		Header:     w.header,
+	})
+}
+
+// reset replaces a response that has not been committed.
+func (w *streamWriter) reset(resp Response) {
+	w.mu.Lock()
+	w.status = 0
+	w.mu.Unlock()
+
+	w.header = resp.Header
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+
+	w.buf.Reset()
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+func (w *streamWriter) close() error {
+	w.WriteHeader(http.StatusOK)
+
+	if !w.multipart {
+		return w.c.postResponse(w.relay, Response{
+			StatusCode: w.status,
+			Header:     w.header,
+			Body:       w.buf.Bytes(),
+		}, false)
+	}
+
+	if err := w.mw.Close(); err != nil {
+		w.pw.CloseWithError(err)
+	} else {
+		w.pw.Close()
+	}
+
+	return <-w.result
+}
+
+func (w *streamWriter) abort(err error) {
+	w.pw.CloseWithError(err)
+	<-w.result
+}
@@ -0,0 +1,172 @@
+package faas_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	faas "github.com/poy/cf-faas"
+	"github.com/poy/cf-faas/faastest"
+	"github.com/poy/cf-faas/internal/handlers"
+	"github.com/poy/cf-faas/internal/internalapi"
+	"github.com/poy/cf-faas/internal/metrics"
+	"github.com/poy/onpar"
+	. "github.com/poy/onpar/expect"
+	. "github.com/poy/onpar/matchers"
+)
+
+type TS struct {
+	*testing.T
+	server *httptest.Server
+	next   chan struct{}
+	errs   chan error
+}
+
+func TestStream(t *testing.T) {
+	t.Parallel()
+	o := onpar.New()
+	defer o.Run(t)
+
+	o.BeforeEach(func(t *testing.T) TS {
+		ts := TS{
+			T:    t,
+			next: make(chan struct{}),
+			errs: make(chan error, 1),
+		}
+
+		h := faas.StreamHandlerFunc(func(ctx context.Context, w faas.ResponseWriter, r faas.Request, body io.Reader) error {
+			upload, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+
+			if string(upload) == "fail" {
+				return faas.Error{Status: http.StatusTeapot}
+			}
+
+			w.Header().Set("X-Upload", string(upload))
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("chunk-1"))
+			<-ts.next
+			w.Write([]byte("chunk-2"))
+			return nil
+		})
+
+		mux := http.NewServeMux()
+		ts.server = httptest.NewServer(mux)
+		logger := log.New(ioutil.Discard, "", 0)
+		tokens := handlers.NewRandomTokens()
+		relayer := handlers.NewRequestRelayer(ts.server.URL, "relay", "some-guid:0", tokens, logger)
+
+		mux.HandleFunc("/relay/", func(w http.ResponseWriter, r *http.Request) {
+			// Normally set by the CF router.
+			r.Header.Set("X-Forwarded-Proto", "https")
+			relayer.ServeHTTP(w, r)
+		})
+		mux.Handle("/stream", handlers.NewHTTPEvent(internalapi.Work{}, true, handlers.QueueLimits{}, relayer, workSubmitterFunc(func(w internalapi.Work) {
+			go func() {
+				u, err := url.Parse(w.Href)
+				if err != nil {
+					panic(err)
+				}
+
+				c, err := faas.NewClient(
+					faas.WithRelayAddr(w.Href),
+					faas.WithRelayToken(tokens.Sign(u.Path, time.Minute)),
+					faas.WithAppInstance("some-app-instance"),
+					faas.WithLogger(logger),
+				)
+				if err != nil {
+					panic(err)
+				}
+				ts.errs <- c.Run(h)
+			}()
+		}), metrics.New(nil), logger))
+
+		return ts
+	})
+
+	o.AfterEach(func(t TS) {
+		t.server.Close()
+	})
+
+	o.Spec("it relays the response as it is written", func(t TS) {
+		resp, err := http.Post(t.server.URL+"/stream", "text/plain", strings.NewReader("some-upload"))
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+
+		Expect(t, resp.StatusCode).To(Equal(http.StatusCreated))
+		Expect(t, resp.Header.Get("X-Upload")).To(Equal("some-upload"))
+
+		chunk := make([]byte, len("chunk-1"))
+		_, err = io.ReadFull(resp.Body, chunk)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(chunk)).To(Equal("chunk-1"))
+
+		close(t.next)
+		rest, err := ioutil.ReadAll(resp.Body)
+		Expect(t, err).To(BeNil())
+		Expect(t, string(rest)).To(Equal("chunk-2"))
+		Expect(t, <-t.errs).To(BeNil())
+	})
+
+	o.Spec("it uses the error status code if nothing was written", func(t TS) {
+		resp, err := http.Post(t.server.URL+"/stream", "text/plain", strings.NewReader("fail"))
+		Expect(t, err).To(BeNil())
+		defer resp.Body.Close()
+
+		Expect(t, resp.StatusCode).To(Equal(http.StatusTeapot))
+		Expect(t, <-t.errs).To(BeNil())
+	})
+
+	o.Spec("it buffers for relays that only speak JSON", func(t TS) {
+		close(t.next)
+		resp, err := faastest.Invoke(faas.StreamHandlerFunc(func(ctx context.Context, w faas.ResponseWriter, r faas.Request, body io.Reader) error {
+			upload, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+
+			if r.Body != nil {
+				return errors.New("expected the body to only be given via the reader")
+			}
+
+			fmt.Fprintf(w, "got %s", upload)
+			return nil
+		}), faas.Request{Body: []byte("some-upload")})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(t, string(resp.Body)).To(Equal("got some-upload"))
+	})
+
+	o.Spec("StreamHandlerFunc buffers when used as a Handler", func(t TS) {
+		resp, err := faas.StreamHandlerFunc(func(ctx context.Context, w faas.ResponseWriter, r faas.Request, body io.Reader) error {
+			w.Header().Set("A", "a")
+			w.WriteHeader(http.StatusAccepted)
+			io.Copy(w, body)
+			return nil
+		}).Handle(faas.Request{Body: []byte("some-body")})
+		Expect(t, err).To(BeNil())
+
+		Expect(t, resp.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(t, resp.Header.Get("A")).To(Equal("a"))
+		Expect(t, string(resp.Body)).To(Equal("some-body"))
+	})
+}
+
+type workSubmitterFunc func(internalapi.Work)
+
+func (f workSubmitterFunc) SubmitWork(ctx context.Context, w internalapi.Work) error {
+	f(w)
+	return nil
+}